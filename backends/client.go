@@ -3,6 +3,7 @@ package backends
 import (
 	"errors"
 	"strings"
+	"time"
 
 	"github.com/kelseyhightower/confd/backends/consul"
 	"github.com/kelseyhightower/confd/backends/dynamodb"
@@ -16,17 +17,103 @@ import (
 	"github.com/kelseyhightower/confd/backends/vault"
 	"github.com/kelseyhightower/confd/backends/zookeeper"
 	"github.com/kelseyhightower/confd/log"
+	util "github.com/kelseyhightower/confd/util"
 )
 
 // The StoreClient interface is implemented by objects that can retrieve
-// key/value pairs from a backend store.
+// key/value pairs from a backend store. Store clients holding connections
+// to the backend, such as those of the redis, zookeeper and etcdv3
+// backends, also implement io.Closer; Close releases them once the client
+// is no longer used.
 type StoreClient interface {
 	GetValues(keys []string) (map[string]string, error)
 	WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error)
 }
 
-// New is used to create a storage client based on our configuration.
+// The TTLStoreClient interface is implemented by store clients that can also
+// report the remaining time to live, in seconds, of the keys they return.
+// Keys without a TTL are omitted from the returned TTL map. Only the etcd
+// backend implements it.
+type TTLStoreClient interface {
+	StoreClient
+	GetValuesWithTTL(keys []string) (map[string]string, map[string]int64, error)
+}
+
+// The WriteStoreClient interface is implemented by store clients that can
+// also write a value to a key, as template resources with write_back_key
+// do. Only the etcd and etcdv3 backends implement it.
+type WriteStoreClient interface {
+	StoreClient
+	SetValue(key, value string) error
+}
+
+// ErrWriteUnsupported is returned when writing a key to a backend whose
+// store client is not a WriteStoreClient.
+var ErrWriteUnsupported = errors.New("the backend does not support writing keys")
+
+// The KeyInfoClient interface is implemented by store clients that can
+// describe how a single key is stored, as -explain does: its value, the
+// index it was last modified at and its remaining time to live in seconds,
+// 0 if it does not expire. Only the etcd backend implements it.
+type KeyInfoClient interface {
+	StoreClient
+	GetKeyInfo(key string) (value string, modifiedIndex uint64, ttl int64, err error)
+}
+
+// ErrKeyInfoUnsupported is returned when describing a key of a backend
+// whose store client is not a KeyInfoClient.
+var ErrKeyInfoUnsupported = errors.New("the backend cannot describe keys")
+
+// The TypedStoreClient interface is implemented by store clients of
+// backends storing typed values, such as the YAML and JSON files of the
+// file backend. GetTypedValues returns the values of GetValues along with
+// their types: a string, bool, int64 or float64.
+// Only the file backend implements it.
+type TypedStoreClient interface {
+	StoreClient
+	GetTypedValues(keys []string) (map[string]string, map[string]interface{}, error)
+}
+
+// ErrTypedValuesUnsupported is returned when fetching the typed values of
+// a backend whose store client is not a TypedStoreClient.
+var ErrTypedValuesUnsupported = errors.New("the backend does not store typed values")
+
+// The LeaderClient interface is implemented by store clients that can tell
+// the leader of the backend cluster, as the clusterLeader and
+// backendHealthy template functions do. ClusterLeader returns "" when the
+// cluster has no leader, as when it lost quorum. Only the etcd and consul
+// backends implement it.
+type LeaderClient interface {
+	StoreClient
+	ClusterLeader() (string, error)
+}
+
+// ErrLeaderUnsupported is returned when asking for the cluster leader of a
+// backend whose store client is not a LeaderClient.
+var ErrLeaderUnsupported = errors.New("the backend cannot tell the leader of its cluster")
+
+// New is used to create a storage client based on our configuration. With
+// MaxRequestsPerSecond set the client is rate limited, with Trace set
+// every request made through the client is logged, and with Backoff set
+// failing fetches are retried that many times.
 func New(config Config) (StoreClient, error) {
+	c, err := newClient(config)
+	if err != nil {
+		return c, err
+	}
+	if config.MaxRequestsPerSecond > 0 {
+		c = newRateLimitedClient(c, config.MaxRequestsPerSecond)
+	}
+	if config.Trace {
+		c = newTracingClient(c)
+	}
+	if config.Backoff > 0 {
+		c = newRetryingClient(c, config.Backoff)
+	}
+	return c, nil
+}
+
+func newClient(config Config) (StoreClient, error) {
 
 	if config.Backend == "" {
 		config.Backend = "etcd"
@@ -36,7 +123,7 @@ func New(config Config) (StoreClient, error) {
 	if config.Backend == "file" {
 		log.Info("Backend source(s) set to " + strings.Join(config.YAMLFile, ", "))
 	} else {
-		log.Info("Backend source(s) set to " + strings.Join(backendNodes, ", "))
+		log.Info("Backend source(s) set to " + strings.Join(util.RedactNodes(backendNodes), ", "))
 	}
 
 	switch config.Backend {
@@ -47,23 +134,26 @@ func New(config Config) (StoreClient, error) {
 			config.BasicAuth,
 			config.Username,
 			config.Password,
+			config.UserAgent,
+			config.AuthToken,
+			config.Datacenter,
 		)
 	case "etcd":
 		// Create the etcd client upfront and use it for the life of the process.
 		// The etcdClient is an http.Client and designed to be reused.
-		return etcd.NewEtcdClient(backendNodes, config.ClientCert, config.ClientKey, config.ClientCaKeys, config.ClientInsecure, config.BasicAuth, config.Username, config.Password)
+		return etcd.NewEtcdClient(backendNodes, config.ClientCert, config.ClientKey, config.ClientCaKeys, config.ClientInsecure, config.BasicAuth, config.Username, config.Password, config.UserAgent, time.Duration(config.Timeout)*time.Second)
 	case "etcdv3":
 		return etcdv3.NewEtcdClient(backendNodes, config.ClientCert, config.ClientKey, config.ClientCaKeys, config.BasicAuth, config.Username, config.Password)
 	case "zookeeper":
 		return zookeeper.NewZookeeperClient(backendNodes)
 	case "rancher":
-		return rancher.NewRancherClient(backendNodes)
+		return rancher.NewRancherClient(backendNodes, config.UserAgent)
 	case "redis":
 		return redis.NewRedisClient(backendNodes, config.ClientKey, config.Separator)
 	case "env":
 		return env.NewEnvClient()
 	case "file":
-		return file.NewFileClient(config.YAMLFile, config.Filter)
+		return file.NewFileClient(config.YAMLFile, config.Filter, config.Separator, config.FileArrays)
 	case "vault":
 		vaultConfig := map[string]string{
 			"app-id":    config.AppID,
@@ -77,14 +167,15 @@ func New(config Config) (StoreClient, error) {
 			"key":       config.ClientKey,
 			"caCert":    config.ClientCaKeys,
 			"path":      config.Path,
+			"userAgent": config.UserAgent,
 		}
 		return vault.New(backendNodes[0], config.AuthType, vaultConfig)
 	case "dynamodb":
 		table := config.Table
 		log.Info("DynamoDB table set to " + table)
-		return dynamodb.NewDynamoDBClient(table)
+		return dynamodb.NewDynamoDBClient(table, config.UserAgent)
 	case "ssm":
-		return ssm.New()
+		return ssm.New(config.UserAgent)
 	}
 	return nil, errors.New("Invalid backend")
 }
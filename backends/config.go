@@ -5,26 +5,33 @@ import (
 )
 
 type Config struct {
-	AuthToken    string     `toml:"auth_token"`
-	AuthType     string     `toml:"auth_type"`
-	Backend      string     `toml:"backend"`
-	BasicAuth    bool       `toml:"basic_auth"`
-	ClientCaKeys string     `toml:"client_cakeys"`
-	ClientCert   string     `toml:"client_cert"`
-	ClientKey    string     `toml:"client_key"`
-        ClientInsecure bool     `toml:"client_insecure"`
-	BackendNodes util.Nodes `toml:"nodes"`
-	Password     string     `toml:"password"`
-	Scheme       string     `toml:"scheme"`
-	Table        string     `toml:"table"`
-	Separator    string     `toml:"separator"`
-	Username     string     `toml:"username"`
-	AppID        string     `toml:"app_id"`
-	UserID       string     `toml:"user_id"`
-	RoleID       string     `toml:"role_id"`
-	SecretID     string     `toml:"secret_id"`
-	YAMLFile     util.Nodes `toml:"file"`
-	Filter       string     `toml:"filter"`
-	Path         string     `toml:"path"`
-	Role         string
+	AuthToken            string     `toml:"auth_token"`
+	AuthType             string     `toml:"auth_type"`
+	Backend              string     `toml:"backend"`
+	Backoff              int        `toml:"backoff"`
+	BasicAuth            bool       `toml:"basic_auth"`
+	ClientCaKeys         string     `toml:"client_cakeys"`
+	ClientCert           string     `toml:"client_cert"`
+	ClientKey            string     `toml:"client_key"`
+	Datacenter           string     `toml:"datacenter"`
+	ClientInsecure       bool       `toml:"client_insecure"`
+	BackendNodes         util.Nodes `toml:"nodes"`
+	MaxRequestsPerSecond float64    `toml:"max_requests_per_second"`
+	Password             string     `toml:"password"`
+	Scheme               string     `toml:"scheme"`
+	Table                string     `toml:"table"`
+	Timeout              int        `toml:"timeout"`
+	Trace                bool       `toml:"trace"`
+	Separator            string     `toml:"separator"`
+	Username             string     `toml:"username"`
+	AppID                string     `toml:"app_id"`
+	UserID               string     `toml:"user_id"`
+	RoleID               string     `toml:"role_id"`
+	SecretID             string     `toml:"secret_id"`
+	YAMLFile             util.Nodes `toml:"file"`
+	FileArrays           string     `toml:"file_arrays"`
+	Filter               string     `toml:"filter"`
+	Path                 string     `toml:"path"`
+	UserAgent            string     `toml:"user_agent"`
+	Role                 string
 }
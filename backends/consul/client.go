@@ -5,18 +5,29 @@ import (
 	"strings"
 
 	"github.com/hashicorp/consul/api"
+	util "github.com/kelseyhightower/confd/util"
 )
 
 // Client provides a wrapper around the consulkv client
 type ConsulClient struct {
 	client *api.KV
+	status *api.Status
 }
 
 // NewConsulClient returns a new client to Consul for the given address
-func New(nodes []string, scheme, cert, key, caCert string, basicAuth bool, username string, password string) (*ConsulClient, error) {
+// that sends userAgent as the User-Agent header of every request. A
+// non-empty token is sent as the ACL token of every request and a
+// non-empty datacenter is queried instead of the agent's own.
+func New(nodes []string, scheme, cert, key, caCert string, basicAuth bool, username string, password string, userAgent string, token string, datacenter string) (*ConsulClient, error) {
 	conf := api.DefaultConfig()
 
 	conf.Scheme = scheme
+	if token != "" {
+		conf.Token = token
+	}
+	if datacenter != "" {
+		conf.Datacenter = datacenter
+	}
 
 	if len(nodes) > 0 {
 		conf.Address = nodes[0]
@@ -37,11 +48,18 @@ func New(nodes []string, scheme, cert, key, caCert string, basicAuth bool, usern
 		conf.TLSConfig.CAFile = caCert
 	}
 
+	httpClient, err := api.NewHttpClient(conf.Transport, conf.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	httpClient.Transport = &util.UserAgentTransport{UserAgent: userAgent, Transport: httpClient.Transport}
+	conf.HttpClient = httpClient
+
 	client, err := api.NewClient(conf)
 	if err != nil {
 		return nil, err
 	}
-	return &ConsulClient{client.KV()}, nil
+	return &ConsulClient{client.KV(), client.Status()}, nil
 }
 
 // GetValues queries Consul for keys
@@ -86,3 +104,9 @@ func (c *ConsulClient) WatchPrefix(prefix string, keys []string, waitIndex uint6
 		return r.waitIndex, r.err
 	}
 }
+
+// ClusterLeader returns the address of the leader of the Consul cluster,
+// or "" if the cluster has no leader.
+func (c *ConsulClient) ClusterLeader() (string, error) {
+	return c.status.Leader()
+}
@@ -0,0 +1,56 @@
+package consul
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClusterLeader(t *testing.T) {
+	leader := "10.0.0.1:8300"
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/status/leader" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "%q", leader)
+	}))
+	defer s.Close()
+
+	c, err := New([]string{strings.TrimPrefix(s.URL, "http://")}, "http", "", "", "", false, "", "", "confd/test", "", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got, err := c.ClusterLeader(); err != nil || got != leader {
+		t.Errorf("ClusterLeader() of a healthy cluster = %q, %v, want %q", got, err, leader)
+	}
+	leader = ""
+	if got, err := c.ClusterLeader(); err != nil || got != "" {
+		t.Errorf("ClusterLeader() of a cluster without a leader = %q, %v, want no leader", got, err)
+	}
+}
+
+func TestTokenAndDatacenter(t *testing.T) {
+	var token, dc string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token = r.Header.Get("X-Consul-Token")
+		dc = r.URL.Query().Get("dc")
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, "[]")
+	}))
+	defer s.Close()
+
+	c, err := New([]string{strings.TrimPrefix(s.URL, "http://")}, "http", "", "", "", false, "", "", "confd/test", "secret-token", "dc2")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := c.GetValues([]string{"/app"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if token != "secret-token" || dc != "dc2" {
+		t.Errorf("GetValues() sent token %q and dc %q, want secret-token and dc2", token, dc)
+	}
+}
@@ -4,9 +4,11 @@ import (
 	"os"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/kelseyhightower/confd/log"
+	util "github.com/kelseyhightower/confd/util"
 )
 
 // Client is a wrapper around the DynamoDB client
@@ -17,9 +19,10 @@ type Client struct {
 }
 
 // NewDynamoDBClient returns an *dynamodb.Client with a connection to the region
-// configured via the AWS_REGION environment variable.
+// configured via the AWS_REGION environment variable. userAgent is appended
+// to the User-Agent header of every request.
 // It returns an error if the connection cannot be made or the table does not exist.
-func NewDynamoDBClient(table string) (*Client, error) {
+func NewDynamoDBClient(table string, userAgent string) (*Client, error) {
 	var c *aws.Config
 	if os.Getenv("DYNAMODB_LOCAL") != "" {
 		log.Debug("DYNAMODB_LOCAL is set")
@@ -32,6 +35,7 @@ func NewDynamoDBClient(table string) (*Client, error) {
 	}
 
 	session := session.New(c)
+	session.Handlers.Build.PushBack(request.MakeAddToUserAgentFreeFormHandler(userAgent))
 
 	// Fail early, if no credentials can be found
 	_, err := session.Config.Credentials.Get()
@@ -72,8 +76,10 @@ func (c *Client) GetValues(keys []string) (map[string]string, error) {
 			}
 		}
 
-		// Check for nested keys
-		q, err := c.client.Scan(
+		// Check for nested keys, reading every page of the scan. BEGINS_WITH
+		// also matches keys such as /application for /app, which are not
+		// nested under key and are skipped.
+		err = c.client.ScanPages(
 			&dynamodb.ScanInput{
 				ScanFilter: map[string]*dynamodb.Condition{
 					"key": &dynamodb.Condition{
@@ -83,23 +89,30 @@ func (c *Client) GetValues(keys []string) (map[string]string, error) {
 				AttributesToGet: []*string{aws.String("key"), aws.String("value")},
 				TableName:       aws.String(c.table),
 				Select:          aws.String("SPECIFIC_ATTRIBUTES"),
+			},
+			func(page *dynamodb.ScanOutput, lastPage bool) bool {
+				for _, item := range page.Items {
+					if item["key"] == nil || item["key"].S == nil {
+						continue
+					}
+					k := *item["key"].S
+					if _, ok := util.TrimPathPrefix(k, key); !ok {
+						continue
+					}
+					if val, ok := item["value"]; ok {
+						if val.S != nil {
+							vars[k] = *val.S
+						} else {
+							log.Warning("Skipping key '%s'. 'value' is not of type 'string'.", k)
+						}
+					}
+				}
+				return true
 			})
 
 		if err != nil {
 			return vars, err
 		}
-
-		for _, i := range q.Items {
-			item := i
-			if val, ok := item["value"]; ok {
-				if val.S != nil {
-					vars[*item["key"].S] = *val.S
-				} else {
-					log.Warning("Skipping key '%s'. 'value' is not of type 'string'.", *item["key"].S)
-				}
-				continue
-			}
-		}
 	}
 	return vars, nil
 }
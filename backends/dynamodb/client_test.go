@@ -0,0 +1,55 @@
+package dynamodb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestGetValuesScansEveryPage(t *testing.T) {
+	pages := []string{
+		`{"Items": [{"key": {"S": "/app/db/host"}, "value": {"S": "10.0.0.1"}}, {"key": {"S": "/application/name"}, "value": {"S": "other"}}], "LastEvaluatedKey": {"key": {"S": "/application/name"}}}`,
+		`{"Items": [{"key": {"S": "/app/db/port"}, "value": {"S": "5432"}}, {"key": {"S": "/app"}, "value": {"N": "1"}}]}`,
+	}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		switch r.Header.Get("X-Amz-Target") {
+		case "DynamoDB_20120810.GetItem":
+			fmt.Fprint(w, `{}`)
+		case "DynamoDB_20120810.Scan":
+			var input struct{ ExclusiveStartKey map[string]interface{} }
+			json.NewDecoder(r.Body).Decode(&input)
+			if input.ExclusiveStartKey == nil {
+				fmt.Fprint(w, pages[0])
+			} else {
+				fmt.Fprint(w, pages[1])
+			}
+		default:
+			http.Error(w, `{"__type": "UnknownOperationException"}`, http.StatusBadRequest)
+		}
+	}))
+	defer s.Close()
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:    aws.String(s.URL),
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	}))
+	c := &Client{dynamodb.New(sess), "confd"}
+	got, err := c.GetValues([]string{"/app"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := map[string]string{"/app/db/host": "10.0.0.1", "/app/db/port": "5432"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetValues() = %v, want %v", got, want)
+	}
+}
@@ -3,6 +3,7 @@ package env
 import (
 	"fmt"
 	"os"
+	"path"
 	"strings"
 
 	"github.com/kelseyhightower/confd/log"
@@ -30,13 +31,22 @@ func (c *Client) GetValues(keys []string) (map[string]string, error) {
 	for _, key := range keys {
 		k := transform(key)
 		for envKey, envValue := range envMap {
-			if strings.HasPrefix(envKey, k) {
-				vars[clean(envKey)] = envValue
+			if !strings.HasPrefix(envKey, k) {
+				continue
+			}
+			// The variables nested under key keep the key as it was asked
+			// for, so that keys with uppercase segments are found again.
+			rest := envKey[len(k):]
+			switch {
+			case rest == "":
+				vars[path.Join("/", key)] = envValue
+			case strings.HasPrefix(rest, "_") || strings.HasSuffix(k, "_") || k == "":
+				vars[path.Join("/", key, clean(rest))] = envValue
 			}
 		}
 	}
 
-	log.Debug(fmt.Sprintf("Key Map: %#v", vars))
+	log.Debug(fmt.Sprintf("Read %d keys", len(vars)))
 
 	return vars, nil
 }
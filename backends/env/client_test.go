@@ -0,0 +1,67 @@
+package env
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestTransform(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"/myapp/database/url", "MYAPP_DATABASE_URL"},
+		{"myapp/database/url", "MYAPP_DATABASE_URL"},
+		{"/my-app/db-host", "MY-APP_DB-HOST"},
+		{"/MyApp/URL", "MYAPP_URL"},
+		{"/", ""},
+	}
+	for _, tt := range tests {
+		if got := transform(tt.key); got != tt.want {
+			t.Errorf("transform(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestGetValues(t *testing.T) {
+	env := map[string]string{
+		"MYAPP_DATABASE_URL":  "postgres://db/app",
+		"MYAPP_DATABASE_USER": "app",
+		"MY-APP_DB-HOST":      "db.local",
+		"MYAPPLE_COLOR":       "red",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	tests := []struct {
+		keys []string
+		want map[string]string
+	}{
+		{[]string{"/myapp/database/url"}, map[string]string{"/myapp/database/url": "postgres://db/app"}},
+		{[]string{"/myapp/database"}, map[string]string{
+			"/myapp/database/url":  "postgres://db/app",
+			"/myapp/database/user": "app",
+		}},
+		{[]string{"/my-app/db-host"}, map[string]string{"/my-app/db-host": "db.local"}},
+		{[]string{"/MyApp/Database/URL"}, map[string]string{"/MyApp/Database/URL": "postgres://db/app"}},
+		{[]string{"/MyApp/Database"}, map[string]string{
+			"/MyApp/Database/url":  "postgres://db/app",
+			"/MyApp/Database/user": "app",
+		}},
+	}
+	c, err := NewEnvClient()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, tt := range tests {
+		got, err := c.GetValues(tt.keys)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("GetValues(%v) = %v, want %v", tt.keys, got, tt.want)
+		}
+	}
+}
@@ -2,34 +2,48 @@ package etcd
 
 import (
 	"crypto/tls"
-	"crypto/x509"
-	"io/ioutil"
+	"errors"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/coreos/etcd/client"
 	"golang.org/x/net/context"
         "github.com/kelseyhightower/confd/log"
+	util "github.com/kelseyhightower/confd/util"
 )
 
 // Client is a wrapper around the etcd client
 type Client struct {
-	client client.KeysAPI
+	client  client.KeysAPI
+	members client.MembersAPI
+	timeout time.Duration
 }
 
 // NewEtcdClient returns an *etcd.Client with a connection to named machines.
-func NewEtcdClient(machines []string, cert, key, caCert string, clientInsecure bool, basicAuth bool, username string, password string) (*Client, error) {
+// Machines are URLs, or unix:///path/to/socket for an etcd listening on a
+// unix socket. Every request it makes carries the given User-Agent header
+// and, except for watches, fails once it takes longer than timeout, unless
+// timeout is 0.
+func NewEtcdClient(machines []string, cert, key, caCert string, clientInsecure bool, basicAuth bool, username string, password string, userAgent string, timeout time.Duration) (*Client, error) {
 	var c client.Client
 	var kapi client.KeysAPI
 	var err error
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	endpoints, sockets := unixEndpoints(machines)
 	var transport = &http.Transport{
 		Proxy: http.ProxyFromEnvironment,
-		Dial: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).Dial,
+		Dial: func(network, addr string) (net.Conn, error) {
+			if path, ok := sockets[addr]; ok {
+				return dialer.Dial("unix", path)
+			}
+			return dialer.Dial(network, addr)
+		},
 		TLSHandshakeTimeout: 10 * time.Second,
 	}
 
@@ -43,9 +57,12 @@ func NewEtcdClient(machines []string, cert, key, caCert string, clientInsecure b
 	}
 
 	cfg := client.Config{
-		Endpoints:               machines,
+		Endpoints:               endpoints,
 		HeaderTimeoutPerRequest: time.Duration(3) * time.Second,
 	}
+	if timeout > 0 && timeout < cfg.HeaderTimeoutPerRequest {
+		cfg.HeaderTimeoutPerRequest = timeout
+	}
 
 	if basicAuth {
 		cfg.Username = username
@@ -53,68 +70,206 @@ func NewEtcdClient(machines []string, cert, key, caCert string, clientInsecure b
 	}
 
 	if caCert != "" {
-		certBytes, err := ioutil.ReadFile(caCert)
+		caCertPool, err := util.LoadCertPool(caCert)
 		if err != nil {
-			return &Client{kapi}, err
-		}
-
-		caCertPool := x509.NewCertPool()
-		ok := caCertPool.AppendCertsFromPEM(certBytes)
-
-		if ok {
-			tlsConfig.RootCAs = caCertPool
+			return &Client{client: kapi}, err
 		}
+		tlsConfig.RootCAs = caCertPool
 	}
 
 	if cert != "" && key != "" {
-		tlsCert, err := tls.LoadX509KeyPair(cert, key)
+		certs, err := util.NewCertificateReloader(cert, key)
 		if err != nil {
-			return &Client{kapi}, err
+			return &Client{client: kapi}, err
 		}
-		tlsConfig.Certificates = []tls.Certificate{tlsCert}
+		// Rotated certificates are picked up on the next connection.
+		tlsConfig.GetClientCertificate = certs.GetClientCertificate
 	}
 
 	transport.TLSClientConfig = tlsConfig
-	cfg.Transport = transport
+	cfg.Transport = &util.UserAgentTransport{UserAgent: userAgent, Transport: transport}
 
 	c, err = client.New(cfg)
 	if err != nil {
-		return &Client{kapi}, err
+		return &Client{client: kapi}, err
 	}
 
 	kapi = client.NewKeysAPI(c)
-	return &Client{kapi}, nil
+	return &Client{kapi, client.NewMembersAPI(c), timeout}, nil
+}
+
+// requestContext returns the context of a request other than a watch,
+// which is cancelled once the timeout of the client elapses.
+func (c *Client) requestContext() (context.Context, context.CancelFunc) {
+	if c.timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), c.timeout)
+}
+
+// unixEndpoints replaces the unix:// machines, which the etcd client cannot
+// reach, with http endpoints named after their position. It returns the
+// endpoints along with the socket paths the transport dials instead, by
+// host and port.
+func unixEndpoints(machines []string) ([]string, map[string]string) {
+	endpoints := make([]string, len(machines))
+	sockets := make(map[string]string)
+	for i, machine := range machines {
+		endpoints[i] = machine
+		if strings.HasPrefix(machine, "unix://") {
+			host := "unix-socket-" + strconv.Itoa(i)
+			endpoints[i] = "http://" + host
+			sockets[host+":80"] = strings.TrimPrefix(machine, "unix://")
+		}
+	}
+	return endpoints, sockets
 }
 
 // GetValues queries etcd for keys prefixed by prefix.
 func (c *Client) GetValues(keys []string) (map[string]string, error) {
+	vars, _, err := c.GetValuesWithTTL(keys)
+	return vars, err
+}
+
+// snapshotAttempts is how many times GetValuesWithTTL reads the keys when
+// they keep changing while being read.
+const snapshotAttempts = 3
+
+// GetValuesWithTTL queries etcd for keys prefixed by prefix. In addition to
+// the values it returns the remaining TTL, in seconds, of every key that
+// has one.
+// etcd v2 cannot read at a past index, so the keys are read again, up to
+// snapshotAttempts times, if any of them was modified after the index of
+// the first read, to return values from a single point in time. Keys
+// deleted while being read go unnoticed.
+func (c *Client) GetValuesWithTTL(keys []string) (map[string]string, map[string]int64, error) {
+	for attempt := 1; ; attempt++ {
+		vars, ttls, changed, err := c.readKeys(keys)
+		if err != nil || !changed {
+			return vars, ttls, err
+		}
+		if attempt == snapshotAttempts {
+			log.Warning("Keys kept changing while being read, the values may not be consistent")
+			return vars, ttls, nil
+		}
+		log.Debug("Keys changed while being read, reading them again")
+	}
+}
+
+// readKeys reads keys, pinning the etcd index of the first read. It
+// reports whether any key read was modified after that index.
+func (c *Client) readKeys(keys []string) (map[string]string, map[string]int64, bool, error) {
 	vars := make(map[string]string)
-	for _, key := range keys {
-		resp, err := c.client.Get(context.Background(), key, &client.GetOptions{
+	ttls := make(map[string]int64)
+	var index uint64
+	changed := false
+	for i, key := range keys {
+		ctx, cancel := c.requestContext()
+		resp, err := c.client.Get(ctx, key, &client.GetOptions{
 			Recursive: true,
 			Sort:      true,
 			Quorum:    true,
 		})
+		cancel()
 		if err != nil {
-			return vars, err
+			return vars, ttls, false, err
+		}
+		if i == 0 {
+			index = resp.Index
+		} else if modifiedAfter(resp.Node, index) {
+			changed = true
 		}
-		err = nodeWalk(resp.Node, vars)
+		err = nodeWalk(resp.Node, vars, ttls)
 		if err != nil {
-			return vars, err
+			return vars, ttls, false, err
 		}
 	}
-	return vars, nil
+	return vars, ttls, changed, nil
 }
 
-// nodeWalk recursively descends nodes, updating vars.
-func nodeWalk(node *client.Node, vars map[string]string) error {
+// modifiedAfter reports whether node or any node below it was modified
+// after index.
+func modifiedAfter(node *client.Node, index uint64) bool {
+	if node == nil {
+		return false
+	}
+	if node.ModifiedIndex > index {
+		return true
+	}
+	for _, n := range node.Nodes {
+		if modifiedAfter(n, index) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetKeyInfo returns the value of key, the index it was last modified at and
+// its remaining TTL in seconds, 0 if it does not expire.
+func (c *Client) GetKeyInfo(key string) (string, uint64, int64, error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	resp, err := c.client.Get(ctx, key, &client.GetOptions{Quorum: true})
+	if err != nil {
+		return "", 0, 0, err
+	}
+	if resp.Node.Dir {
+		return "", 0, 0, errors.New(key + " is a directory")
+	}
+	return resp.Node.Value, resp.Node.ModifiedIndex, resp.Node.TTL, nil
+}
+
+// SetValue sets key to value.
+func (c *Client) SetValue(key, value string) error {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	_, err := c.client.Set(ctx, key, value, nil)
+	return err
+}
+
+// ClusterLeader returns the name of the leader of the etcd cluster, or ""
+// if the cluster has no leader.
+func (c *Client) ClusterLeader() (string, error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	leader, err := c.members.Leader(ctx)
+	if err != nil {
+		if noLeader(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return leader.Name, nil
+}
+
+// noLeader reports whether err is the error of a request every etcd member
+// answered saying it has no leader.
+func noLeader(err error) bool {
+	cerr, ok := err.(*client.ClusterError)
+	if !ok || len(cerr.Errors) == 0 {
+		return false
+	}
+	for _, err := range cerr.Errors {
+		if !strings.HasSuffix(err.Error(), "has no leader") {
+			return false
+		}
+	}
+	return true
+}
+
+// nodeWalk recursively descends nodes, updating vars and the TTLs of
+// expiring keys.
+func nodeWalk(node *client.Node, vars map[string]string, ttls map[string]int64) error {
 	if node != nil {
 		key := node.Key
 		if !node.Dir {
 			vars[key] = node.Value
+			if node.TTL > 0 {
+				ttls[key] = node.TTL
+			}
 		} else {
 			for _, node := range node.Nodes {
-				nodeWalk(node, vars)
+				nodeWalk(node, vars, ttls)
 			}
 		}
 	}
@@ -122,15 +277,14 @@ func nodeWalk(node *client.Node, vars map[string]string) error {
 }
 
 func (c *Client) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
-	// return something > 0 to trigger a key retrieval from the store
+	// Return the current index to trigger a key retrieval from the store.
+	// The keys are fetched after the index is read, so watching from it
+	// next time catches every change made after the fetch.
 	if waitIndex == 0 {
-		return 1, nil
+		return c.currentIndex(prefix)
 	}
 
-	// Setting AfterIndex to 0 (default) means that the Watcher
-	// should start watching for events starting at the current
-	// index, whatever that may be.
-	watcher := c.client.Watcher(prefix, &client.WatcherOptions{AfterIndex: uint64(0), Recursive: true})
+	watcher := c.client.Watcher(prefix, &client.WatcherOptions{AfterIndex: waitIndex, Recursive: true})
 	ctx, cancel := context.WithCancel(context.Background())
 	cancelRoutine := make(chan bool)
 	defer close(cancelRoutine)
@@ -147,11 +301,10 @@ func (c *Client) WatchPrefix(prefix string, keys []string, waitIndex uint64, sto
 	for {
 		resp, err := watcher.Next(ctx)
 		if err != nil {
-			switch e := err.(type) {
-			case *client.Error:
-				if e.Code == 401 {
-					return 0, nil
-				}
+			// The events since waitIndex are no longer available, start over
+			// from a fresh retrieval.
+			if e, ok := err.(client.Error); ok && e.Code == client.ErrorCodeEventIndexCleared {
+				return 0, nil
 			}
 			return waitIndex, err
 		}
@@ -167,3 +320,28 @@ func (c *Client) WatchPrefix(prefix string, keys []string, waitIndex uint64, sto
 		}
 	}
 }
+
+// currentIndex returns the current etcd index, as reported when reading
+// prefix. prefix need not exist yet.
+func (c *Client) currentIndex(prefix string) (uint64, error) {
+	var index uint64
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	resp, err := c.client.Get(ctx, prefix, &client.GetOptions{Quorum: true})
+	switch e := err.(type) {
+	case nil:
+		index = resp.Index
+	case client.Error:
+		if e.Code != client.ErrorCodeKeyNotFound {
+			return 0, err
+		}
+		index = e.Index
+	default:
+		return 0, err
+	}
+	// An index of 0 would mean no retrieval has happened yet.
+	if index == 0 {
+		index = 1
+	}
+	return index, nil
+}
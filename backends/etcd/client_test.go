@@ -0,0 +1,408 @@
+package etcd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+)
+
+func TestNodeWalkRecordsTTLs(t *testing.T) {
+	node := &client.Node{
+		Key: "/app",
+		Dir: true,
+		Nodes: client.Nodes{
+			&client.Node{Key: "/app/name", Value: "confd"},
+			&client.Node{
+				Key: "/app/members",
+				Dir: true,
+				Nodes: client.Nodes{
+					&client.Node{Key: "/app/members/a", Value: "10.0.0.1", TTL: 30},
+					&client.Node{Key: "/app/members/b", Value: "10.0.0.2", TTL: 2},
+				},
+			},
+		},
+	}
+	vars := make(map[string]string)
+	ttls := make(map[string]int64)
+	if err := nodeWalk(node, vars, ttls); err != nil {
+		t.Fatal(err.Error())
+	}
+	wantVars := map[string]string{
+		"/app/name":      "confd",
+		"/app/members/a": "10.0.0.1",
+		"/app/members/b": "10.0.0.2",
+	}
+	if !reflect.DeepEqual(vars, wantVars) {
+		t.Errorf("nodeWalk() vars = %v, want %v", vars, wantVars)
+	}
+	wantTTLs := map[string]int64{
+		"/app/members/a": 30,
+		"/app/members/b": 2,
+	}
+	if !reflect.DeepEqual(ttls, wantTTLs) {
+		t.Errorf("nodeWalk() ttls = %v, want %v", ttls, wantTTLs)
+	}
+}
+
+// fakeEtcd is an HTTP server answering etcd v2 key requests with fixed
+// responses and recording the requests it receives. Watches are answered
+// from the changes made with set.
+type fakeEtcd struct {
+	*httptest.Server
+	mu       sync.Mutex
+	nodes    map[string]*client.Node
+	index    uint64
+	events   []*client.Node
+	requests []*http.Request
+	// afterGet, if set, is called after answering a read of key.
+	afterGet func(key string)
+	// leader is the leader of the cluster, nil if it has none.
+	leader *client.Member
+}
+
+// set stores value under key as the next change.
+func (f *fakeEtcd) set(key, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.index++
+	node := &client.Node{Key: key, Value: value, ModifiedIndex: f.index}
+	f.nodes[key] = node
+	f.events = append(f.events, node)
+}
+
+// serveWatch answers with the first change under key at or after waitIndex,
+// waiting for one if needed. A waitIndex of 0 waits for the next change.
+func (f *fakeEtcd) serveWatch(w http.ResponseWriter, r *http.Request, key string) {
+	waitIndex, _ := strconv.ParseUint(r.URL.Query().Get("waitIndex"), 10, 64)
+	f.mu.Lock()
+	if waitIndex == 0 {
+		waitIndex = f.index + 1
+	}
+	f.mu.Unlock()
+	for {
+		f.mu.Lock()
+		for _, node := range f.events {
+			if node.ModifiedIndex >= waitIndex && strings.HasPrefix(node.Key, key) {
+				f.mu.Unlock()
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("X-Etcd-Index", strconv.FormatUint(node.ModifiedIndex, 10))
+				json.NewEncoder(w).Encode(client.Response{Action: "set", Node: node})
+				return
+			}
+		}
+		f.mu.Unlock()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func newFakeEtcd(nodes map[string]*client.Node) *fakeEtcd {
+	f := &fakeEtcd{nodes: nodes, index: 1}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	return f
+}
+
+func (f *fakeEtcd) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v2/members/leader" {
+		f.mu.Lock()
+		leader := f.leader
+		f.mu.Unlock()
+		if leader == nil {
+			http.Error(w, "raft: no leader", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(leader)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/v2/keys")
+	f.mu.Lock()
+	f.requests = append(f.requests, r)
+	node, ok := f.nodes[key]
+	index := f.index
+	f.mu.Unlock()
+
+	if r.URL.Query().Get("wait") == "true" {
+		f.serveWatch(w, r, key)
+		return
+	}
+	if r.Method == "PUT" {
+		f.set(key, r.FormValue("value"))
+		f.mu.Lock()
+		node = f.nodes[key]
+		f.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(client.Response{Action: "set", Node: node})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Etcd-Index", strconv.FormatUint(index, 10))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"errorCode":100,"message":"Key not found","cause":%q,"index":%d}`, r.URL.Path, index)
+		return
+	}
+	json.NewEncoder(w).Encode(client.Response{Action: "get", Node: node})
+	if f.afterGet != nil {
+		f.afterGet(key)
+	}
+}
+
+func TestGetValuesSetsUserAgent(t *testing.T) {
+	f := newFakeEtcd(map[string]*client.Node{
+		"/app/name": &client.Node{Key: "/app/name", Value: "confd"},
+	})
+	defer f.Close()
+
+	c, err := NewEtcdClient([]string{f.URL}, "", "", "", false, false, "", "", "confd/test", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	vars, err := c.GetValues([]string{"/app/name"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if vars["/app/name"] != "confd" {
+		t.Errorf("GetValues() = %v, want /app/name=confd", vars)
+	}
+	if len(f.requests) == 0 {
+		t.Fatal("no requests reached the server")
+	}
+	for _, r := range f.requests {
+		if ua := r.Header.Get("User-Agent"); ua != "confd/test" {
+			t.Errorf("request %s has User-Agent %q, want %q", r.URL, ua, "confd/test")
+		}
+	}
+}
+
+func TestGetValuesTimeout(t *testing.T) {
+	// The server sends the response headers, then stalls the body, which
+	// only the timeout of the whole request catches.
+	stall := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Etcd-Index", "1")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-stall
+	}))
+	defer s.Close()
+	defer close(stall)
+
+	c, err := NewEtcdClient([]string{s.URL}, "", "", "", false, false, "", "", "confd/test", 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	start := time.Now()
+	if _, err := c.GetValues([]string{"/app/name"}); err == nil {
+		t.Error("GetValues() returned no error from a stalled server")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("GetValues() returned after %s with a timeout of 200ms", elapsed)
+	}
+}
+
+func TestGetValuesOverUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "etcd.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	f := &fakeEtcd{nodes: map[string]*client.Node{
+		"/app/name": &client.Node{Key: "/app/name", Value: "confd"},
+	}, index: 1}
+	f.Server = httptest.NewUnstartedServer(http.HandlerFunc(f.serveHTTP))
+	f.Listener.Close()
+	f.Listener = l
+	f.Start()
+	defer f.Close()
+
+	c, err := NewEtcdClient([]string{"unix://" + socket}, "", "", "", false, false, "", "", "confd/test", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	vars, err := c.GetValues([]string{"/app/name"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if vars["/app/name"] != "confd" {
+		t.Errorf("GetValues() = %v, want /app/name=confd", vars)
+	}
+}
+
+func TestWatchPrefixCatchesChangesAfterInitialRead(t *testing.T) {
+	f := newFakeEtcd(map[string]*client.Node{})
+	f.index = 5
+	defer f.Close()
+
+	c, err := NewEtcdClient([]string{f.URL}, "", "", "", false, false, "", "", "confd/test", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	stopChan := make(chan bool)
+	defer close(stopChan)
+
+	// The prefix does not exist yet.
+	index, err := c.WatchPrefix("/app", []string{"/app"}, 0, stopChan)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if index != 5 {
+		t.Errorf("initial WatchPrefix() = %d, want the current index 5", index)
+	}
+	// The initial read finds nothing.
+	c.GetValues([]string{"/app"})
+
+	// A key is created after the initial read but before the watch starts.
+	f.set("/app/name", "confd")
+
+	done := make(chan uint64, 1)
+	go func() {
+		index, err := c.WatchPrefix("/app", []string{"/app"}, index, stopChan)
+		if err != nil {
+			t.Error(err.Error())
+		}
+		done <- index
+	}()
+	select {
+	case index := <-done:
+		if index != 6 {
+			t.Errorf("WatchPrefix() = %d, want the index 6 of the change", index)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("WatchPrefix() missed the key created before the watch started")
+	}
+}
+
+func TestSetValue(t *testing.T) {
+	f := newFakeEtcd(map[string]*client.Node{})
+	defer f.Close()
+
+	c, err := NewEtcdClient([]string{f.URL}, "", "", "", false, false, "", "", "confd/test", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := c.SetValue("/derived/upstream", "a:80"); err != nil {
+		t.Fatal(err.Error())
+	}
+	vars, err := c.GetValues([]string{"/derived/upstream"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if vars["/derived/upstream"] != "a:80" {
+		t.Errorf("GetValues() after SetValue() = %v, want /derived/upstream=a:80", vars)
+	}
+}
+
+func TestGetValuesRereadsKeysChangedWhileReading(t *testing.T) {
+	f := newFakeEtcd(map[string]*client.Node{
+		"/app/host": &client.Node{Key: "/app/host", Value: "db1", ModifiedIndex: 1},
+		"/app/port": &client.Node{Key: "/app/port", Value: "5432", ModifiedIndex: 1},
+	})
+	defer f.Close()
+	// The host moves to db2 right after it is first read, before the port
+	// of db2 is read.
+	var once sync.Once
+	f.afterGet = func(key string) {
+		if key == "/app/host" {
+			once.Do(func() {
+				f.set("/app/host", "db2")
+				f.set("/app/port", "6432")
+			})
+		}
+	}
+
+	c, err := NewEtcdClient([]string{f.URL}, "", "", "", false, false, "", "", "confd/test", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	vars, err := c.GetValues([]string{"/app/host", "/app/port"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := map[string]string{"/app/host": "db2", "/app/port": "6432"}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("GetValues() = %v, want %v", vars, want)
+	}
+	hostReads := 0
+	for _, r := range f.requests {
+		if r.URL.Path == "/v2/keys/app/host" {
+			hostReads++
+		}
+	}
+	if hostReads != 2 {
+		t.Errorf("/app/host was read %d times, want 2", hostReads)
+	}
+}
+
+func TestModifiedAfter(t *testing.T) {
+	node := &client.Node{
+		Key:           "/app",
+		Dir:           true,
+		ModifiedIndex: 3,
+		Nodes: client.Nodes{
+			&client.Node{Key: "/app/name", Value: "confd", ModifiedIndex: 4},
+			&client.Node{Key: "/app/members", Dir: true, ModifiedIndex: 3, Nodes: client.Nodes{
+				&client.Node{Key: "/app/members/a", Value: "10.0.0.1", ModifiedIndex: 9},
+			}},
+		},
+	}
+	tests := []struct {
+		index uint64
+		want  bool
+	}{
+		{2, true},
+		{8, true},
+		{9, false},
+		{12, false},
+	}
+	for _, tt := range tests {
+		if got := modifiedAfter(node, tt.index); got != tt.want {
+			t.Errorf("modifiedAfter(node, %d) = %v, want %v", tt.index, got, tt.want)
+		}
+	}
+}
+
+func TestClusterLeader(t *testing.T) {
+	f := newFakeEtcd(map[string]*client.Node{})
+	defer f.Close()
+
+	c, err := NewEtcdClient([]string{f.URL}, "", "", "", false, false, "", "", "confd/test", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	f.leader = &client.Member{ID: "8e9e05c52164694d", Name: "etcd-1"}
+	if leader, err := c.ClusterLeader(); err != nil || leader != "etcd-1" {
+		t.Errorf("ClusterLeader() of a healthy cluster = %q, %v, want etcd-1", leader, err)
+	}
+	f.leader = nil
+	if leader, err := c.ClusterLeader(); err != nil || leader != "" {
+		t.Errorf("ClusterLeader() of a cluster without a leader = %q, %v, want no leader", leader, err)
+	}
+	f.Close()
+	if _, err := c.ClusterLeader(); err == nil {
+		t.Error("ClusterLeader() of an unreachable cluster succeeded")
+	}
+}
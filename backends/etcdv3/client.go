@@ -2,8 +2,6 @@ package etcdv3
 
 import (
 	"crypto/tls"
-	"crypto/x509"
-	"io/ioutil"
 	"strings"
 	"time"
 
@@ -11,6 +9,7 @@ import (
 
 	"github.com/coreos/etcd/clientv3"
 	"github.com/kelseyhightower/confd/log"
+	util "github.com/kelseyhightower/confd/util"
 	"sync"
 )
 
@@ -104,6 +103,11 @@ type Client struct {
 	wm sync.Mutex
 }
 
+// Close closes the connection to etcd, cancelling its watches.
+func (c *Client) Close() error {
+	return c.client.Close()
+}
+
 // NewEtcdClient returns an *etcdv3.Client with a connection to named machines.
 func NewEtcdClient(machines []string, cert, key, caCert string, basicAuth bool, username string, password string) (*Client, error) {
 	cfg := clientv3.Config{
@@ -124,26 +128,21 @@ func NewEtcdClient(machines []string, cert, key, caCert string, basicAuth bool,
 	}
 
 	if caCert != "" {
-		certBytes, err := ioutil.ReadFile(caCert)
+		caCertPool, err := util.LoadCertPool(caCert)
 		if err != nil {
 			return &Client{}, err
 		}
-
-		caCertPool := x509.NewCertPool()
-		ok := caCertPool.AppendCertsFromPEM(certBytes)
-
-		if ok {
-			tlsConfig.RootCAs = caCertPool
-		}
+		tlsConfig.RootCAs = caCertPool
 		tlsEnabled = true
 	}
 
 	if cert != "" && key != "" {
-		tlsCert, err := tls.LoadX509KeyPair(cert, key)
+		certs, err := util.NewCertificateReloader(cert, key)
 		if err != nil {
 			return &Client{}, err
 		}
-		tlsConfig.Certificates = []tls.Certificate{tlsCert}
+		// Rotated certificates are picked up on the next connection.
+		tlsConfig.GetClientCertificate = certs.GetClientCertificate
 		tlsEnabled = true
 	}
 
@@ -222,6 +221,14 @@ func (c *Client) GetValues(keys []string) (map[string]string, error) {
 	return vars, nil
 }
 
+// SetValue sets key to value.
+func (c *Client) SetValue(key, value string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(3)*time.Second)
+	defer cancel()
+	_, err := c.client.Put(ctx, key, value)
+	return err
+}
+
 func (c *Client) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
 	var err error
 	
@@ -1,6 +1,7 @@
 package file
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"path"
@@ -15,10 +16,22 @@ import (
 
 var replacer = strings.NewReplacer("/", "_")
 
+// The values of the arrays setting, selecting how arrays are flattened.
+const (
+	// ArraysIndex flattens every element of an array to a key named by its
+	// index, such as /hosts/0 and /hosts/1.
+	ArraysIndex = "index"
+	// ArraysJSON keeps arrays whole, as a single key holding the array
+	// encoded as JSON.
+	ArraysJSON = "json"
+)
+
 // Client provides a shell for the yaml client
 type Client struct {
-	filepath []string
-	filter   string
+	filepath  []string
+	filter    string
+	separator string
+	arrays    string
 }
 
 type ResultError struct {
@@ -26,11 +39,26 @@ type ResultError struct {
 	err      error
 }
 
-func NewFileClient(filepath []string, filter string) (*Client, error) {
-	return &Client{filepath: filepath, filter: filter}, nil
+// NewFileClient returns a client reading the YAML and JSON files in
+// filepath, and in the directories of filepath matching filter. Nested keys
+// are joined with separator, "/" if empty, below the root key "/", and
+// arrays are flattened as selected by arrays, ArraysIndex if empty.
+// It returns an error if arrays is not ArraysIndex or ArraysJSON.
+func NewFileClient(filepath []string, filter, separator, arrays string) (*Client, error) {
+	if separator == "" {
+		separator = "/"
+	}
+	switch arrays {
+	case "":
+		arrays = ArraysIndex
+	case ArraysIndex, ArraysJSON:
+	default:
+		return nil, fmt.Errorf("Invalid file arrays %q, valid values are index and json", arrays)
+	}
+	return &Client{filepath: filepath, filter: filter, separator: separator, arrays: arrays}, nil
 }
 
-func readFile(path string, vars map[string]string) error {
+func (c *Client) readFile(path string, vars map[string]string, types map[string]interface{}) error {
 	yamlMap := make(map[interface{}]interface{})
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -42,7 +70,7 @@ func readFile(path string, vars map[string]string) error {
 		return err
 	}
 
-	err = nodeWalk(yamlMap, "/", vars)
+	err = c.nodeWalk(yamlMap, "/", vars, types)
 	if err != nil {
 		return err
 	}
@@ -50,20 +78,28 @@ func readFile(path string, vars map[string]string) error {
 }
 
 func (c *Client) GetValues(keys []string) (map[string]string, error) {
+	vars, _, err := c.GetTypedValues(keys)
+	return vars, err
+}
+
+// GetTypedValues returns the values of keys both as strings and with the
+// type they have in the YAML or JSON files.
+func (c *Client) GetTypedValues(keys []string) (map[string]string, map[string]interface{}, error) {
 	vars := make(map[string]string)
+	types := make(map[string]interface{})
 	var filePaths []string
 	for _, path := range c.filepath {
 		p, err := util.RecursiveFilesLookup(path, c.filter)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		filePaths = append(filePaths, p...)
 	}
 
 	for _, path := range filePaths {
-		err := readFile(path, vars)
+		err := c.readFile(path, vars, types)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
 
@@ -75,36 +111,85 @@ VarsLoop:
 			}
 		}
 		delete(vars, k)
+		delete(types, k)
 	}
-	log.Debug(fmt.Sprintf("Key Map: %#v", vars))
-	return vars, nil
+	log.Debug(fmt.Sprintf("Read %d keys", len(vars)))
+	return vars, types, nil
 }
 
-// nodeWalk recursively descends nodes, updating vars.
-func nodeWalk(node interface{}, key string, vars map[string]string) error {
+// nodeWalk recursively descends nodes, updating vars and types.
+func (c *Client) nodeWalk(node interface{}, key string, vars map[string]string, types map[string]interface{}) error {
 	switch node.(type) {
 	case []interface{}:
+		if c.arrays == ArraysJSON {
+			b, err := json.Marshal(jsonValue(node))
+			if err != nil {
+				return err
+			}
+			vars[key] = string(b)
+			types[key] = vars[key]
+			return nil
+		}
 		for i, j := range node.([]interface{}) {
-			key := path.Join(key, strconv.Itoa(i))
-			nodeWalk(j, key, vars)
+			key := c.join(key, strconv.Itoa(i))
+			if err := c.nodeWalk(j, key, vars, types); err != nil {
+				return err
+			}
 		}
 	case map[interface{}]interface{}:
 		for k, v := range node.(map[interface{}]interface{}) {
-			key := path.Join(key, k.(string))
-			nodeWalk(v, key, vars)
+			key := c.join(key, fmt.Sprint(k))
+			if err := c.nodeWalk(v, key, vars, types); err != nil {
+				return err
+			}
 		}
 	case string:
 		vars[key] = node.(string)
+		types[key] = node
 	case int:
 		vars[key] = strconv.Itoa(node.(int))
+		types[key] = int64(node.(int))
 	case bool:
 		vars[key] = strconv.FormatBool(node.(bool))
+		types[key] = node
 	case float64:
 		vars[key] = strconv.FormatFloat(node.(float64), 'f', -1, 64)
+		types[key] = node
 	}
 	return nil
 }
 
+// join returns the key of the child name of key.
+func (c *Client) join(key, name string) string {
+	if c.separator == "/" {
+		return path.Join(key, name)
+	}
+	if key == "/" {
+		return key + name
+	}
+	return key + c.separator + name
+}
+
+// jsonValue returns node, decoded from YAML, with its maps converted to
+// map[string]interface{} so that it can be encoded as JSON.
+func jsonValue(node interface{}) interface{} {
+	switch n := node.(type) {
+	case []interface{}:
+		values := make([]interface{}, len(n))
+		for i, v := range n {
+			values[i] = jsonValue(v)
+		}
+		return values
+	case map[interface{}]interface{}:
+		values := make(map[string]interface{}, len(n))
+		for k, v := range n {
+			values[fmt.Sprint(k)] = jsonValue(v)
+		}
+		return values
+	}
+	return node
+}
+
 func (c *Client) watchChanges(watcher *fsnotify.Watcher, stopChan chan bool) ResultError {
 	outputChannel := make(chan ResultError)
 	go func() error {
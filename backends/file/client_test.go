@@ -0,0 +1,70 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestGetValuesFlattening(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	values := filepath.Join(dir, "values.json")
+	doc := `{"app": {"db": {"host": "db1", "port": 5432}, "hosts": ["a", {"name": "b"}]}}`
+	if err := ioutil.WriteFile(values, []byte(doc), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tests := []struct {
+		desc, separator, arrays string
+		want                    map[string]string
+	}{
+		{"indexed arrays", "", "", map[string]string{
+			"/app/db/host":      "db1",
+			"/app/db/port":      "5432",
+			"/app/hosts/0":      "a",
+			"/app/hosts/1/name": "b",
+		}},
+		{"JSON arrays", "", ArraysJSON, map[string]string{
+			"/app/db/host": "db1",
+			"/app/db/port": "5432",
+			"/app/hosts":   `["a",{"name":"b"}]`,
+		}},
+		{"custom separator", ".", ArraysIndex, map[string]string{
+			"/app.db.host":      "db1",
+			"/app.db.port":      "5432",
+			"/app.hosts.0":      "a",
+			"/app.hosts.1.name": "b",
+		}},
+		{"custom separator with JSON arrays", "_", ArraysJSON, map[string]string{
+			"/app_db_host": "db1",
+			"/app_db_port": "5432",
+			"/app_hosts":   `["a",{"name":"b"}]`,
+		}},
+	}
+	for _, tt := range tests {
+		c, err := NewFileClient([]string{values}, "*", tt.separator, tt.arrays)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		got, err := c.GetValues([]string{"/app"})
+		if err != nil {
+			t.Errorf("%s: GetValues() returned %s", tt.desc, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: GetValues() = %v, want %v", tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestNewFileClientInvalidArrays(t *testing.T) {
+	if _, err := NewFileClient([]string{"values.yaml"}, "*", "", "flatten"); err == nil {
+		t.Errorf("NewFileClient() with arrays %q returned no error", "flatten")
+	}
+}
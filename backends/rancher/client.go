@@ -11,6 +11,7 @@ import (
 	"time"
 
 	log "github.com/kelseyhightower/confd/log"
+	util "github.com/kelseyhightower/confd/util"
 )
 
 const (
@@ -22,7 +23,7 @@ type Client struct {
 	httpClient *http.Client
 }
 
-func NewRancherClient(backendNodes []string) (*Client, error) {
+func NewRancherClient(backendNodes []string, userAgent string) (*Client, error) {
 	url := MetaDataURL
 
 	if len(backendNodes) > 0 {
@@ -31,8 +32,10 @@ func NewRancherClient(backendNodes []string) (*Client, error) {
 
 	log.Info("Using Rancher Metadata URL: " + url)
 	client := &Client{
-		url:        url,
-		httpClient: &http.Client{},
+		url: url,
+		httpClient: &http.Client{
+			Transport: &util.UserAgentTransport{UserAgent: userAgent, Transport: http.DefaultTransport},
+		},
 	}
 
 	err := client.testConnection()
@@ -0,0 +1,111 @@
+package backends
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket shared by every goroutine using a store
+// client. It holds up to one second worth of requests, at least one, so
+// short bursts go through unthrottled.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+	sleep  func(time.Duration)
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+		now:    time.Now,
+		sleep:  time.Sleep,
+	}
+}
+
+// wait blocks until n requests may be made. Waiting callers reserve their
+// tokens up front, so concurrent callers are served in turn.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := l.now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if delay > 0 {
+		l.sleep(delay)
+	}
+}
+
+// rateLimitedClient is a StoreClient making at most the rate of its limiter
+// requests per second. Every key of a GetValues call counts as a request,
+// since most backends query keys one by one.
+type rateLimitedClient struct {
+	wrappedClient
+	limiter *rateLimiter
+}
+
+// rateLimitedTTLClient is a rateLimitedClient for TTLStoreClients.
+type rateLimitedTTLClient struct {
+	rateLimitedClient
+}
+
+func newRateLimitedClient(c StoreClient, rate float64) StoreClient {
+	r := rateLimitedClient{wrappedClient{c}, newRateLimiter(rate)}
+	if _, ok := c.(TTLStoreClient); ok {
+		return &rateLimitedTTLClient{r}
+	}
+	return &r
+}
+
+func (r *rateLimitedClient) GetValues(keys []string) (map[string]string, error) {
+	r.limiter.wait(len(keys))
+	return r.client.GetValues(keys)
+}
+
+func (r *rateLimitedClient) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	r.limiter.wait(1)
+	return r.wrappedClient.WatchPrefix(prefix, keys, waitIndex, stopChan)
+}
+
+func (r *rateLimitedClient) SetValue(key, value string) error {
+	r.limiter.wait(1)
+	return r.wrappedClient.SetValue(key, value)
+}
+
+func (r *rateLimitedClient) GetKeyInfo(key string) (string, uint64, int64, error) {
+	r.limiter.wait(1)
+	return r.wrappedClient.GetKeyInfo(key)
+}
+
+func (r *rateLimitedClient) GetTypedValues(keys []string) (map[string]string, map[string]interface{}, error) {
+	r.limiter.wait(len(keys))
+	return r.wrappedClient.GetTypedValues(keys)
+}
+
+func (r *rateLimitedClient) ClusterLeader() (string, error) {
+	r.limiter.wait(1)
+	return r.wrappedClient.ClusterLeader()
+}
+
+func (r *rateLimitedTTLClient) GetValuesWithTTL(keys []string) (map[string]string, map[string]int64, error) {
+	r.limiter.wait(len(keys))
+	return r.getValuesWithTTL(keys)
+}
@@ -0,0 +1,75 @@
+package backends
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/confd/backends/env"
+)
+
+// fakeClock advances only when slept on.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func TestRateLimiterThrottlesBurst(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	l := newRateLimiter(10)
+	l.now, l.sleep, l.last = clock.Now, clock.Sleep, clock.Now()
+
+	// The first second worth of requests pass immediately.
+	for i := 0; i < 10; i++ {
+		l.wait(1)
+	}
+	if elapsed := clock.Now().Sub(time.Unix(0, 0)); elapsed != 0 {
+		t.Errorf("the first 10 requests waited %s, want 0", elapsed)
+	}
+	// The next 20 are spread over two seconds.
+	for i := 0; i < 20; i++ {
+		l.wait(1)
+	}
+	if elapsed := clock.Now().Sub(time.Unix(0, 0)); elapsed < 1990*time.Millisecond || elapsed > 2010*time.Millisecond {
+		t.Errorf("30 requests at 10 per second took %s, want 2s", elapsed)
+	}
+}
+
+func TestRateLimitedClientCountsKeys(t *testing.T) {
+	os.Setenv("RATELIMITTEST_A", "1")
+	defer os.Unsetenv("RATELIMITTEST_A")
+	envClient, err := env.NewEnvClient()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	c := newRateLimitedClient(envClient, 2).(*rateLimitedClient)
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	c.limiter.now, c.limiter.sleep, c.limiter.last = clock.Now, clock.Sleep, clock.Now()
+	if _, ok := interface{}(c).(TTLStoreClient); ok {
+		t.Errorf("rate limited client of a backend without TTLs implements TTLStoreClient")
+	}
+
+	vars, err := c.GetValues([]string{"/ratelimittest", "/a", "/b", "/c"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if vars["/ratelimittest/a"] != "1" {
+		t.Errorf("GetValues() = %v, want /ratelimittest/a=1", vars)
+	}
+	if elapsed := clock.Now().Sub(time.Unix(0, 0)); elapsed != time.Second {
+		t.Errorf("fetching 4 keys at 2 per second waited %s, want 1s", elapsed)
+	}
+}
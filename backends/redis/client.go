@@ -9,6 +9,7 @@ import (
 
 	"github.com/garyburd/redigo/redis"
 	"github.com/kelseyhightower/confd/log"
+	util "github.com/kelseyhightower/confd/util"
 )
 
 
@@ -121,6 +122,17 @@ func NewRedisClient(machines []string, password string, separator string) (*Clie
 	return clientWrapper, err
 }
 
+// Close closes the connections to redis, ending the watch subscription.
+func (c *Client) Close() error {
+	if c.psc.Conn != nil {
+		c.psc.Close()
+	}
+	if c.client != nil {
+		return c.client.Close()
+	}
+	return nil
+}
+
 func (c *Client) transform(key string) string {
 	if c.separator == "/" {
 		return key;
@@ -220,11 +232,59 @@ func (c *Client) GetValues(keys []string) (map[string]string, error) {
 		}
 	}
 
-	log.Debug(fmt.Sprintf("Key Map: %#v", vars))
+	log.Debug(fmt.Sprintf("Read %d keys", len(vars)))
 
 	return vars, nil
 }
 
+// changeEvents are the keyspace notification events of the commands that
+// change or remove string and hash values.
+var changeEvents = map[string]bool{
+	"del": true, "append": true, "rename_from": true, "rename_to": true,
+	"expire": true, "expired": true, "evicted": true, "set": true,
+	"setrange": true, "incrby": true, "incrbyfloat": true, "hset": true,
+	"hincrby": true, "hincrbyfloat": true, "hdel": true,
+}
+
+// keyspacePatterns returns the patterns of the keyspace notification
+// channels of database db for prefix and the keys under it. Keys match whole
+// path elements, so /app does not match /application.
+func (c *Client) keyspacePatterns(db int, prefix string) []interface{} {
+	channel := "__keyspace@" + strconv.Itoa(db) + "__:"
+	prefix = util.NormalizePrefix(prefix)
+	if prefix == "/" {
+		return []interface{}{channel + "*"}
+	}
+	return []interface{}{channel + c.transform(prefix), channel + c.transform(prefix+"/*")}
+}
+
+// keyspaceEventsEnabled reports whether the notify-keyspace-events setting
+// flags publishes the keyspace events of every change WatchPrefix waits
+// for.
+func keyspaceEventsEnabled(flags string) bool {
+	if !strings.Contains(flags, "K") {
+		return false
+	}
+	return strings.Contains(flags, "A") || (strings.Contains(flags, "g") && strings.Contains(flags, "$") && strings.Contains(flags, "h"))
+}
+
+// checkKeyspaceEvents warns if the server rClient is connected to does not
+// publish the keyspace events watches rely on, so that watches never firing
+// are not mistaken for keys never changing. Servers that refuse CONFIG are
+// not checked.
+func checkKeyspaceEvents(rClient redis.Conn) {
+	reply, err := redis.Strings(rClient.Do("CONFIG", "GET", "notify-keyspace-events"))
+	if err != nil || len(reply) != 2 {
+		return
+	}
+	if !keyspaceEventsEnabled(reply[1]) {
+		log.Warning(fmt.Sprintf("Redis notify-keyspace-events is %q, watches will miss changes - set it to KA", reply[1]))
+	}
+}
+
+// WatchPrefix waits for a keyspace notification of a change to a key under
+// prefix. The server must publish keyspace events, as set by
+// notify-keyspace-events.
 func (c *Client) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
 		
 	if waitIndex == 0 {
@@ -249,6 +309,7 @@ func (c *Client) WatchPrefix(prefix string, keys []string, waitIndex uint64, sto
 				return
 			}
 		
+			checkKeyspaceEvents(rClient)
 			c.psc = redis.PubSubConn{Conn: rClient}		
 
 			go func() {
@@ -260,13 +321,8 @@ func (c *Client) WatchPrefix(prefix string, keys []string, waitIndex uint64, sto
 					switch n := c.psc.Receive().(type) {
 						case redis.PMessage:
 							log.Debug(fmt.Sprintf("Redis Message: %s %s\n", n.Channel, n.Data))
-							data := string(n.Data)
-							commands := [12]string{"del", "append", "rename_from", "rename_to", "expire", "set", "incrby", "incrbyfloat", "hset", "hincrby", "hincrbyfloat", "hdel"}
-							for _, command := range commands {
-								if command == data {
-									c.pscChan <- watchResponse{1, nil}
-									break
-								}
+							if changeEvents[string(n.Data)] {
+								c.pscChan <- watchResponse{1, nil}
 							}
 						case redis.Subscription:
 							log.Debug(fmt.Sprintf("Redis Subscription: %s %s %d\n", n.Kind, n.Channel, n.Count))
@@ -282,7 +338,7 @@ func (c *Client) WatchPrefix(prefix string, keys []string, waitIndex uint64, sto
 				}
 			}()
 			
-			c.psc.PSubscribe("__keyspace@" + strconv.Itoa(db) + "__:" + c.transform(prefix) + "*")
+			c.psc.PSubscribe(c.keyspacePatterns(db, prefix)...)
 		}
 	}()
 
@@ -0,0 +1,37 @@
+package redis
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeyspacePatterns(t *testing.T) {
+	for _, tt := range []struct {
+		separator, prefix string
+		want              []interface{}
+	}{
+		{"/", "/", []interface{}{"__keyspace@0__:*"}},
+		{"/", "/app/", []interface{}{"__keyspace@0__:/app", "__keyspace@0__:/app/*"}},
+		{":", "/app/db", []interface{}{"__keyspace@0__:app:db", "__keyspace@0__:app:db:*"}},
+	} {
+		c := &Client{separator: tt.separator}
+		if got := c.keyspacePatterns(0, tt.prefix); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("keyspacePatterns(%q) with separator %q = %v, want %v", tt.prefix, tt.separator, got, tt.want)
+		}
+	}
+}
+
+func TestKeyspaceEventsEnabled(t *testing.T) {
+	for flags, want := range map[string]bool{
+		"":     false,
+		"KA":   true,
+		"AKE":  true,
+		"EA":   false,
+		"Kg$h": true,
+		"Kg$":  false,
+	} {
+		if got := keyspaceEventsEnabled(flags); got != want {
+			t.Errorf("keyspaceEventsEnabled(%q) = %v, want %v", flags, got, want)
+		}
+	}
+}
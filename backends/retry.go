@@ -0,0 +1,88 @@
+package backends
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/kelseyhightower/confd/log"
+)
+
+// The backoff between the attempts of a failing fetch, doubled after every
+// attempt up to the maximum.
+var (
+	retryBackoff    = 500 * time.Millisecond
+	maxRetryBackoff = 10 * time.Second
+)
+
+// retryingClient is a StoreClient retrying failing fetches up to retries
+// times, with exponential backoff, so that a backend briefly unavailable,
+// as during a rolling restart or a leader election, does not fail the
+// whole processing cycle. Watches and writes are not retried.
+type retryingClient struct {
+	wrappedClient
+	retries int
+	sleep   func(time.Duration)
+}
+
+// retryingTTLClient is a retryingClient for TTLStoreClients.
+type retryingTTLClient struct {
+	retryingClient
+}
+
+func newRetryingClient(c StoreClient, retries int) StoreClient {
+	r := retryingClient{wrappedClient: wrappedClient{c}, retries: retries, sleep: time.Sleep}
+	if _, ok := c.(TTLStoreClient); ok {
+		return &retryingTTLClient{r}
+	}
+	return &r
+}
+
+// retry calls fetch until it succeeds or fails retries+1 times.
+// It returns the error of the last attempt.
+func (r *retryingClient) retry(fetch func() error) error {
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		err := fetch()
+		if err == nil || attempt > r.retries {
+			return err
+		}
+		log.Warning(fmt.Sprintf("Backend fetch failed (attempt %d of %d), retrying in %s: %s", attempt, r.retries+1, backoff, err))
+		r.sleep(backoff)
+		backoff *= 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+func (r *retryingClient) GetValues(keys []string) (map[string]string, error) {
+	var vars map[string]string
+	err := r.retry(func() (err error) {
+		vars, err = r.client.GetValues(keys)
+		return err
+	})
+	return vars, err
+}
+
+func (r *retryingClient) GetTypedValues(keys []string) (map[string]string, map[string]interface{}, error) {
+	if _, ok := r.client.(TypedStoreClient); !ok {
+		return nil, nil, ErrTypedValuesUnsupported
+	}
+	var vars map[string]string
+	var types map[string]interface{}
+	err := r.retry(func() (err error) {
+		vars, types, err = r.wrappedClient.GetTypedValues(keys)
+		return err
+	})
+	return vars, types, err
+}
+
+func (r *retryingTTLClient) GetValuesWithTTL(keys []string) (map[string]string, map[string]int64, error) {
+	var vars map[string]string
+	var ttls map[string]int64
+	err := r.retry(func() (err error) {
+		vars, ttls, err = r.getValuesWithTTL(keys)
+		return err
+	})
+	return vars, ttls, err
+}
@@ -0,0 +1,78 @@
+package backends
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/confd/log"
+)
+
+// flakyClient fails the first failures fetches.
+type flakyClient struct {
+	failures int
+	calls    int
+}
+
+func (c *flakyClient) GetValues(keys []string) (map[string]string, error) {
+	c.calls++
+	if c.calls <= c.failures {
+		return nil, errors.New("connection refused")
+	}
+	return map[string]string{"/app/port": "80"}, nil
+}
+
+func (c *flakyClient) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	return 0, nil
+}
+
+func TestRetryingClientBacksOff(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	log.SetLevel("warn")
+
+	tests := []struct {
+		failures, retries int
+		wantErr           bool
+		wantSleeps        []time.Duration
+	}{
+		{0, 3, false, nil},
+		{2, 3, false, []time.Duration{500 * time.Millisecond, time.Second}},
+		{9, 6, true, []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second}},
+	}
+	for _, tt := range tests {
+		flaky := &flakyClient{failures: tt.failures}
+		c := newRetryingClient(flaky, tt.retries).(*retryingClient)
+		var sleeps []time.Duration
+		c.sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+
+		vars, err := c.GetValues([]string{"/app"})
+		if tt.wantErr {
+			if err == nil || err.Error() != "connection refused" {
+				t.Errorf("%d failures, %d retries: err = %v, want the last fetch error", tt.failures, tt.retries, err)
+			}
+		} else if err != nil || vars["/app/port"] != "80" {
+			t.Errorf("%d failures, %d retries: GetValues() = %v, %v", tt.failures, tt.retries, vars, err)
+		}
+		if want := tt.retries + 1; tt.wantErr && flaky.calls != want {
+			t.Errorf("%d failures, %d retries: %d fetches, want %d", tt.failures, tt.retries, flaky.calls, want)
+		}
+		if len(sleeps) != len(tt.wantSleeps) {
+			t.Errorf("%d failures, %d retries: slept %v, want %v", tt.failures, tt.retries, sleeps, tt.wantSleeps)
+			continue
+		}
+		for i := range sleeps {
+			if sleeps[i] != tt.wantSleeps[i] {
+				t.Errorf("%d failures, %d retries: slept %v, want %v", tt.failures, tt.retries, sleeps, tt.wantSleeps)
+				break
+			}
+		}
+	}
+	if out := buf.String(); !strings.Contains(out, "Backend fetch failed (attempt 1 of 4), retrying in 500ms: connection refused") {
+		t.Errorf("log output %q does not report the retries", out)
+	}
+}
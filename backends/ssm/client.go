@@ -5,6 +5,8 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/kelseyhightower/confd/log"
@@ -14,9 +16,16 @@ type Client struct {
 	client *ssm.SSM
 }
 
-func New() (*Client, error) {
+// New returns a *ssm.Client using the default AWS credential chain, which
+// ends with the credentials of the EC2 instance profile. The region is
+// taken from AWS_REGION or the shared config, or else from the EC2
+// instance metadata.
+// userAgent is appended to the User-Agent header of every request.
+func New(userAgent string) (*Client, error) {
 	// Create a session to share configuration, and load external configuration.
 	sess := session.Must(session.NewSession())
+	sess.Handlers.Build.PushBack(request.MakeAddToUserAgentFreeFormHandler(userAgent))
+	setRegion(sess, ec2metadata.New(sess))
 
 	// Fail early, if no credentials can be found
 	_, err := sess.Config.Credentials.Get()
@@ -40,6 +49,22 @@ func New() (*Client, error) {
 	return &Client{svc}, nil
 }
 
+// setRegion sets the region of sess, if none is configured, to the region
+// of the EC2 instance confd runs on, as reported by metadata. Outside of EC2
+// the region is left unset and requests fail with a missing region error.
+func setRegion(sess *session.Session, metadata *ec2metadata.EC2Metadata) {
+	if aws.StringValue(sess.Config.Region) != "" {
+		return
+	}
+	region, err := metadata.Region()
+	if err != nil {
+		log.Debug("Cannot get the AWS region from the EC2 instance metadata - %s", err.Error())
+		return
+	}
+	log.Info("AWS region set to %s from the EC2 instance metadata", region)
+	sess.Config.Region = aws.String(region)
+}
+
 // GetValues retrieves the values for the given keys from AWS SSM Parameter Store
 func (c *Client) GetValues(keys []string) (map[string]string, error) {
 	vars := make(map[string]string)
@@ -53,7 +78,7 @@ func (c *Client) GetValues(keys []string) (map[string]string, error) {
 		}
 		if len(resp) == 0 {
 			resp, err = c.getParameter(key)
-			if err != nil && err.(awserr.Error).Code() != ssm.ErrCodeParameterNotFound {
+			if aerr, ok := err.(awserr.Error); err != nil && (!ok || aerr.Code() != ssm.ErrCodeParameterNotFound) {
 				return vars, err
 			}
 		}
@@ -72,7 +97,7 @@ func (c *Client) getParametersWithPrefix(prefix string) (map[string]string, erro
 		Recursive:      aws.Bool(true),
 		WithDecryption: aws.Bool(true),
 	}
-	c.client.GetParametersByPathPages(params,
+	err = c.client.GetParametersByPathPages(params,
 		func(page *ssm.GetParametersByPathOutput, lastPage bool) bool {
 			for _, p := range page.Parameters {
 				parameters[*p.Name] = *p.Value
@@ -0,0 +1,36 @@
+package ssm
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+func TestSetRegion(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/latest/dynamic/instance-identity/document" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"region": "eu-west-1"}`)
+	}))
+	defer s.Close()
+
+	for _, tt := range []struct {
+		region, want string
+	}{
+		{"", "eu-west-1"},
+		{"us-east-2", "us-east-2"},
+	} {
+		sess := session.Must(session.NewSession(&aws.Config{Region: aws.String(tt.region)}))
+		setRegion(sess, ec2metadata.New(sess, &aws.Config{Endpoint: aws.String(s.URL + "/latest")}))
+		if got := aws.StringValue(sess.Config.Region); got != tt.want {
+			t.Errorf("setRegion() with region %q = %q, want %q", tt.region, got, tt.want)
+		}
+	}
+}
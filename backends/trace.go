@@ -0,0 +1,96 @@
+package backends
+
+import (
+	"time"
+
+	"github.com/kelseyhightower/confd/log"
+)
+
+// tracingClient is a StoreClient logging every request, with the number of
+// keys returned and its duration, as trace messages.
+type tracingClient struct {
+	wrappedClient
+}
+
+// tracingTTLClient is a tracingClient for TTLStoreClients.
+type tracingTTLClient struct {
+	tracingClient
+}
+
+func newTracingClient(c StoreClient) StoreClient {
+	t := tracingClient{wrappedClient{c}}
+	if _, ok := c.(TTLStoreClient); ok {
+		return &tracingTTLClient{t}
+	}
+	return &t
+}
+
+func (t *tracingClient) GetValues(keys []string) (map[string]string, error) {
+	start := time.Now()
+	vars, err := t.client.GetValues(keys)
+	traceGet("GetValues", keys, len(vars), start, err)
+	return vars, err
+}
+
+func (t *tracingClient) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	log.Trace("WatchPrefix %s from index %d for keys %v", prefix, waitIndex, keys)
+	start := time.Now()
+	index, err := t.wrappedClient.WatchPrefix(prefix, keys, waitIndex, stopChan)
+	if err != nil {
+		log.Trace("WatchPrefix %s failed after %s: %s", prefix, time.Since(start), err)
+		return index, err
+	}
+	log.Trace("WatchPrefix %s returned index %d after %s", prefix, index, time.Since(start))
+	return index, err
+}
+
+func (t *tracingClient) SetValue(key, value string) error {
+	start := time.Now()
+	err := t.wrappedClient.SetValue(key, value)
+	if err != nil {
+		log.Trace("SetValue %s failed after %s: %s", key, time.Since(start), err)
+		return err
+	}
+	log.Trace("SetValue %s took %s", key, time.Since(start))
+	return nil
+}
+
+func (t *tracingClient) GetKeyInfo(key string) (string, uint64, int64, error) {
+	start := time.Now()
+	value, index, ttl, err := t.wrappedClient.GetKeyInfo(key)
+	traceGet("GetKeyInfo", []string{key}, 1, start, err)
+	return value, index, ttl, err
+}
+
+func (t *tracingClient) GetTypedValues(keys []string) (map[string]string, map[string]interface{}, error) {
+	start := time.Now()
+	vars, types, err := t.wrappedClient.GetTypedValues(keys)
+	traceGet("GetTypedValues", keys, len(vars), start, err)
+	return vars, types, err
+}
+
+func (t *tracingClient) ClusterLeader() (string, error) {
+	start := time.Now()
+	leader, err := t.wrappedClient.ClusterLeader()
+	if err != nil {
+		log.Trace("ClusterLeader failed after %s: %s", time.Since(start), err)
+		return "", err
+	}
+	log.Trace("ClusterLeader returned %q in %s", leader, time.Since(start))
+	return leader, nil
+}
+
+func (t *tracingTTLClient) GetValuesWithTTL(keys []string) (map[string]string, map[string]int64, error) {
+	start := time.Now()
+	vars, ttls, err := t.getValuesWithTTL(keys)
+	traceGet("GetValuesWithTTL", keys, len(vars), start, err)
+	return vars, ttls, err
+}
+
+func traceGet(method string, keys []string, count int, start time.Time, err error) {
+	if err != nil {
+		log.Trace("%s %v failed after %s: %s", method, keys, time.Since(start), err)
+		return
+	}
+	log.Trace("%s %v returned %d keys in %s", method, keys, count, time.Since(start))
+}
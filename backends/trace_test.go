@@ -0,0 +1,45 @@
+package backends
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kelseyhightower/confd/backends/env"
+	"github.com/kelseyhightower/confd/log"
+)
+
+func TestTracingClientLogsRequests(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetTrace(true)
+	defer func() {
+		log.SetTrace(false)
+		log.SetLevel("warn")
+		log.SetOutput(os.Stderr)
+	}()
+	os.Setenv("TRACETEST_A", "1")
+	os.Setenv("TRACETEST_B", "2")
+	defer os.Unsetenv("TRACETEST_A")
+	defer os.Unsetenv("TRACETEST_B")
+
+	envClient, err := env.NewEnvClient()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	c := newTracingClient(envClient)
+	if _, ok := c.(TTLStoreClient); ok {
+		t.Errorf("tracing client of a backend without TTLs implements TTLStoreClient")
+	}
+	vars, err := c.GetValues([]string{"/tracetest"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(vars) != 2 {
+		t.Errorf("GetValues() = %v, want 2 keys", vars)
+	}
+	if out := buf.String(); !strings.Contains(out, "TRACE GetValues [/tracetest] returned 2 keys in") {
+		t.Errorf("trace output %q does not describe the request", out)
+	}
+}
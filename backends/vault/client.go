@@ -9,16 +9,38 @@ import (
 	"io/ioutil"
 	"net/http"
 	"path"
+	"sync"
+	"time"
 
 	vaultapi "github.com/hashicorp/vault/api"
 	"github.com/kelseyhightower/confd/log"
+	util "github.com/kelseyhightower/confd/util"
 )
 
 // Client is a wrapper around the vault client
 type Client struct {
 	client *vaultapi.Client
+
+	// mu guards renewAt, failures and updated, which track the leases of
+	// the secrets last read by GetValues.
+	mu       sync.Mutex
+	renewAt  map[string]time.Time
+	failures map[string]int
+	updated  chan struct{}
 }
 
+// leaseRenewRatio is the part of a lease after which the secret it
+// belongs to is read again, leaving time to render the new secret before
+// the old one expires.
+const leaseRenewRatio = 2.0 / 3
+
+// The delay before reading a leased secret again after reading it failed,
+// doubled after every consecutive failure up to the maximum.
+var (
+	leaseRetryBackoff    = 2 * time.Second
+	maxLeaseRetryBackoff = time.Minute
+)
+
 // get a
 func getParameter(key string, parameters map[string]string) string {
 	value := parameters[key]
@@ -116,13 +138,13 @@ func authenticate(c *vaultapi.Client, authType string, params map[string]string)
 	return nil
 }
 
-func getConfig(address, cert, key, caCert string) (*vaultapi.Config, error) {
+func getConfig(address, cert, key, caCert, userAgent string) (*vaultapi.Config, error) {
 	conf := vaultapi.DefaultConfig()
 	conf.Address = address
 
 	tlsConfig := &tls.Config{}
 	if cert != "" && key != "" {
-		clientCert, err := tls.LoadX509KeyPair(cert, key)
+		clientCert, err := util.LoadX509KeyPair(cert, key)
 		if err != nil {
 			return nil, err
 		}
@@ -140,8 +162,11 @@ func getConfig(address, cert, key, caCert string) (*vaultapi.Config, error) {
 		tlsConfig.RootCAs = caCertPool
 	}
 
-	conf.HttpClient.Transport = &http.Transport{
-		TLSClientConfig: tlsConfig,
+	conf.HttpClient.Transport = &util.UserAgentTransport{
+		UserAgent: userAgent,
+		Transport: &http.Transport{
+			TLSClientConfig: tlsConfig,
+		},
 	}
 
 	return conf, nil
@@ -154,7 +179,7 @@ func New(address, authType string, params map[string]string) (*Client, error) {
 		return nil, errors.New("you have to set the auth type when using the vault backend")
 	}
 	log.Info("Vault authentication backend set to %s", authType)
-	conf, err := getConfig(address, params["cert"], params["key"], params["caCert"])
+	conf, err := getConfig(address, params["cert"], params["key"], params["caCert"], params["userAgent"])
 
 	if err != nil {
 		return nil, err
@@ -168,7 +193,7 @@ func New(address, authType string, params map[string]string) (*Client, error) {
 	if err := authenticate(c, authType, params); err != nil {
 		return nil, err
 	}
-	return &Client{c}, nil
+	return &Client{client: c, renewAt: make(map[string]time.Time), failures: make(map[string]int), updated: make(chan struct{})}, nil
 }
 
 // GetValues queries etcd for keys prefixed by prefix.
@@ -184,8 +209,10 @@ func (c *Client) GetValues(keys []string) (map[string]string, error) {
 
 		if err != nil {
 			log.Debug("there was an error extracting %s", key)
+			c.retryLease(key)
 			return nil, err
 		}
+		c.trackLease(key, resp)
 		if resp == nil || resp.Data == nil {
 			continue
 		}
@@ -222,7 +249,7 @@ func isKV(data map[string]interface{}) (string, bool) {
 func flatten(key string, value interface{}, vars map[string]string) {
 	switch value.(type) {
 	case string:
-		log.Debug("setting key %s to: %s", key, value)
+		log.Debug("setting key %s", key)
 		vars[key] = value.(string)
 	case map[string]interface{}:
 		inner := value.(map[string]interface{})
@@ -282,8 +309,92 @@ func walkTree(c *Client, key string, branches map[string]bool) error {
 	return nil
 }
 
-// WatchPrefix - not implemented at the moment
+// trackLease records when the secret at key, read as resp, should be read
+// again, forgetting any previous lease of key. Secrets without a lease are
+// not read again until they are watched from scratch.
+func (c *Client) trackLease(key string, resp *vaultapi.Secret) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.renewAt, key)
+	delete(c.failures, key)
+	if resp != nil && resp.LeaseDuration > 0 {
+		d := time.Duration(float64(resp.LeaseDuration) * leaseRenewRatio * float64(time.Second))
+		log.Debug("lease of %s expires in %ds, reading it again in %s", key, resp.LeaseDuration, d)
+		c.renewAt[key] = time.Now().Add(d)
+	}
+	close(c.updated)
+	c.updated = make(chan struct{})
+}
+
+// retryLease postpones reading the secret at key again, if it has a lease,
+// after reading it failed, so that watches do not retry a failing Vault in
+// a tight loop. The delay doubles with every consecutive failure.
+func (c *Client) retryLease(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.renewAt[key]; !ok {
+		return
+	}
+	c.failures[key]++
+	d := leaseRetryBackoff
+	for i := 1; i < c.failures[key] && d < maxLeaseRetryBackoff; i++ {
+		d *= 2
+	}
+	if d > maxLeaseRetryBackoff {
+		d = maxLeaseRetryBackoff
+	}
+	log.Warning("Cannot read %s to renew its lease, retrying in %s", key, d)
+	c.renewAt[key] = time.Now().Add(d)
+	close(c.updated)
+	c.updated = make(chan struct{})
+}
+
+// nextRenewal returns the earliest time a secret under one of keys should
+// be read again, whether there is one, and a channel closed once
+// GetValues reads secrets again.
+func (c *Client) nextRenewal(keys []string) (time.Time, bool, chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var next time.Time
+	found := false
+	for key, at := range c.renewAt {
+		for _, k := range keys {
+			if _, ok := util.TrimPathPrefix(key, k); ok && (!found || at.Before(next)) {
+				next, found = at, true
+			}
+		}
+	}
+	return next, found, c.updated
+}
+
+// WatchPrefix waits until a lease of a secret under keys is due for
+// renewal, so that the secret is read again, and rendered again if it was
+// rotated, before the lease expires. Vault has no way to watch for changes,
+// so secrets without a lease are only read again by interval processing.
 func (c *Client) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
-	<-stopChan
-	return 0, nil
+	// return something > 0 to trigger the first read of the secrets, which
+	// also records their leases
+	if waitIndex == 0 {
+		return 1, nil
+	}
+	for {
+		next, found, updated := c.nextRenewal(keys)
+		var due <-chan time.Time
+		var timer *time.Timer
+		if found {
+			timer = time.NewTimer(time.Until(next))
+			due = timer.C
+		}
+		select {
+		case <-stopChan:
+			return 0, nil
+		case <-updated:
+			if timer != nil {
+				timer.Stop()
+			}
+		case <-due:
+			log.Info("Vault lease under %s is due for renewal, reading it again", prefix)
+			return waitIndex + 1, nil
+		}
+	}
 }
@@ -0,0 +1,139 @@
+package vault
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestClient returns a client authenticated with a token to a fake
+// Vault serving the secret at /secret/db with a lease of lease seconds,
+// failing to read it while fail is set.
+func newTestClient(t *testing.T, lease int, fail *int32) (*Client, func()) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/v1/auth/token/lookup-self":
+			fmt.Fprint(w, `{"data": {}}`)
+		case r.URL.Path == "/v1/secret/db" && r.Method == "GET" && r.URL.Query().Get("list") == "" && atomic.LoadInt32(fail) != 0:
+			http.Error(w, `{"errors": ["sealed"]}`, http.StatusServiceUnavailable)
+		case r.URL.Path == "/v1/secret/db" && r.Method == "GET" && r.URL.Query().Get("list") == "":
+			fmt.Fprintf(w, `{"lease_duration": %d, "data": {"value": "s3cret"}}`, lease)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	c, err := New(s.URL, "token", map[string]string{"token": "root"})
+	if err != nil {
+		s.Close()
+		t.Fatal(err.Error())
+	}
+	return c, s.Close
+}
+
+func TestWatchPrefixRenewsLeases(t *testing.T) {
+	c, done := newTestClient(t, 1, new(int32))
+	defer done()
+
+	stop := make(chan bool)
+	defer close(stop)
+	result := make(chan uint64, 1)
+	go func() {
+		index, _ := c.WatchPrefix("/secret", []string{"/secret/db"}, 3, stop)
+		result <- index
+	}()
+	vars, err := c.GetValues([]string{"/secret/db"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if vars["/secret/db"] != "s3cret" {
+		t.Fatalf("GetValues() = %v, want /secret/db set", vars)
+	}
+	select {
+	case index := <-result:
+		if index != 4 {
+			t.Errorf("WatchPrefix() = %d, want 4", index)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("WatchPrefix() did not return before the lease expired")
+	}
+}
+
+func TestWatchPrefixFirstRead(t *testing.T) {
+	c, done := newTestClient(t, 1, new(int32))
+	defer done()
+
+	stop := make(chan bool)
+	defer close(stop)
+	result := make(chan uint64, 1)
+	go func() {
+		index, _ := c.WatchPrefix("/secret", []string{"/secret/db"}, 0, stop)
+		result <- index
+	}()
+	select {
+	case index := <-result:
+		if index == 0 {
+			t.Errorf("WatchPrefix() = 0 for the first read, want a non zero index")
+		}
+	case <-time.After(time.Second):
+		t.Error("WatchPrefix() with waitIndex 0 and no lease waited instead of triggering the first read")
+	}
+}
+
+func TestWatchPrefixWithoutLease(t *testing.T) {
+	c, done := newTestClient(t, 0, new(int32))
+	defer done()
+
+	if _, err := c.GetValues([]string{"/secret/db"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	stop := make(chan bool)
+	result := make(chan uint64, 1)
+	go func() {
+		index, _ := c.WatchPrefix("/secret", []string{"/secret/db"}, 3, stop)
+		result <- index
+	}()
+	select {
+	case index := <-result:
+		t.Fatalf("WatchPrefix() = %d for a secret without a lease, want it to wait", index)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(stop)
+	if index := <-result; index != 0 {
+		t.Errorf("WatchPrefix() = %d once stopped, want 0", index)
+	}
+}
+
+func TestWatchPrefixBacksOffFailedRenewals(t *testing.T) {
+	defer func(d time.Duration) { leaseRetryBackoff = d }(leaseRetryBackoff)
+	leaseRetryBackoff = 200 * time.Millisecond
+	var fail int32
+	c, done := newTestClient(t, 1, &fail)
+	defer done()
+
+	if _, err := c.GetValues([]string{"/secret/db"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	stop := make(chan bool)
+	defer close(stop)
+	if _, err := c.WatchPrefix("/secret", []string{"/secret/db"}, 1, stop); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	atomic.StoreInt32(&fail, 1)
+	for _, want := range []time.Duration{200 * time.Millisecond, 400 * time.Millisecond} {
+		if _, err := c.GetValues([]string{"/secret/db"}); err == nil {
+			t.Fatal("GetValues() returned no error from a failing Vault")
+		}
+		start := time.Now()
+		if _, err := c.WatchPrefix("/secret", []string{"/secret/db"}, 1, stop); err != nil {
+			t.Fatal(err.Error())
+		}
+		if elapsed := time.Since(start); elapsed < want*3/4 {
+			t.Errorf("WatchPrefix() returned after %s following a failed read, want a backoff of %s", elapsed, want)
+		}
+	}
+}
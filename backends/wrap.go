@@ -0,0 +1,64 @@
+package backends
+
+import "io"
+
+// wrappedClient is embedded by the store clients wrapping another one, such
+// as the rate limited, tracing and retrying clients. It forwards WatchPrefix
+// and the methods of the optional store client interfaces to the wrapped
+// client, failing with ErrWriteUnsupported, ErrKeyInfoUnsupported,
+// ErrTypedValuesUnsupported or ErrLeaderUnsupported if the wrapped client
+// does not implement them, and Close, so that wrapping a client keeps what
+// it supports. Wrapping clients override the methods they change.
+type wrappedClient struct {
+	client StoreClient
+}
+
+func (w *wrappedClient) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	return w.client.WatchPrefix(prefix, keys, waitIndex, stopChan)
+}
+
+func (w *wrappedClient) SetValue(key, value string) error {
+	c, ok := w.client.(WriteStoreClient)
+	if !ok {
+		return ErrWriteUnsupported
+	}
+	return c.SetValue(key, value)
+}
+
+func (w *wrappedClient) GetKeyInfo(key string) (string, uint64, int64, error) {
+	c, ok := w.client.(KeyInfoClient)
+	if !ok {
+		return "", 0, 0, ErrKeyInfoUnsupported
+	}
+	return c.GetKeyInfo(key)
+}
+
+func (w *wrappedClient) GetTypedValues(keys []string) (map[string]string, map[string]interface{}, error) {
+	c, ok := w.client.(TypedStoreClient)
+	if !ok {
+		return nil, nil, ErrTypedValuesUnsupported
+	}
+	return c.GetTypedValues(keys)
+}
+
+func (w *wrappedClient) ClusterLeader() (string, error) {
+	c, ok := w.client.(LeaderClient)
+	if !ok {
+		return "", ErrLeaderUnsupported
+	}
+	return c.ClusterLeader()
+}
+
+// Close closes the wrapped client if it is an io.Closer.
+func (w *wrappedClient) Close() error {
+	if c, ok := w.client.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// getValuesWithTTL fetches keys through the wrapped client, which must be
+// a TTLStoreClient, as the wrapping clients for TTLStoreClients do.
+func (w *wrappedClient) getValuesWithTTL(keys []string) (map[string]string, map[string]int64, error) {
+	return w.client.(TTLStoreClient).GetValuesWithTTL(keys)
+}
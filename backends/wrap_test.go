@@ -0,0 +1,51 @@
+package backends
+
+import (
+	"testing"
+
+	"github.com/kelseyhightower/confd/log"
+)
+
+// leaderClient is a LeaderClient whose cluster is led by leader.
+type leaderClient struct {
+	flakyClient
+	leader string
+}
+
+func (c *leaderClient) ClusterLeader() (string, error) {
+	return c.leader, nil
+}
+
+func TestWrappingKeepsOptionalInterfaces(t *testing.T) {
+	log.SetLevel("warn")
+	wrappers := map[string]func(StoreClient) StoreClient{
+		"rate limited": func(c StoreClient) StoreClient { return newRateLimitedClient(c, 1000) },
+		"tracing":      newTracingClient,
+		"retrying":     func(c StoreClient) StoreClient { return newRetryingClient(c, 2) },
+	}
+	for name, wrap := range wrappers {
+		c := wrap(&flakyClient{}).(interface {
+			WriteStoreClient
+			KeyInfoClient
+			TypedStoreClient
+			LeaderClient
+		})
+		if err := c.SetValue("/app/port", "80"); err != ErrWriteUnsupported {
+			t.Errorf("%s: SetValue() = %v, want ErrWriteUnsupported", name, err)
+		}
+		if _, _, _, err := c.GetKeyInfo("/app/port"); err != ErrKeyInfoUnsupported {
+			t.Errorf("%s: GetKeyInfo() = %v, want ErrKeyInfoUnsupported", name, err)
+		}
+		if _, _, err := c.GetTypedValues([]string{"/app"}); err != ErrTypedValuesUnsupported {
+			t.Errorf("%s: GetTypedValues() = %v, want ErrTypedValuesUnsupported", name, err)
+		}
+		if _, err := c.ClusterLeader(); err != ErrLeaderUnsupported {
+			t.Errorf("%s: ClusterLeader() = %v, want ErrLeaderUnsupported", name, err)
+		}
+
+		l := wrap(&leaderClient{leader: "10.0.0.1:2380"}).(LeaderClient)
+		if leader, err := l.ClusterLeader(); err != nil || leader != "10.0.0.1:2380" {
+			t.Errorf("%s: ClusterLeader() = %q, %v, want the leader of the wrapped client", name, leader, err)
+		}
+	}
+}
@@ -2,10 +2,12 @@ package zookeeper
 
 import (
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/kelseyhightower/confd/log"
+	util "github.com/kelseyhightower/confd/util"
 	zk "github.com/samuel/go-zookeeper/zk"
 )
 
@@ -17,11 +19,17 @@ type Client struct {
 func NewZookeeperClient(machines []string) (*Client, error) {
 	c, _, err := zk.Connect(machines, time.Second) //*10)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	return &Client{c}, nil
 }
 
+// Close closes the connection to the zookeeper ensemble.
+func (c *Client) Close() error {
+	c.client.Close()
+	return nil
+}
+
 func nodeWalk(prefix string, c *Client, vars map[string]string) error {
 	var s string
 	l, stat, err := c.client.Children(prefix)
@@ -65,10 +73,14 @@ func (c *Client) GetValues(keys []string) (map[string]string, error) {
 	vars := make(map[string]string)
 	for _, v := range keys {
 		v = strings.Replace(v, "/*", "", -1)
-		_, _, err := c.client.Exists(v)
+		exists, _, err := c.client.Exists(v)
 		if err != nil {
 			return vars, err
 		}
+		// Like keys missing from etcd, a missing znode has no values.
+		if !exists {
+			continue
+		}
 		err = nodeWalk(v, c, vars)
 		if err != nil {
 			return vars, err
@@ -82,25 +94,53 @@ type watchResponse struct {
 	err       error
 }
 
+// watch sends a response on respChan once key, a znode, changes: once its
+// data or children change or it is deleted, or, if it does not exist yet,
+// once it is created. ZooKeeper watches fire once, so watch returns after
+// the first change or once cancelRoutine is closed.
 func (c *Client) watch(key string, respChan chan watchResponse, cancelRoutine chan bool) {
+	send := func(r watchResponse) {
+		select {
+		case respChan <- r:
+		case <-cancelRoutine:
+		}
+	}
+	exists, _, existsEventCh, err := c.client.ExistsW(key)
+	if err != nil {
+		send(watchResponse{0, err})
+		return
+	}
+	if !exists {
+		select {
+		case e := <-existsEventCh:
+			send(watchResponse{1, e.Err})
+		case <-cancelRoutine:
+			log.Debug("Stop watching: " + key)
+		}
+		return
+	}
 	_, _, keyEventCh, err := c.client.GetW(key)
 	if err != nil {
-		respChan <- watchResponse{0, err}
+		send(watchResponse{0, err})
+		return
 	}
 	_, _, childEventCh, err := c.client.ChildrenW(key)
 	if err != nil {
-		respChan <- watchResponse{0, err}
+		send(watchResponse{0, err})
+		return
 	}
 
 	for {
 		select {
 		case e := <-keyEventCh:
-			if e.Type == zk.EventNodeDataChanged {
-				respChan <- watchResponse{1, e.Err}
+			if e.Type == zk.EventNodeDataChanged || e.Type == zk.EventNodeDeleted {
+				send(watchResponse{1, e.Err})
+				return
 			}
 		case e := <-childEventCh:
 			if e.Type == zk.EventNodeChildrenChanged {
-				respChan <- watchResponse{1, e.Err}
+				send(watchResponse{1, e.Err})
+				return
 			}
 		case <-cancelRoutine:
 			log.Debug("Stop watching: " + key)
@@ -110,6 +150,40 @@ func (c *Client) watch(key string, respChan chan watchResponse, cancelRoutine ch
 	}
 }
 
+// watchedNodes returns the znodes to watch for changes to keys, given the
+// values entries currently under the watched prefix: keys themselves, so
+// that their first children and their creation are seen, and every value
+// under one of keys with its parent znodes up to that key, so that changed,
+// added and removed values are seen. Keys match whole path elements, so /app does
+// not match /application.
+func watchedNodes(entries map[string]string, keys []string) []string {
+	nodes := make(map[string]bool)
+	for _, v := range keys {
+		nodes[util.NormalizePrefix(strings.Replace(v, "/*", "", -1))] = true
+	}
+	for k := range entries {
+		for _, v := range keys {
+			v = strings.Replace(v, "/*", "", -1)
+			if _, ok := util.TrimPathPrefix(k, v); ok {
+				nodes[k] = true
+				for dir := filepath.Dir(k); dir != "/"; dir = filepath.Dir(dir) {
+					if _, ok := util.TrimPathPrefix(dir, v); !ok {
+						break
+					}
+					nodes[dir] = true
+				}
+				break
+			}
+		}
+	}
+	list := make([]string, 0, len(nodes))
+	for node := range nodes {
+		list = append(list, node)
+	}
+	sort.Strings(list)
+	return list
+}
+
 func (c *Client) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
 	// return something > 0 to trigger a key retrieval from the store
 	if waitIndex == 0 {
@@ -126,32 +200,9 @@ func (c *Client) WatchPrefix(prefix string, keys []string, waitIndex uint64, sto
 	cancelRoutine := make(chan bool)
 	defer close(cancelRoutine)
 
-	//watch all subfolders for changes
-	watchMap := make(map[string]string)
-	for k, _ := range entries {
-		for _, v := range keys {
-			if strings.HasPrefix(k, v) {
-				for dir := filepath.Dir(k); dir != "/"; dir = filepath.Dir(dir) {
-					if _, ok := watchMap[dir]; !ok {
-						watchMap[dir] = ""
-						log.Debug("Watching: " + dir)
-						go c.watch(dir, respChan, cancelRoutine)
-					}
-				}
-				break
-			}
-		}
-	}
-
-	//watch all keys in prefix for changes
-	for k, _ := range entries {
-		for _, v := range keys {
-			if strings.HasPrefix(k, v) {
-				log.Debug("Watching: " + k)
-				go c.watch(k, respChan, cancelRoutine)
-				break
-			}
-		}
+	for _, node := range watchedNodes(entries, keys) {
+		log.Debug("Watching: " + node)
+		go c.watch(node, respChan, cancelRoutine)
 	}
 
 	for {
@@ -0,0 +1,21 @@
+package zookeeper
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWatchedNodes(t *testing.T) {
+	entries := map[string]string{
+		"/app/db/host":      "10.0.0.1",
+		"/app/db/port":      "5432",
+		"/app/name":         "web",
+		"/application/name": "other",
+		"/other/key":        "value",
+	}
+	got := watchedNodes(entries, []string{"/app/db", "/app/name", "/app/cache/*"})
+	want := []string{"/app/cache", "/app/db", "/app/db/host", "/app/db/port", "/app/name"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("watchedNodes() = %v, want %v", got, want)
+	}
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"reflect"
 	"runtime"
 	"syscall"
 
@@ -19,21 +21,31 @@ func main() {
 		fmt.Printf("confd %s (Git SHA: %s, Go Version: %s)\n", Version, GitSHA, runtime.Version())
 		os.Exit(0)
 	}
-	if err := initConfig(); err != nil {
-		log.Fatal(err.Error())
+	// The defaults and command line flags, from which SIGHUP reloads the
+	// config file.
+	base := config
+	if err := loadConfig(); err != nil {
+		log.Error(err.Error())
+		os.Exit(exitConfig)
 	}
 
 	log.Info("Starting confd")
 
 	storeClient, err := backends.New(config.BackendsConfig)
 	if err != nil {
-		log.Fatal(err.Error())
+		log.Error(err.Error())
+		os.Exit(exitBackend)
+	}
+
+	if config.Explain != "" {
+		os.Exit(explain(os.Stdout, config, storeClient, config.Explain))
 	}
 
 	config.TemplateConfig.StoreClient = storeClient
 	if config.OneTime {
 		if err := template.Process(config.TemplateConfig); err != nil {
-			log.Fatal(err.Error())
+			log.Error(err.Error())
+			os.Exit(exitCode(err))
 		}
 		os.Exit(0)
 	}
@@ -52,17 +64,112 @@ func main() {
 
 	go processor.Process()
 
+	var controlServer *template.ControlServer
+	if config.ControlSocket != "" {
+		controlServer, err = template.NewControlServer(config.ControlSocket, processor.(template.Controller))
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		go controlServer.Serve()
+	}
+
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	for {
 		select {
 		case err := <-errChan:
 			log.Error(err.Error())
 		case s := <-signalChan:
+			if s == syscall.SIGHUP {
+				reload(processor, base)
+				continue
+			}
 			log.Info(fmt.Sprintf("Captured %v. Exiting...", s))
 			close(doneChan)
 		case <-doneChan:
+			if controlServer != nil {
+				controlServer.Close()
+			}
 			os.Exit(0)
 		}
 	}
 }
+
+// reload reloads the confd config file on top of base and makes processor
+// use the new settings, picking up added and removed template resources.
+// Template resources are only read again, losing their watches and state,
+// if the settings they are processed with changed; the store client
+// replaced by a changed backend config is closed once processor no longer
+// uses it. If the config cannot be reloaded, the previous settings are
+// kept.
+func reload(processor template.Processor, base Config) {
+	log.Info("Captured SIGHUP. Reloading " + config.ConfigFile)
+	previous := config
+	if err := reloadConfig(base); err != nil {
+		log.Error("Keeping the previous configuration - " + err.Error())
+		rescan(processor)
+		return
+	}
+	if config.Watch != previous.Watch {
+		log.Warning("Switching between watch and interval mode needs a restart")
+	}
+	r, ok := processor.(template.Reconfigurer)
+	if !ok || (reflect.DeepEqual(config.TemplateConfig, previous.TemplateConfig) && config.Interval == previous.Interval) {
+		rescan(processor)
+		return
+	}
+	r.Reconfigure(config.TemplateConfig, config.Interval)
+	if config.StoreClient != previous.StoreClient {
+		closeStoreClient(previous.StoreClient)
+	}
+}
+
+// closeStoreClient closes c if it holds connections to the backend.
+func closeStoreClient(c backends.StoreClient) {
+	closer, ok := c.(io.Closer)
+	if !ok {
+		return
+	}
+	log.Debug("Closing the previous backend client")
+	if err := closer.Close(); err != nil {
+		log.Warning("Cannot close the previous backend client - " + err.Error())
+	}
+}
+
+// reloadConfig initializes the confd configuration again, starting from
+// base, and connects to the backend it configures, keeping the previous
+// store client if the backend config is unchanged.
+// It returns an error, leaving the configuration unchanged, if the config
+// is invalid or the backend cannot be reached.
+func reloadConfig(base Config) error {
+	previous := config
+	config = base
+	if err := loadConfig(); err != nil {
+		config = previous
+		return err
+	}
+	if previous.StoreClient != nil && reflect.DeepEqual(config.BackendsConfig, previous.BackendsConfig) {
+		config.TemplateConfig.StoreClient = previous.StoreClient
+		return nil
+	}
+	storeClient, err := backends.New(config.BackendsConfig)
+	if err != nil {
+		config = previous
+		return err
+	}
+	config.TemplateConfig.StoreClient = storeClient
+	return nil
+}
+
+// rescan makes processor pick up added and removed template resources.
+func rescan(processor template.Processor) {
+	r, ok := processor.(template.Rescanner)
+	if !ok {
+		log.Info("Template resources are re-read every interval")
+		return
+	}
+	log.Info("Rescanning template resources")
+	if err := r.Rescan(); err != nil {
+		log.Error(err.Error())
+	}
+}
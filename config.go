@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -15,6 +17,7 @@ import (
 	"github.com/kelseyhightower/confd/backends"
 	"github.com/kelseyhightower/confd/log"
 	"github.com/kelseyhightower/confd/resource/template"
+	util "github.com/kelseyhightower/confd/util"
 )
 
 type TemplateConfig = template.Config
@@ -24,43 +27,116 @@ type BackendsConfig = backends.Config
 type Config struct {
 	TemplateConfig
 	BackendsConfig
-	Interval      int    `toml:"interval"`
-	SecretKeyring string `toml:"secret_keyring"`
-	SRVDomain     string `toml:"srv_domain"`
-	SRVRecord     string `toml:"srv_record"`
-	LogLevel      string `toml:"log-level"`
-	Watch         bool   `toml:"watch"`
-	PrintVersion  bool
-	ConfigFile    string
-	OneTime       bool
+	Interval       int                `toml:"interval"`
+	SecretKeyring  string             `toml:"secret_keyring"`
+	SRVDomain      string             `toml:"srv_domain"`
+	SRVRecord      string             `toml:"srv_record"`
+	SRVService     string             `toml:"srv_service"`
+	LogLevel       string             `toml:"log-level"`
+	Syslog         bool               `toml:"syslog"`
+	Watch          bool               `toml:"watch"`
+	ControlSocket  string             `toml:"control_socket"`
+	Profile        string             `toml:"profile"`
+	Profiles       map[string]Profile `toml:"profiles"`
+	PrintVersion   bool
+	ConfigFile     string
+	OneTime        bool `toml:"onetime"`
+	Explain        string
+	ExplainSecrets bool
+}
+
+// A Profile holds the backend settings of one environment, selected with
+// -profile or CONFD_PROFILE. Settings left empty keep their top level value.
+type Profile struct {
+	Backend      string     `toml:"backend"`
+	BackendNodes util.Nodes `toml:"nodes"`
+	Scheme       string     `toml:"scheme"`
+	Prefix       string     `toml:"prefix"`
+	AuthToken    string     `toml:"auth_token"`
+	AuthType     string     `toml:"auth_type"`
+	BasicAuth    bool       `toml:"basic_auth"`
+	Username     string     `toml:"username"`
+	Password     string     `toml:"password"`
+	ClientCaKeys string     `toml:"client_cakeys"`
+	ClientCert   string     `toml:"client_cert"`
+	ClientKey    string     `toml:"client_key"`
+	Datacenter   string     `toml:"datacenter"`
 }
 
 var config Config
 
 func init() {
-	flag.StringVar(&config.AuthToken, "auth-token", "", "Auth bearer token to use")
+	defineFlags()
+}
+
+// resetConfig restores config to the state it was in before flag.Parse and
+// initConfig ran, so that confd can be configured again from scratch, as
+// tests and programs embedding confd do between loads. It clears config,
+// every setting derived from it such as the backend nodes and the store
+// client, and flag.CommandLine, which it replaces with a new FlagSet on
+// which the confd flags are defined again with their defaults, forgetting
+// which of them were set on the command line. The log level and syslog
+// output set by initConfig are left alone.
+func resetConfig() {
+	config = Config{}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	defineFlags()
+}
+
+// defineFlags defines the confd flags on flag.CommandLine, storing their
+// values in config.
+func defineFlags() {
+	flag.BoolVar(&config.AllowDuplicateDest, "allow-duplicate-dest", false, "warn about template resources sharing a dest instead of refusing to start")
+	flag.StringVar(&config.AuthToken, "auth-token", "", "Auth bearer token to use, or the ACL token with -backend=consul")
 	flag.StringVar(&config.Backend, "backend", "etcd", "backend to use")
+	flag.IntVar(&config.Backoff, "backoff", 0, "retry a failing backend fetch this many times, waiting 0.5s then twice as long after every attempt, up to 10s (0 means no retries)")
+	flag.StringVar(&config.BackupFormat, "backup-format", "", "how to name the backups kept with -backups: numbered, dest.bak, dest.bak.1 and so on, or timestamp, dest.bak.<UTC time> (default \"numbered\")")
+	flag.StringVar(&config.BackupSuffix, "backup-suffix", "", "the suffix added to dest to name its backups (default \".bak\")")
+	flag.IntVar(&config.Backups, "backups", 0, "keep this many backups of the previous contents of every dest it overwrites (0 means no backups)")
 	flag.BoolVar(&config.BasicAuth, "basic-auth", false, "Use Basic Auth to authenticate (only used with -backend=consul and -backend=etcd)")
-	flag.StringVar(&config.ClientCaKeys, "client-ca-keys", "", "client ca keys")
-	flag.StringVar(&config.ClientCert, "client-cert", "", "the client cert")
-	flag.StringVar(&config.ClientKey, "client-key", "", "the client key")
+	flag.StringVar(&config.ClientCaKeys, "client-ca-keys", "", "the CA certificates verifying the backend servers")
+	flag.StringVar(&config.ClientCert, "client-cert", "", "the client cert, as a file path or as inline PEM data (only a file path with -backend=consul)")
+	flag.StringVar(&config.ClientKey, "client-key", "", "the client key, as a file path or as inline PEM data (only a file path with -backend=consul)")
+	flag.StringVar(&config.CompareMethod, "compare-method", "hash", "how to decide whether a config file changed: bytes, hash (md5 sums) or normalized (ignoring trailing whitespace)")
+	flag.IntVar(&config.Concurrency, "concurrency", 1, "process up to this many template resources at once")
 	flag.StringVar(&config.ConfDir, "confdir", "/etc/confd", "confd conf directory")
+	flag.StringVar(&config.ControlSocket, "control-socket", "", "path of a unix socket accepting sync, status and dump commands")
 	flag.StringVar(&config.ConfigFile, "config-file", "/etc/confd/confd.toml", "the confd config file")
+	flag.StringVar(&config.Datacenter, "datacenter", "", "the Consul datacenter to query (only used with -backend=consul, default: the datacenter of the agent)")
+	flag.StringVar(&config.Explain, "explain", "", "print the backend, value, modified index and TTL of this key and exit")
+	flag.BoolVar(&config.ExplainSecrets, "explain-show-secrets", false, "show the value printed by -explain even if it may be a secret")
+	flag.StringVar(&config.DefaultMode, "default-mode", "", "octal mode of dest files whose template resource sets no mode, such as 0640 (default: the mode of the existing dest, or 0666 less the umask)")
+	flag.BoolVar(&config.DryRun, "dry-run", false, "render templates and run check_cmd without modifying dest or running reload_cmd")
 	flag.Var(&config.YAMLFile, "file", "the YAML file to watch for changes (only used with -backend=file)")
+	flag.StringVar(&config.FileArrays, "file-arrays", "", "how to flatten arrays: index, a key per element, or json, a single key holding the array as JSON (only used with -backend=file) (default \"index\")")
+	flag.IntVar(&config.FirstRunTimeout, "first-run-timeout", 0, "seconds to wait for the required_keys of every template resource to appear (only used with -onetime)")
+	flag.Var(&negatedBool{&config.NoFollowSymlinks}, "follow-symlinks", "when dest is a symlink, write to the file it points to instead of failing")
 	flag.StringVar(&config.Filter, "filter", "*", "files filter (only used with -backend=file)")
 	flag.IntVar(&config.Interval, "interval", 600, "backend polling interval")
 	flag.BoolVar(&config.KeepStageFile, "keep-stage-file", false, "keep staged files")
-	flag.StringVar(&config.LogLevel, "log-level", "", "level which confd should log messages")
+	flag.BoolVar(&config.LockDest, "lock-dest", false, "hold an advisory lock on <dest>.lock while updating dest and running reload_cmd (not supported on Windows)")
+	flag.StringVar(&config.LogLevel, "log-level", "", "level which confd should log messages: debug, info, warning or error (default \"info\")")
+	flag.IntVar(&config.MaxConcurrentReloads, "max-concurrent-reloads", 0, "maximum number of check_cmd and reload_cmd commands running at once (0 means no limit)")
+	flag.IntVar(&config.MaxConsecutiveFailures, "max-consecutive-failures", 0, "exit after this many consecutive failed processing cycles (0 means never exit)")
+	flag.IntVar(&config.MaxDepth, "max-depth", 0, "only read keys up to this many levels below the prefix (0 means no limit)")
+	flag.Float64Var(&config.MaxRequestsPerSecond, "max-requests-per-second", 0, "maximum rate of backend requests, every key fetched counting as one (0 means no limit)")
 	flag.Var(&config.BackendNodes, "node", "list of backend nodes")
 	flag.BoolVar(&config.Noop, "noop", false, "only show pending changes")
 	flag.BoolVar(&config.OneTime, "onetime", false, "run once and exit")
 	flag.StringVar(&config.Prefix, "prefix", "", "key path prefix")
+	flag.StringVar(&config.Profile, "profile", "", "the profile of the confd config file to use (default $CONFD_PROFILE)")
 	flag.BoolVar(&config.PrintVersion, "version", false, "print version and exit")
 	flag.StringVar(&config.Scheme, "scheme", "http", "the backend URI scheme for nodes retrieved from DNS SRV records (http or https)")
+	flag.BoolVar(&config.ReloadPerResource, "reload-per-resource", false, "run the reload_cmd of every updated template resource right after it, even if several share it, instead of once per cycle after all of them")
 	flag.StringVar(&config.SecretKeyring, "secret-keyring", "", "path to armored PGP secret keyring (for use with crypt functions)")
+	flag.StringVar(&config.ShadowRoot, "shadow-root", "", "write every dest file under this directory, preserving its path, and never run reload_cmd")
+	flag.BoolVar(&config.SkipOnEmpty, "skip-on-empty", false, "leave the dest of template resources untouched when the backend returns no keys for them")
 	flag.StringVar(&config.SRVDomain, "srv-domain", "", "the name of the resource record")
 	flag.StringVar(&config.SRVRecord, "srv-record", "", "the SRV record to search for backends nodes. Example: _etcd-client._tcp.example.com")
+	flag.StringVar(&config.SRVService, "srv-service", "", "the service of the SRV record looked up in -srv-domain, as in _<service>._tcp.<domain> (defaults to the backend name)")
 	flag.BoolVar(&config.SyncOnly, "sync-only", false, "sync without check_cmd and reload_cmd")
+	flag.BoolVar(&config.Syslog, "syslog", false, "log to the local syslog daemon, with the daemon facility and the confd tag, instead of standard error")
+	flag.IntVar(&config.TemplateErrorContext, "template-error-context", 3, "the number of template lines shown before and after the line a template error points at")
 	flag.StringVar(&config.AuthType, "auth-type", "", "Vault auth backend type to use (only used with -backend=vault)")
 	flag.StringVar(&config.AppID, "app-id", "", "Vault app-id to use with the app-id backend (only used with -backend=vault and auth-type=app-id)")
 	flag.StringVar(&config.UserID, "user-id", "", "Vault user-id to use with the app-id backend (only used with -backend=value and auth-type=app-id)")
@@ -68,18 +144,48 @@ func init() {
 	flag.StringVar(&config.SecretID, "secret-id", "", "Vault secret-id to use with the AppRole backend (only used with -backend=vault and auth-type=app-role)")
 	flag.StringVar(&config.Path, "path", "", "Vault mount path of the auth method (only used with -backend=vault)")
 	flag.StringVar(&config.Table, "table", "", "the name of the DynamoDB table (only used with -backend=dynamodb)")
-	flag.StringVar(&config.Separator, "separator", "", "the separator to replace '/' with when looking up keys in the backend, prefixed '/' will also be removed (only used with -backend=redis)")
+	flag.StringVar(&config.Separator, "separator", "", "the separator to replace '/' with when looking up keys in the backend, prefixed '/' will also be removed (only used with -backend=redis), or to join nested keys with (only used with -backend=file)")
+	flag.IntVar(&config.Timeout, "timeout", 30, "fail etcd requests, other than watches, taking longer than this many seconds (0 means no timeout)")
+	flag.BoolVar(&config.Trace, "trace", false, "log every backend request with its status, key count and duration (implies -log-level=debug)")
+	flag.StringVar(&config.Umask, "umask", "", "octal umask applied to the mode of new dest files without an explicit mode, such as 027 (default 022)")
+	flag.StringVar(&config.UserAgent, "user-agent", "", "the User-Agent header sent with backend requests (default \"confd/<version>\")")
 	flag.StringVar(&config.Username, "username", "", "the username to authenticate as (only used with vault and etcd backends)")
 	flag.StringVar(&config.Password, "password", "", "the password to authenticate with (only used with vault and etcd backends)")
 	flag.BoolVar(&config.Watch, "watch", false, "enable watch support")
 }
 
+// negatedBool is a boolean flag.Value setting the bool it points to to the
+// opposite of its value, for flags enabling what a setting disables, so
+// that the zero value of the setting is the default of the flag.
+type negatedBool struct {
+	b *bool
+}
+
+func (n *negatedBool) String() string {
+	if n.b == nil {
+		return "false"
+	}
+	return strconv.FormatBool(!*n.b)
+}
+
+func (n *negatedBool) Set(s string) error {
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*n.b = !v
+	return nil
+}
+
+func (n *negatedBool) IsBoolFlag() bool { return true }
+
 // initConfig initializes the confd configuration by first setting defaults,
-// then overriding settings from the confd config file, then overriding
-// settings from environment variables, and finally overriding
-// settings from flags set on the command line.
+// then overriding settings from the confd config file and its active
+// profile, then overriding settings from environment variables, and finally
+// overriding settings from flags set on the command line.
 // It returns an error if any.
 func initConfig() error {
+	flags := commandLineFlags()
 	_, err := os.Stat(config.ConfigFile)
 	if os.IsNotExist(err) {
 		log.Debug("Skipping confd config file.")
@@ -96,27 +202,90 @@ func initConfig() error {
 		}
 	}
 
+	// The profile is selected by -profile, then CONFD_PROFILE, then the
+	// profile setting of the config file.
+	if restore, ok := flags["profile"]; ok {
+		restore()
+	} else if profile := os.Getenv("CONFD_PROFILE"); profile != "" {
+		config.Profile = profile
+	}
+	if err := applyProfile(); err != nil {
+		return err
+	}
+
 	// Update config from environment variables.
-	processEnv()
+	if err := processEnv(); err != nil {
+		return err
+	}
+
+	for _, restore := range flags {
+		restore()
+	}
 
 	if config.SecretKeyring != "" {
 		kr, err := os.Open(config.SecretKeyring)
 		if err != nil {
-			log.Fatal(err.Error())
+			return err
 		}
 		defer kr.Close()
 		config.PGPPrivateKey, err = ioutil.ReadAll(kr)
 		if err != nil {
-			log.Fatal(err.Error())
+			return err
 		}
 	}
 
 	if config.LogLevel != "" {
-		log.SetLevel(config.LogLevel)
+		if err := log.SetLevel(config.LogLevel); err != nil {
+			return err
+		}
+	}
+	log.SetTrace(config.Trace)
+	if config.Syslog {
+		if err := log.SetSyslog(); err != nil {
+			return fmt.Errorf("Cannot log to syslog - %s", err.Error())
+		}
+	}
+
+	if config.BasicAuth && (config.Username == "" || config.Password == "") {
+		return errors.New("Basic auth needs both -username and -password")
+	}
+
+	if config.ClientCaKeys != "" && (config.Backend == "etcd" || config.Backend == "etcdv3") {
+		if _, err := util.LoadCertPool(config.ClientCaKeys); err != nil {
+			return err
+		}
+	}
+
+	if _, err := util.ParseUmask(config.Umask); err != nil {
+		return err
+	}
+	if config.Timeout < 0 {
+		return fmt.Errorf("Invalid timeout %d, it cannot be negative", config.Timeout)
+	}
+	if config.DefaultMode != "" {
+		if _, err := util.ParseMode(config.DefaultMode); err != nil {
+			return fmt.Errorf("Cannot use -default-mode - %s", err.Error())
+		}
+	}
+
+	if !util.IsValidCompareMethod(config.CompareMethod) {
+		return fmt.Errorf("Invalid compare method %q, valid methods are bytes, hash and normalized", config.CompareMethod)
+	}
+
+	if config.Prefix != "" {
+		config.Prefix = util.NormalizePrefix(config.Prefix)
+	}
+
+	if config.UserAgent == "" {
+		config.UserAgent = "confd/" + Version
 	}
 
 	if config.SRVDomain != "" && config.SRVRecord == "" {
-		config.SRVRecord = fmt.Sprintf("_%s._tcp.%s.", config.Backend, config.SRVDomain)
+		service := config.SRVService
+		if service == "" {
+			service = config.Backend
+		}
+		config.SRVRecord = fmt.Sprintf("_%s._tcp.%s.", service, config.SRVDomain)
 	}
 
 	// Update BackendNodes from SRV records.
@@ -124,18 +293,8 @@ func initConfig() error {
 		log.Info("SRV record set to " + config.SRVRecord)
 		srvNodes, err := getBackendNodesFromSRV(config.SRVRecord)
 		if err != nil {
-			return errors.New("Cannot get nodes from SRV records " + err.Error())
+			return errors.New("Cannot get nodes from SRV records - " + err.Error())
 		}
-
-		switch config.Backend {
-		case "etcd":
-			vsm := make([]string, len(srvNodes))
-			for i, v := range srvNodes {
-				vsm[i] = config.Scheme + "://" + v
-			}
-			srvNodes = vsm
-		}
-
 		config.BackendNodes = srvNodes
 	}
 	if len(config.BackendNodes) == 0 {
@@ -159,6 +318,16 @@ func initConfig() error {
 			config.BackendNodes = []string{"127.0.0.1:2181"}
 		}
 	}
+	if config.Backend == "etcd" {
+		config.BackendNodes = append([]string(nil), config.BackendNodes...)
+		for i, node := range config.BackendNodes {
+			u, err := etcdNodeURL(node, config.Scheme)
+			if err != nil {
+				return err
+			}
+			config.BackendNodes[i] = u
+		}
+	}
 	// Initialize the storage client
 	log.Info("Backend set to " + config.Backend)
 
@@ -169,8 +338,7 @@ func initConfig() error {
 		}
 
 		if unsupportedBackends[config.Backend] {
-			log.Info(fmt.Sprintf("Watch is not supported for backend %s. Exiting...", config.Backend))
-			os.Exit(1)
+			return fmt.Errorf("Watch is not supported for backend %s - run it with -interval instead", config.Backend)
 		}
 	}
 
@@ -182,35 +350,203 @@ func initConfig() error {
 	return nil
 }
 
-func getBackendNodesFromSRV(record string) ([]string, error) {
-	nodes := make([]string, 0)
+// loadConfig initializes the confd configuration and checks that the
+// directories of the template resources and templates it points to exist.
+// It returns an error if any.
+func loadConfig() error {
+	if err := initConfig(); err != nil {
+		return err
+	}
+	return validateConfDirs()
+}
+
+// validateConfDirs checks that the conf.d and templates directories of the
+// confdir exist, so that a mistyped -confdir or a missing mount fails at
+// startup rather than leaving confd with nothing to process.
+// It returns an error naming the first missing directory, if any.
+func validateConfDirs() error {
+	for _, dir := range []string{config.ConfigDir, config.TemplateDir} {
+		fi, err := os.Stat(dir)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("Cannot find directory %s - check -confdir (currently %s)", dir, config.ConfDir)
+		}
+		if err != nil {
+			return fmt.Errorf("Cannot read directory %s - %s", dir, err.Error())
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("Cannot use %s - not a directory", dir)
+		}
+	}
+	return nil
+}
 
+// commandLineFlags returns, for every flag set on the command line, a
+// function setting it again, so that flags take precedence over the config
+// file.
+func commandLineFlags() map[string]func() {
+	flags := make(map[string]func())
+	flag.Visit(func(f *flag.Flag) {
+		if nodes, ok := f.Value.(*util.Nodes); ok {
+			saved := append(util.Nodes(nil), *nodes...)
+			flags[f.Name] = func() { *nodes = append(util.Nodes(nil), saved...) }
+			return
+		}
+		value := f.Value.String()
+		flags[f.Name] = func() { f.Value.Set(value) }
+	})
+	return flags
+}
+
+// applyProfile overrides the backend settings with the non-empty settings
+// of the active profile, if any.
+// It returns an error if the profile is not defined.
+func applyProfile() error {
+	if config.Profile == "" {
+		return nil
+	}
+	p, ok := config.Profiles[config.Profile]
+	if !ok {
+		return fmt.Errorf("Unknown profile %q in %s", config.Profile, config.ConfigFile)
+	}
+	log.Info("Using profile " + config.Profile)
+	for _, s := range []struct {
+		dst *string
+		src string
+	}{
+		{&config.Backend, p.Backend},
+		{&config.Scheme, p.Scheme},
+		{&config.Prefix, p.Prefix},
+		{&config.AuthToken, p.AuthToken},
+		{&config.AuthType, p.AuthType},
+		{&config.Username, p.Username},
+		{&config.Password, p.Password},
+		{&config.ClientCaKeys, p.ClientCaKeys},
+		{&config.ClientCert, p.ClientCert},
+		{&config.ClientKey, p.ClientKey},
+		{&config.Datacenter, p.Datacenter},
+	} {
+		if s.src != "" {
+			*s.dst = s.src
+		}
+	}
+	if len(p.BackendNodes) > 0 {
+		config.BackendNodes = p.BackendNodes
+	}
+	if p.BasicAuth {
+		config.BasicAuth = true
+	}
+	return nil
+}
+
+func getBackendNodesFromSRV(record string) ([]string, error) {
 	// Ignore the CNAME as we don't need it.
 	_, addrs, err := net.LookupSRV("", "", record)
 	if err != nil {
-		return nodes, err
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no SRV records found for %s", record)
 	}
-	for _, srv := range addrs {
+	return srvNodes(addrs), nil
+}
+
+// srvNodes returns the host:port of every SRV record in addrs, ordered by
+// priority, lowest first, then by weight, highest first, so that the
+// primary node is tried first.
+func srvNodes(addrs []*net.SRV) []string {
+	sorted := append([]*net.SRV(nil), addrs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Priority != sorted[j].Priority {
+			return sorted[i].Priority < sorted[j].Priority
+		}
+		return sorted[i].Weight > sorted[j].Weight
+	})
+	nodes := make([]string, 0, len(sorted))
+	for _, srv := range sorted {
 		host := strings.TrimRight(srv.Target, ".")
 		port := strconv.FormatUint(uint64(srv.Port), 10)
 		nodes = append(nodes, net.JoinHostPort(host, port))
 	}
-	return nodes, nil
+	return nodes
 }
 
-func processEnv() {
-	cakeys := os.Getenv("CONFD_CLIENT_CAKEYS")
-	if len(cakeys) > 0 && config.ClientCaKeys == "" {
-		config.ClientCaKeys = cakeys
+// etcdNodeURL returns node, an etcd node URL or a bare host or host:port,
+// such as the nodes found in SRV records, as a URL with scheme. IPv6 hosts
+// must be in brackets, as in [2001:db8::1]:4001, since the colons of a
+// bare IPv6 address cannot be told from the port separator.
+// It returns an error if node is not a valid host or URL.
+func etcdNodeURL(node, scheme string) (string, error) {
+	if i := strings.Index(node, "://"); i != -1 {
+		u, err := url.Parse(node)
+		if err != nil || (strings.Count(u.Host, ":") > 1 && !strings.HasPrefix(u.Host, "[")) {
+			if strings.Count(node[i+3:], ":") > 1 {
+				return "", fmt.Errorf("Invalid etcd node %s - IPv6 addresses must be in brackets, as in %s://[2001:db8::1]:4001", node, node[:i])
+			}
+			return "", fmt.Errorf("Invalid etcd node %s - %s", node, err.Error())
+		}
+		return node, nil
+	}
+	if !strings.Contains(node, ":") {
+		return scheme + "://" + node, nil
 	}
+	host, port, err := net.SplitHostPort(node)
+	if err != nil {
+		if strings.Count(node, ":") > 1 {
+			return "", fmt.Errorf("Invalid etcd node %s - IPv6 addresses must be in brackets, as in [2001:db8::1]:4001", node)
+		}
+		return "", fmt.Errorf("Invalid etcd node %s - %s", node, err.Error())
+	}
+	return scheme + "://" + net.JoinHostPort(host, port), nil
+}
 
-	cert := os.Getenv("CONFD_CLIENT_CERT")
-	if len(cert) > 0 && config.ClientCert == "" {
-		config.ClientCert = cert
+// envName returns the name of the environment variable setting the flag
+// name, such as CONFD_LOG_LEVEL for -log-level.
+func envName(name string) string {
+	return "CONFD_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// processEnv overrides the settings of every flag set in the environment,
+// by the variable named after the flag by envName. Node lists, as set by
+// -node and -file, are comma separated. -config-file and -profile, which
+// decide how the config file is read, and the -explain and -version
+// commands are not set this way; CONFD_PROFILE is read before the profile
+// is applied.
+// It returns an error if a variable is not a valid value of its flag.
+func processEnv() error {
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		switch f.Name {
+		case "config-file", "profile", "explain", "version":
+			return
+		}
+		if err != nil {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if nodes, isNodes := f.Value.(*util.Nodes); isNodes {
+			*nodes = nil
+			for _, node := range strings.Split(value, ",") {
+				if node = strings.TrimSpace(node); node != "" {
+					nodes.Set(node)
+				}
+			}
+			return
+		}
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("Invalid %s %q - %s", envName(f.Name), value, setErr.Error())
+		}
+	})
+	if err != nil {
+		return err
 	}
 
-	key := os.Getenv("CONFD_CLIENT_KEY")
-	if len(key) > 0 && config.ClientKey == "" {
-		config.ClientKey = key
+	// CONFD_CLIENT_CAKEYS predates the variables named after the flags.
+	cakeys := os.Getenv("CONFD_CLIENT_CAKEYS")
+	if len(cakeys) > 0 && config.ClientCaKeys == "" {
+		config.ClientCaKeys = cakeys
 	}
+	return nil
 }
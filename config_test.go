@@ -1,10 +1,19 @@
 package main
 
 import (
+	"flag"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/kelseyhightower/confd/backends"
+	"github.com/kelseyhightower/confd/backends/env"
 	"github.com/kelseyhightower/confd/log"
+	"github.com/kelseyhightower/confd/resource/template"
 )
 
 func TestInitConfigDefaultConfig(t *testing.T) {
@@ -15,12 +24,17 @@ func TestInitConfigDefaultConfig(t *testing.T) {
 			BackendNodes: []string{"http://127.0.0.1:4001"},
 			Scheme:       "http",
 			Filter:       "*",
+			Timeout:      30,
+			UserAgent:    "confd/" + Version,
 		},
 		TemplateConfig: TemplateConfig{
-			ConfDir:     "/etc/confd",
-			ConfigDir:   "/etc/confd/conf.d",
-			TemplateDir: "/etc/confd/templates",
-			Noop:        false,
+			CompareMethod:        "hash",
+			Concurrency:          1,
+			ConfDir:              "/etc/confd",
+			ConfigDir:            "/etc/confd/conf.d",
+			TemplateDir:          "/etc/confd/templates",
+			TemplateErrorContext: 3,
+			Noop:                 false,
 		},
 		ConfigFile: "/etc/confd/confd.toml",
 		Interval:   600,
@@ -32,3 +46,604 @@ func TestInitConfigDefaultConfig(t *testing.T) {
 		t.Errorf("initConfig() = %v, want %v", config, want)
 	}
 }
+
+func TestInitConfigProfiles(t *testing.T) {
+	log.SetLevel("warn")
+	defer func(c Config) { config = c }(config)
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "confd.toml")
+	configToml := `
+backend = "etcd"
+scheme = "http"
+prefix = "/dev"
+profile = "stage"
+
+[profiles.stage]
+nodes = ["http://stage:2379"]
+prefix = "/stage"
+
+[profiles.prod]
+nodes = ["https://prod-1:2379", "https://prod-2:2379"]
+scheme = "https"
+prefix = "/prod"
+username = "admin"
+password = "secret"
+basic_auth = true
+`
+	if err := ioutil.WriteFile(configFile, []byte(configToml), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tests := []struct {
+		desc    string
+		env     string
+		flags   map[string]string
+		nodes   []string
+		scheme  string
+		prefix  string
+		profile string
+	}{
+		{"config file profile", "", nil, []string{"http://stage:2379"}, "http", "/stage", "stage"},
+		{"CONFD_PROFILE", "prod", nil, []string{"https://prod-1:2379", "https://prod-2:2379"}, "https", "/prod", "prod"},
+		{"-profile flag", "stage", map[string]string{"profile": "prod"}, []string{"https://prod-1:2379", "https://prod-2:2379"}, "https", "/prod", "prod"},
+		{"flags override profile", "prod", map[string]string{"prefix": "/override", "node": "http://override:2379"}, []string{"http://override:2379"}, "https", "/override", "prod"},
+	}
+	defer func(fs *flag.FlagSet) { flag.CommandLine = fs }(flag.CommandLine)
+	for _, tt := range tests {
+		config = Config{ConfigFile: configFile}
+		config.CompareMethod = "hash"
+		os.Setenv("CONFD_PROFILE", tt.env)
+		flag.CommandLine = flag.NewFlagSet("confd", flag.ContinueOnError)
+		flag.Var(&config.BackendNodes, "node", "")
+		flag.StringVar(&config.Prefix, "prefix", "", "")
+		flag.StringVar(&config.Profile, "profile", "", "")
+		for name, value := range tt.flags {
+			if err := flag.Set(name, value); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		err := initConfig()
+		if err != nil {
+			t.Errorf("%s: initConfig() returned %s", tt.desc, err.Error())
+			continue
+		}
+		if config.Profile != tt.profile {
+			t.Errorf("%s: profile = %q, want %q", tt.desc, config.Profile, tt.profile)
+		}
+		if !reflect.DeepEqual([]string(config.BackendNodes), tt.nodes) {
+			t.Errorf("%s: nodes = %v, want %v", tt.desc, config.BackendNodes, tt.nodes)
+		}
+		if config.Scheme != tt.scheme {
+			t.Errorf("%s: scheme = %q, want %q", tt.desc, config.Scheme, tt.scheme)
+		}
+		if config.Prefix != tt.prefix {
+			t.Errorf("%s: prefix = %q, want %q", tt.desc, config.Prefix, tt.prefix)
+		}
+	}
+	os.Unsetenv("CONFD_PROFILE")
+}
+
+func TestInitConfigOneTime(t *testing.T) {
+	log.SetLevel("warn")
+	defer func(c Config) { config = c }(config)
+	defer func(fs *flag.FlagSet) { flag.CommandLine = fs }(flag.CommandLine)
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "confd.toml")
+	if err := ioutil.WriteFile(configFile, []byte("onetime = true\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, flags := range []map[string]string{nil, {"onetime": "false"}} {
+		config = Config{ConfigFile: configFile}
+		config.CompareMethod = "hash"
+		flag.CommandLine = flag.NewFlagSet("confd", flag.ContinueOnError)
+		flag.BoolVar(&config.OneTime, "onetime", false, "")
+		for name, value := range flags {
+			if err := flag.Set(name, value); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		if err := initConfig(); err != nil {
+			t.Fatal(err.Error())
+		}
+		if want := flags == nil; config.OneTime != want {
+			t.Errorf("flags %v: OneTime = %t, want %t", flags, config.OneTime, want)
+		}
+	}
+}
+
+func TestInitConfigInvalidLogLevel(t *testing.T) {
+	log.SetLevel("warn")
+	defer log.SetLevel("warn")
+	defer func(c Config) { config = c }(config)
+	defer func(fs *flag.FlagSet) { flag.CommandLine = fs }(flag.CommandLine)
+
+	for _, tt := range []struct {
+		level string
+		valid bool
+	}{
+		{"debug", true},
+		{"warning", true},
+		{"error", true},
+		{"verbose", false},
+	} {
+		config = Config{ConfigFile: "/nonexistent/confd.toml"}
+		config.CompareMethod = "hash"
+		flag.CommandLine = flag.NewFlagSet("confd", flag.ContinueOnError)
+		flag.StringVar(&config.LogLevel, "log-level", "", "")
+		if err := flag.Set("log-level", tt.level); err != nil {
+			t.Fatal(err.Error())
+		}
+		err := initConfig()
+		if tt.valid && err != nil {
+			t.Errorf("-log-level %s: initConfig() returned %s", tt.level, err.Error())
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("-log-level %s: initConfig() returned no error", tt.level)
+		}
+	}
+}
+
+func TestInitConfigBasicAuthNeedsCredentials(t *testing.T) {
+	log.SetLevel("warn")
+	defer func(c Config) { config = c }(config)
+	defer func(fs *flag.FlagSet) { flag.CommandLine = fs }(flag.CommandLine)
+
+	for _, tt := range []struct {
+		username, password string
+		valid              bool
+	}{
+		{"admin", "secret", true},
+		{"admin", "", false},
+		{"", "secret", false},
+		{"", "", false},
+	} {
+		config = Config{ConfigFile: "/nonexistent/confd.toml"}
+		config.CompareMethod = "hash"
+		config.BasicAuth = true
+		config.Username, config.Password = tt.username, tt.password
+		flag.CommandLine = flag.NewFlagSet("confd", flag.ContinueOnError)
+		err := initConfig()
+		if tt.valid && err != nil {
+			t.Errorf("username %q, password %q: initConfig() returned %s", tt.username, tt.password, err.Error())
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("username %q, password %q: initConfig() returned no error", tt.username, tt.password)
+		}
+	}
+}
+
+func TestEtcdNodeURL(t *testing.T) {
+	tests := []struct {
+		node, want string
+		valid      bool
+	}{
+		{"127.0.0.1:4001", "http://127.0.0.1:4001", true},
+		{"http://127.0.0.1:4001", "http://127.0.0.1:4001", true},
+		{"etcd.example.com:2379", "http://etcd.example.com:2379", true},
+		{"etcd.example.com", "http://etcd.example.com", true},
+		{"[2001:db8::1]:4001", "http://[2001:db8::1]:4001", true},
+		{"https://[2001:db8::1]:4001", "https://[2001:db8::1]:4001", true},
+		// An IPv6 SRV target, joined to its port by getBackendNodesFromSRV.
+		{net.JoinHostPort("2001:db8::2", "2379"), "http://[2001:db8::2]:2379", true},
+		{"unix:///var/run/etcd.sock", "unix:///var/run/etcd.sock", true},
+		{"2001:db8::1", "", false},
+		{"2001:db8::1:4001", "", false},
+		{"http://2001:db8::1:4001", "", false},
+	}
+	for _, tt := range tests {
+		got, err := etcdNodeURL(tt.node, "http")
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("etcdNodeURL(%q) = %q, want an error", tt.node, got)
+			} else if strings.Count(tt.node, ":") > 2 && !strings.Contains(err.Error(), "brackets") {
+				t.Errorf("etcdNodeURL(%q) error %q does not explain the brackets", tt.node, err.Error())
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("etcdNodeURL(%q) = %q, %v, want %q", tt.node, got, err, tt.want)
+		}
+	}
+}
+
+func TestInitConfigEnv(t *testing.T) {
+	log.SetLevel("warn")
+	defer func(c Config) { config = c }(config)
+	defer func(fs *flag.FlagSet) { flag.CommandLine = fs }(flag.CommandLine)
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "confd.toml")
+	if err := ioutil.WriteFile(configFile, []byte("interval = 60\nprefix = \"/toml\"\nnoop = false\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	env := map[string]string{
+		"CONFD_INTERVAL": "30",
+		"CONFD_PREFIX":   "/env",
+		"CONFD_NOOP":     "true",
+		"CONFD_NODE":     "http://etcd1:2379, http://etcd2:2379",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	newFlags := func() {
+		config = Config{ConfigFile: configFile}
+		config.CompareMethod = "hash"
+		flag.CommandLine = flag.NewFlagSet("confd", flag.ContinueOnError)
+		flag.IntVar(&config.Interval, "interval", 600, "")
+		flag.StringVar(&config.Prefix, "prefix", "", "")
+		flag.BoolVar(&config.Noop, "noop", false, "")
+		flag.Var(&config.BackendNodes, "node", "")
+	}
+
+	newFlags()
+	if err := flag.Set("prefix", "/flag"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := initConfig(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if config.Interval != 30 || !config.Noop {
+		t.Errorf("interval, noop = %d, %t, want the environment to override the config file", config.Interval, config.Noop)
+	}
+	if config.Prefix != "/flag" {
+		t.Errorf("prefix = %q, want the flag to override the environment", config.Prefix)
+	}
+	if want := []string{"http://etcd1:2379", "http://etcd2:2379"}; !reflect.DeepEqual([]string(config.BackendNodes), want) {
+		t.Errorf("nodes = %v, want %v", config.BackendNodes, want)
+	}
+
+	for name, value := range map[string]string{"CONFD_INTERVAL": "soon", "CONFD_NOOP": "maybe"} {
+		os.Setenv(name, value)
+		newFlags()
+		if err := initConfig(); err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("%s=%s: initConfig() returned %v, want an error naming %s", name, value, err, name)
+		}
+		os.Setenv(name, env[name])
+	}
+}
+
+func TestReloadConfigKeepsPreviousOnError(t *testing.T) {
+	log.SetLevel("warn")
+	defer log.SetLevel("warn")
+	defer func(c Config) { config = c }(config)
+	defer func(fs *flag.FlagSet) { flag.CommandLine = fs }(flag.CommandLine)
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "confd.toml")
+	writeConfig := func(configToml string) {
+		if err := ioutil.WriteFile(configFile, []byte(configToml), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	for _, sub := range []string{"conf.d", "templates"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	flag.CommandLine = flag.NewFlagSet("confd", flag.ContinueOnError)
+	base := Config{ConfigFile: configFile, Interval: 600}
+	base.ConfDir = dir
+	base.Backend = "env"
+	base.CompareMethod = "hash"
+	config = base
+
+	writeConfig("interval = 60\nprefix = \"/dev\"\n")
+	if err := reloadConfig(base); err != nil {
+		t.Fatal(err.Error())
+	}
+	if config.Interval != 60 || config.Prefix != "/dev" || config.StoreClient == nil {
+		t.Errorf("reloadConfig() = interval %d, prefix %q, store client %v, want 60, /dev and a client", config.Interval, config.Prefix, config.StoreClient)
+	}
+
+	writeConfig("interval = 30\nlog-level = \"verbose\"\n")
+	want := config
+	if err := reloadConfig(base); err == nil {
+		t.Errorf("reloadConfig() returned no error for an invalid log level")
+	}
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("config = %v after a failed reload, want the previous %v", config, want)
+	}
+
+	writeConfig("prefix = \"/prod\"\n")
+	if err := reloadConfig(base); err != nil {
+		t.Fatal(err.Error())
+	}
+	if config.Interval != 600 || config.Prefix != "/prod" {
+		t.Errorf("reloadConfig() = interval %d, prefix %q, want the default 600 and /prod", config.Interval, config.Prefix)
+	}
+}
+
+func TestLoadConfigChecksConfDirs(t *testing.T) {
+	log.SetLevel("warn")
+	defer func(c Config) { config = c }(config)
+	defer func(fs *flag.FlagSet) { flag.CommandLine = fs }(flag.CommandLine)
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	load := func() error {
+		config = Config{ConfigFile: "/nonexistent/confd.toml"}
+		config.CompareMethod = "hash"
+		config.ConfDir = dir
+		config.OneTime = true
+		config.Noop = true
+		flag.CommandLine = flag.NewFlagSet("confd", flag.ContinueOnError)
+		return loadConfig()
+	}
+	confD := filepath.Join(dir, "conf.d")
+	if err := os.Mkdir(confD, 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	templates := filepath.Join(dir, "templates")
+	if err := load(); err == nil || !strings.Contains(err.Error(), templates) {
+		t.Errorf("loadConfig() = %v, want an error naming %s", err, templates)
+	}
+	if err := ioutil.WriteFile(templates, nil, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := load(); err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Errorf("loadConfig() = %v, want an error saying %s is not a directory", err, templates)
+	}
+	if err := os.Remove(templates); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.Mkdir(templates, 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := load(); err != nil {
+		t.Errorf("loadConfig() = %s with both directories present", err.Error())
+	}
+	if err := os.Remove(confD); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := load(); err == nil || !strings.Contains(err.Error(), confD) {
+		t.Errorf("loadConfig() = %v, want an error naming %s", err, confD)
+	}
+}
+
+func TestSRVNodesOrder(t *testing.T) {
+	addrs := []*net.SRV{
+		{Target: "backup.example.com.", Port: 4001, Priority: 20, Weight: 100},
+		{Target: "light.example.com.", Port: 4001, Priority: 10, Weight: 10},
+		{Target: "heavy.example.com.", Port: 4001, Priority: 10, Weight: 90},
+	}
+	want := []string{"heavy.example.com:4001", "light.example.com:4001", "backup.example.com:4001"}
+	if got := srvNodes(addrs); !reflect.DeepEqual(got, want) {
+		t.Errorf("srvNodes() = %v, want %v", got, want)
+	}
+}
+
+func TestInitConfigSRVService(t *testing.T) {
+	log.SetLevel("warn")
+	defer func(c Config) { config = c }(config)
+	defer func(fs *flag.FlagSet) { flag.CommandLine = fs }(flag.CommandLine)
+
+	for _, tt := range []struct {
+		service, want string
+	}{
+		{"", "_etcd._tcp.invalid."},
+		{"etcd-client", "_etcd-client._tcp.invalid."},
+	} {
+		config = Config{ConfigFile: "/nonexistent/confd.toml"}
+		config.CompareMethod = "hash"
+		config.Backend = "etcd"
+		config.SRVDomain = "invalid"
+		config.SRVService = tt.service
+		flag.CommandLine = flag.NewFlagSet("confd", flag.ContinueOnError)
+		err := initConfig()
+		if err == nil {
+			t.Fatalf("srv_service %q: initConfig() returned no error for an unresolvable domain", tt.service)
+		}
+		if !strings.Contains(err.Error(), "Cannot get nodes from SRV records") || config.SRVRecord != tt.want {
+			t.Errorf("srv_service %q: initConfig() = %s with record %s, want an SRV error for %s", tt.service, err.Error(), config.SRVRecord, tt.want)
+		}
+	}
+}
+
+func TestInitConfigNegativeTimeout(t *testing.T) {
+	log.SetLevel("warn")
+	defer func(c Config) { config = c }(config)
+	defer func(fs *flag.FlagSet) { flag.CommandLine = fs }(flag.CommandLine)
+
+	config = Config{ConfigFile: "/nonexistent/confd.toml"}
+	config.CompareMethod = "hash"
+	config.Timeout = -1
+	flag.CommandLine = flag.NewFlagSet("confd", flag.ContinueOnError)
+	if err := initConfig(); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("initConfig() = %v with a negative timeout, want an invalid timeout error", err)
+	}
+}
+
+func TestResetConfig(t *testing.T) {
+	log.SetLevel("warn")
+	defer log.SetLevel("warn")
+	defer func(c Config) { config = c }(config)
+	defer func(fs *flag.FlagSet) { flag.CommandLine = fs }(flag.CommandLine)
+
+	resetConfig()
+	config.ConfigFile = "/nonexistent/confd.toml"
+	if err := flag.Set("backend", "redis"); err != nil {
+		t.Fatal(err.Error())
+	}
+	err := initConfig()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if want := []string{"127.0.0.1:6379"}; !reflect.DeepEqual([]string(config.BackendNodes), want) {
+		t.Fatalf("BackendNodes = %v, want %v", config.BackendNodes, want)
+	}
+	if config.StoreClient, err = env.NewEnvClient(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	resetConfig()
+	if config.BackendNodes != nil || config.StoreClient != nil {
+		t.Errorf("resetConfig() kept BackendNodes %v and StoreClient %v", config.BackendNodes, config.StoreClient)
+	}
+	if config.Backend != "etcd" || config.Interval != 600 || config.Timeout != 30 {
+		t.Errorf("resetConfig() = backend %q, interval %d, timeout %d, want the flag defaults", config.Backend, config.Interval, config.Timeout)
+	}
+	config.ConfigFile = "/nonexistent/confd.toml"
+	if err := initConfig(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if config.Backend != "etcd" {
+		t.Errorf("Backend = %q after resetConfig(), want -backend to no longer be set", config.Backend)
+	}
+}
+
+// reloadProcessor is a processor recording how reload updates it.
+type reloadProcessor struct {
+	reconfigured, rescanned int
+}
+
+func (p *reloadProcessor) Process() {}
+
+func (p *reloadProcessor) Rescan() error {
+	p.rescanned++
+	return nil
+}
+
+func (p *reloadProcessor) Reconfigure(config template.Config, interval int) {
+	p.reconfigured++
+}
+
+// closingClient is a store client recording whether it was closed.
+type closingClient struct {
+	backends.StoreClient
+	closed bool
+}
+
+func (c *closingClient) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestReloadOnlyReconfiguresChanges(t *testing.T) {
+	log.SetLevel("warn")
+	defer log.SetLevel("warn")
+	defer func(c Config) { config = c }(config)
+	defer func(fs *flag.FlagSet) { flag.CommandLine = fs }(flag.CommandLine)
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	for _, sub := range []string{"conf.d", "templates"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	configFile := filepath.Join(dir, "confd.toml")
+	writeConfig := func(configToml string) {
+		if err := ioutil.WriteFile(configFile, []byte(configToml), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	flag.CommandLine = flag.NewFlagSet("confd", flag.ContinueOnError)
+	base := Config{ConfigFile: configFile, Interval: 600}
+	base.ConfDir = dir
+	base.Backend = "env"
+	base.CompareMethod = "hash"
+	config = base
+
+	writeConfig("prefix = \"/dev\"\n")
+	if err := reloadConfig(base); err != nil {
+		t.Fatal(err.Error())
+	}
+	first := &closingClient{StoreClient: config.StoreClient}
+	config.StoreClient = first
+	p := &reloadProcessor{}
+
+	reload(p, base)
+	if p.reconfigured != 0 || p.rescanned != 1 {
+		t.Errorf("unchanged config: %d reconfigures and %d rescans, want only a rescan", p.reconfigured, p.rescanned)
+	}
+	if config.StoreClient != first || first.closed {
+		t.Errorf("unchanged config: the store client was replaced or closed")
+	}
+
+	writeConfig("prefix = \"/prod\"\n")
+	reload(p, base)
+	if p.reconfigured != 1 {
+		t.Errorf("new prefix: %d reconfigures, want 1", p.reconfigured)
+	}
+	if config.StoreClient != first || first.closed {
+		t.Errorf("new prefix: the store client was replaced or closed although the backend config is unchanged")
+	}
+
+	writeConfig("prefix = \"/prod\"\nbackoff = 2\n")
+	reload(p, base)
+	if p.reconfigured != 2 {
+		t.Errorf("new backend config: %d reconfigures, want 2", p.reconfigured)
+	}
+	if config.StoreClient == first || !first.closed {
+		t.Errorf("new backend config: the previous store client was kept or not closed")
+	}
+}
+
+func TestInitConfigWatchUnsupported(t *testing.T) {
+	log.SetLevel("warn")
+	defer func(c Config) { config = c }(config)
+	defer func(fs *flag.FlagSet) { flag.CommandLine = fs }(flag.CommandLine)
+
+	for _, backend := range []string{"dynamodb", "ssm"} {
+		config = Config{ConfigFile: "/nonexistent/confd.toml", Watch: true}
+		config.CompareMethod = "hash"
+		config.Backend = backend
+		config.Table = "confd"
+		flag.CommandLine = flag.NewFlagSet("confd", flag.ContinueOnError)
+		if err := initConfig(); err == nil || !strings.Contains(err.Error(), "Watch is not supported") {
+			t.Errorf("initConfig() = %v for -watch with -backend %s, want an unsupported watch error", err, backend)
+		}
+	}
+}
+
+func TestFollowSymlinksFlag(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	defer func(fs *flag.FlagSet) { flag.CommandLine = fs }(flag.CommandLine)
+
+	for _, tt := range []struct {
+		args []string
+		want bool
+	}{
+		{nil, false},
+		{[]string{"-follow-symlinks"}, false},
+		{[]string{"-follow-symlinks=false"}, true},
+	} {
+		config = Config{}
+		flag.CommandLine = flag.NewFlagSet("confd", flag.ContinueOnError)
+		defineFlags()
+		if err := flag.CommandLine.Parse(tt.args); err != nil {
+			t.Fatal(err.Error())
+		}
+		if config.NoFollowSymlinks != tt.want {
+			t.Errorf("%v: NoFollowSymlinks = %t, want %t", tt.args, config.NoFollowSymlinks, tt.want)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/kelseyhightower/confd/resource/template"
+)
+
+// Exit codes. A run in which several template resources fail for different
+// reasons exits with the code of the most severe failure, which is the
+// highest code below.
+const (
+	// exitFailure is used for errors that fit no other category.
+	exitFailure = 1
+	// exitBackend means the backend could not be reached, or keys were
+	// missing from it. Retrying later may succeed.
+	exitBackend = 2
+	// exitConfig means the confd configuration or a template resource is
+	// invalid.
+	exitConfig = 3
+	// exitRender means a template could not be rendered or its destination
+	// could not be written.
+	exitRender = 4
+	// exitCheck means a check_cmd rejected a rendered config file.
+	exitCheck = 5
+	// exitReload means a reload_cmd failed after its config file was
+	// updated.
+	exitReload = 6
+)
+
+var exitCodes = map[template.FailureKind]int{
+	template.BackendFailure: exitBackend,
+	template.ConfigFailure:  exitConfig,
+	template.RenderFailure:  exitRender,
+	template.CheckFailure:   exitCheck,
+	template.ReloadFailure:  exitReload,
+}
+
+// exitCode returns the exit code for an error returned by template.Process.
+func exitCode(err error) int {
+	if code, ok := exitCodes[template.Kind(err)]; ok {
+		return code
+	}
+	return exitFailure
+}
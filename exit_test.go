@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kelseyhightower/confd/backends/env"
+	"github.com/kelseyhightower/confd/log"
+	"github.com/kelseyhightower/confd/resource/template"
+)
+
+// runResources writes a template resource to a new confdir for every entry
+// of resources, each mapping extra resource settings to a template, and
+// processes them once using the env backend.
+// It returns the exit code confd would exit with.
+func runResources(t *testing.T, resources map[string][2]string) int {
+	confDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+	for _, dir := range []string{"conf.d", "templates"} {
+		if err := os.Mkdir(filepath.Join(confDir, dir), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	for name, r := range resources {
+		resourceToml := `
+[template]
+src = "` + name + `.tmpl"
+dest = "` + filepath.Join(confDir, name+".conf") + `"
+keys = ["/exittest"]
+` + r[0]
+		if err := ioutil.WriteFile(filepath.Join(confDir, "conf.d", name+".toml"), []byte(resourceToml), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := ioutil.WriteFile(filepath.Join(confDir, "templates", name+".tmpl"), []byte(r[1]), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	storeClient, err := env.NewEnvClient()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = template.Process(template.Config{
+		ConfDir:     confDir,
+		ConfigDir:   filepath.Join(confDir, "conf.d"),
+		StoreClient: storeClient,
+		TemplateDir: filepath.Join(confDir, "templates"),
+	})
+	if err == nil {
+		return 0
+	}
+	return exitCode(err)
+}
+
+func TestExitCodes(t *testing.T) {
+	log.SetLevel("panic")
+	os.Setenv("EXITTEST_VALUE", "1")
+	defer os.Unsetenv("EXITTEST_VALUE")
+
+	valid := `value = {{getv "/exittest/value"}}`
+	tests := []struct {
+		desc      string
+		resources map[string][2]string
+		want      int
+	}{
+		{"success", map[string][2]string{"a": {"", valid}}, 0},
+		{"backend", map[string][2]string{"a": {`required_keys = ["/exittest/missing"]`, valid}}, exitBackend},
+		{"config", map[string][2]string{"a": {`mode = "not-a-mode"`, valid}}, exitConfig},
+		{"render", map[string][2]string{"a": {"", `{{getv "/exittest/missing"}}`}}, exitRender},
+		{"check", map[string][2]string{"a": {`check_cmd = "false"`, valid}}, exitCheck},
+		{"reload", map[string][2]string{"a": {`reload_cmd = "false"`, valid}}, exitReload},
+		{"most severe", map[string][2]string{
+			"a": {`required_keys = ["/exittest/missing"]`, valid},
+			"b": {`check_cmd = "false"`, valid},
+			"c": {"", `{{getv "/exittest/missing"}}`},
+		}, exitCheck},
+	}
+	for _, tt := range tests {
+		if got := runResources(t, tt.resources); got != tt.want {
+			t.Errorf("%s: exit code = %d, want %d", tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestExitCodeUnclassifiedError(t *testing.T) {
+	if got := exitCode(errors.New("boom")); got != exitFailure {
+		t.Errorf("exitCode() = %d, want %d", got, exitFailure)
+	}
+}
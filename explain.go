@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/kelseyhightower/confd/backends"
+	util "github.com/kelseyhightower/confd/util"
+)
+
+// explain prints to w where the value of key, prefixed with the global
+// prefix, comes from: the backend and nodes it is read from, its value and,
+// for backends that can tell, the index it was last modified at and its TTL.
+// Values of keys whose name suggests a credential, and every value of the
+// vault backend, are redacted unless config.ExplainSecrets is set.
+// It returns the code confd exits with.
+func explain(w io.Writer, config Config, c backends.StoreClient, key string) int {
+	key = path.Join("/", config.Prefix, key)
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', 0)
+	defer tw.Flush()
+	fmt.Fprintf(tw, "Key:\t%s\n", key)
+	fmt.Fprintf(tw, "Backend:\t%s\n", config.Backend)
+	if nodes := util.RedactNodes(config.BackendNodes); len(nodes) > 0 {
+		fmt.Fprintf(tw, "Nodes:\t%s\n", strings.Join(nodes, ", "))
+	}
+
+	var value string
+	var index uint64
+	var ttl int64
+	var found, described bool
+	if kc, ok := c.(backends.KeyInfoClient); ok {
+		var err error
+		value, index, ttl, err = kc.GetKeyInfo(key)
+		switch {
+		case err == nil:
+			found, described = true, true
+		case err != backends.ErrKeyInfoUnsupported:
+			fmt.Fprintf(tw, "Error:\t%s\n", err)
+			return exitBackend
+		}
+	}
+	if !described {
+		vars, err := c.GetValues([]string{key})
+		if err != nil {
+			fmt.Fprintf(tw, "Error:\t%s\n", err)
+			return exitBackend
+		}
+		value, found = vars[key]
+	}
+	if !found {
+		fmt.Fprintf(tw, "Value:\t(not found)\n")
+		return exitFailure
+	}
+
+	if !config.ExplainSecrets && (config.Backend == "vault" || util.IsSecretName(key)) {
+		fmt.Fprintf(tw, "Value:\txxxxx (redacted, use -explain-show-secrets to show it)\n")
+	} else {
+		fmt.Fprintf(tw, "Value:\t%q\n", value)
+	}
+	if !described {
+		fmt.Fprintf(tw, "Modified index:\tunknown, the %s backend cannot tell\n", config.Backend)
+		return 0
+	}
+	fmt.Fprintf(tw, "Modified index:\t%d\n", index)
+	if ttl > 0 {
+		fmt.Fprintf(tw, "TTL:\t%ds\n", ttl)
+	} else {
+		fmt.Fprintf(tw, "TTL:\tnone\n")
+	}
+	return 0
+}
@@ -9,6 +9,7 @@ package log
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"time"
@@ -22,9 +23,16 @@ type ConfdFormatter struct {
 func (c *ConfdFormatter) Format(entry *log.Entry) ([]byte, error) {
 	timestamp := time.Now().Format(time.RFC3339)
 	hostname, _ := os.Hostname()
-	return []byte(fmt.Sprintf("%s %s %s[%d]: %s %s\n", timestamp, hostname, tag, os.Getpid(), strings.ToUpper(entry.Level.String()), entry.Message)), nil
+	severity := strings.ToUpper(entry.Level.String())
+	if s, ok := entry.Data["severity"].(string); ok {
+		severity = s
+	}
+	return []byte(fmt.Sprintf("%s %s %s[%d]: %s %s\n", timestamp, hostname, tag, os.Getpid(), severity, entry.Message)), nil
 }
 
+// trace reports whether trace messages are logged.
+var trace bool
+
 // tag represents the application name generating the log message. The tag
 // string will appear in all log entires.
 var tag string
@@ -39,13 +47,44 @@ func SetTag(t string) {
 	tag = t
 }
 
-// SetLevel sets the log level. Valid levels are panic, fatal, error, warn, info and debug.
-func SetLevel(level string) {
+// SetLevel sets the log level. Valid levels are panic, fatal, error, warn
+// (or warning), info and debug.
+// It returns an error, leaving the level as it was, if level is not valid.
+func SetLevel(level string) error {
 	lvl, err := log.ParseLevel(level)
 	if err != nil {
-		Fatal(fmt.Sprintf(`not a valid level: "%s"`, level))
+		return fmt.Errorf(`not a valid log level: "%s"`, level)
 	}
 	log.SetLevel(lvl)
+	return nil
+}
+
+// SetOutput sets the writer log entries are written to, standard error by
+// default.
+func SetOutput(w io.Writer) {
+	log.SetOutput(w)
+}
+
+// SetTrace enables or disables trace messages, the most verbose level below
+// debug. Enabling them also sets the log level to debug.
+func SetTrace(enabled bool) {
+	trace = enabled
+	if enabled {
+		log.SetLevel(log.DebugLevel)
+	}
+}
+
+// TraceEnabled reports whether trace messages are logged, so that callers
+// can skip building expensive messages.
+func TraceEnabled() bool {
+	return trace
+}
+
+// Trace logs a message with severity TRACE if tracing is enabled.
+func Trace(format string, v ...interface{}) {
+	if trace {
+		log.WithField("severity", "TRACE").Debug(fmt.Sprintf(format, v...))
+	}
 }
 
 // Debug logs a message with severity DEBUG.
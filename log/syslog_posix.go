@@ -0,0 +1,61 @@
+// +build !windows
+
+package log
+
+import (
+	"io/ioutil"
+	"log/syslog"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// syslogWriter is the connection to syslog once SetSyslog has been called.
+var syslogWriter *syslog.Writer
+
+// syslogHook writes log entries to syslog, at the syslog severity matching
+// their level.
+type syslogHook struct {
+	w *syslog.Writer
+}
+
+func (h *syslogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *syslogHook) Fire(entry *log.Entry) error {
+	msg := entry.Message
+	if s, ok := entry.Data["severity"].(string); ok {
+		msg = s + " " + msg
+	}
+	switch entry.Level {
+	case log.DebugLevel:
+		return h.w.Debug(msg)
+	case log.InfoLevel:
+		return h.w.Info(msg)
+	case log.WarnLevel:
+		return h.w.Warning(msg)
+	case log.ErrorLevel:
+		return h.w.Err(msg)
+	default:
+		return h.w.Crit(msg)
+	}
+}
+
+// SetSyslog sends log entries to the local syslog daemon, with the daemon
+// facility and the confd tag, instead of standard error. Syslog adds its
+// own timestamp, hostname and tag to every entry.
+// Calling it again has no effect.
+// It returns an error if syslog cannot be reached.
+func SetSyslog() error {
+	if syslogWriter != nil {
+		return nil
+	}
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "confd")
+	if err != nil {
+		return err
+	}
+	syslogWriter = w
+	log.AddHook(&syslogHook{w})
+	log.SetOutput(ioutil.Discard)
+	return nil
+}
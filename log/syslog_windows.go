@@ -0,0 +1,11 @@
+package log
+
+import (
+	"errors"
+)
+
+// SetSyslog is not supported on Windows, which has no syslog.
+// It always returns an error.
+func SetSyslog() error {
+	return errors.New("syslog is not supported on Windows")
+}
@@ -0,0 +1,123 @@
+package template
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/confd/log"
+	util "github.com/kelseyhightower/confd/util"
+)
+
+// The values of backup_format, naming the backups kept of dest.
+const (
+	// BackupNumbered names the backups dest.bak, dest.bak.1, dest.bak.2 and
+	// so on, dest.bak being the most recent. The .bak suffix is set by
+	// backup_suffix.
+	BackupNumbered = "numbered"
+	// BackupTimestamp names the backups dest.bak.<time>, the UTC time the
+	// backup was made.
+	BackupTimestamp = "timestamp"
+)
+
+// DefaultBackupSuffix is the suffix of backups when backup_suffix is not
+// set.
+const DefaultBackupSuffix = ".bak"
+
+// backupTimeLayout formats the time of timestamped backups, so that their
+// names sort in the order they were made.
+const backupTimeLayout = "20060102T150405.000000000Z"
+
+// keepBackup copies dest, if it exists, to a backup next to it before it
+// is overwritten, then removes the oldest backups so that at most
+// t.Backups are kept.
+// It returns an error if the backup cannot be made.
+func (t *TemplateResource) keepBackup(dest string) error {
+	if _, err := os.Stat(dest); os.IsNotExist(err) {
+		return nil
+	}
+	if t.BackupFormat == BackupTimestamp {
+		backup := dest + t.BackupSuffix + "." + time.Now().UTC().Format(backupTimeLayout)
+		log.Debug("Backing up " + dest + " to " + backup)
+		if err := copyFile(dest, backup); err != nil {
+			return fmt.Errorf("Cannot back up %s - %s", dest, err.Error())
+		}
+		return pruneTimestampedBackups(dest+t.BackupSuffix, t.Backups)
+	}
+	// Shift the older backups up by one, dropping the oldest.
+	backup := dest + t.BackupSuffix
+	os.Remove(numberedBackup(backup, t.Backups-1))
+	for i := t.Backups - 2; i >= 0; i-- {
+		if err := os.Rename(numberedBackup(backup, i), numberedBackup(backup, i+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Cannot back up %s - %s", dest, err.Error())
+		}
+	}
+	log.Debug("Backing up " + dest + " to " + backup)
+	if err := copyFile(dest, backup); err != nil {
+		return fmt.Errorf("Cannot back up %s - %s", dest, err.Error())
+	}
+	return nil
+}
+
+// numberedBackup returns the path of the numbered backup, named backup
+// for the most recent one, made i updates before the most recent one.
+func numberedBackup(backup string, i int) string {
+	if i == 0 {
+		return backup
+	}
+	return fmt.Sprintf("%s.%d", backup, i)
+}
+
+// pruneTimestampedBackups removes the oldest timestamped backups named
+// after backup beyond the last n. Files whose name does not end with a
+// backup time are left alone.
+func pruneTimestampedBackups(backup string, n int) error {
+	files, err := ioutil.ReadDir(filepath.Dir(backup))
+	if err != nil {
+		return err
+	}
+	prefix := filepath.Base(backup) + "."
+	var backups []string
+	for _, fi := range files {
+		name := fi.Name()
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if _, err := time.Parse(backupTimeLayout, strings.TrimPrefix(name, prefix)); err != nil {
+			continue
+		}
+		backups = append(backups, name)
+	}
+	sort.Strings(backups)
+	for len(backups) > n {
+		log.Debug("Removing old backup " + backups[0])
+		if err := os.Remove(filepath.Join(filepath.Dir(backup), backups[0])); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// copyFile copies the file at path, with its mode and owner, to the file
+// at to, replacing it.
+func copyFile(path, to string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	fi, err := util.FileStat(path)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(to, contents, fi.Mode); err != nil {
+		return err
+	}
+	os.Chmod(to, fi.Mode)
+	os.Chown(to, int(fi.Uid), int(fi.Gid))
+	return nil
+}
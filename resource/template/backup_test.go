@@ -0,0 +1,193 @@
+package template
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/kelseyhightower/confd/log"
+)
+
+// processPorts processes tr once for every port, leaving dest rendered with
+// the last one.
+func processPorts(t *testing.T, tr *TemplateResource, storeClient *mockStoreClient, ports ...string) {
+	for _, port := range ports {
+		storeClient.values["/app/port"] = port
+		if err := tr.process(); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+}
+
+func TestNumberedBackups(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "test.conf")
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/app"]
+mode = "0640"
+backups = 2
+`
+	storeClient := &mockStoreClient{values: map[string]string{}}
+	tr := newTestResource(t, confDir, resourceToml, "port = {{getv \"/app/port\"}}\n", storeClient)
+
+	processPorts(t, tr, storeClient, "80")
+	if _, err := os.Stat(dest + ".bak"); !os.IsNotExist(err) {
+		t.Errorf("a backup was made of a dest that did not exist")
+	}
+
+	processPorts(t, tr, storeClient, "81", "81", "82", "83")
+	want := map[string]string{
+		dest + ".bak":   "port = 82\n",
+		dest + ".bak.1": "port = 81\n",
+	}
+	for path, contents := range want {
+		got, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Errorf("backup missing: %s", err.Error())
+			continue
+		}
+		if string(got) != contents {
+			t.Errorf("%s = %q, want %q", path, string(got), contents)
+		}
+		if fi, err := os.Stat(path); err == nil && fi.Mode().Perm() != 0640 {
+			t.Errorf("%s mode = %v, want 640", path, fi.Mode().Perm())
+		}
+	}
+	if _, err := os.Stat(dest + ".bak.2"); !os.IsNotExist(err) {
+		t.Errorf("a third backup was kept with backups = 2")
+	}
+}
+
+func TestTimestampedBackups(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "test.conf")
+	notes := dest + ".bak.notes"
+	if err := ioutil.WriteFile(notes, []byte("keep me\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/app"]
+backups = 2
+backup_format = "timestamp"
+`
+	storeClient := &mockStoreClient{values: map[string]string{}}
+	tr := newTestResource(t, confDir, resourceToml, "port = {{getv \"/app/port\"}}\n", storeClient)
+	processPorts(t, tr, storeClient, "80", "81", "82", "83")
+
+	backups, err := filepath.Glob(dest + ".bak.2*")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	sort.Strings(backups)
+	var got []string
+	for _, path := range backups {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		got = append(got, strings.TrimSpace(string(contents)))
+	}
+	if want := "port = 81,port = 82"; strings.Join(got, ",") != want {
+		t.Errorf("backups = %q, want %q", got, want)
+	}
+	if _, err := os.Stat(notes); err != nil {
+		t.Errorf("pruning removed a file that is not a backup: %s", err.Error())
+	}
+}
+
+func TestBackupsValidation(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	resourcePath := filepath.Join(confDir, "conf.d", "test.toml")
+	for _, setting := range []string{"backups = -1", `backup_format = "daily"`, `backup_suffix = "/old"`} {
+		resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + filepath.Join(confDir, "test.conf") + `"
+keys = ["/app"]
+` + setting + `
+`
+		if err := ioutil.WriteFile(resourcePath, []byte(resourceToml), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := NewTemplateResource(resourcePath, testConfig(confDir, &mockStoreClient{})); err == nil {
+			t.Errorf("NewTemplateResource accepted %s", setting)
+		}
+	}
+}
+
+func TestBackupSuffix(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "test.conf")
+	if err := ioutil.WriteFile(dest, []byte("port = 80\n"), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/app"]
+backups = 1
+backup_suffix = ".confd-bak"
+`
+	storeClient := &mockStoreClient{values: map[string]string{"/app/port": "8080"}}
+	tr := newTestResource(t, confDir, resourceToml, "port = {{getv \"/app/port\"}}\n", storeClient)
+
+	tr.noop = true
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := os.Stat(dest + ".confd-bak"); !os.IsNotExist(err) {
+		t.Error("a backup was made in noop mode")
+	}
+
+	tr.noop = false
+	processPorts(t, tr, storeClient, "8080", "8081")
+	backup := dest + ".confd-bak"
+	if got, err := ioutil.ReadFile(backup); err != nil || string(got) != "port = 8080\n" {
+		t.Errorf("%s = %q, %v, want the previous dest", backup, string(got), err)
+	}
+	fi, err := os.Stat(backup)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("%s mode = %v, want 600", backup, fi.Mode().Perm())
+	}
+	matches, _ := filepath.Glob(dest + ".*")
+	if len(matches) != 1 {
+		t.Errorf("files next to dest = %v, want only %s", matches, backup)
+	}
+}
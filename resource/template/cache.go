@@ -0,0 +1,65 @@
+package template
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// A templateCache holds parsed templates by path so that template files are
+// only parsed again once they change, rather than on every processing
+// cycle. A file is considered changed when its modification time or size
+// differs from when it was parsed. A file parsed with other delimiters than
+// the cached template is parsed again.
+type templateCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedTemplate
+}
+
+type cachedTemplate struct {
+	modTime time.Time
+	size    int64
+	delims  [2]string
+	tmpl    *template.Template
+}
+
+// templates is the template cache shared by every template resource.
+var templates = newTemplateCache()
+
+func newTemplateCache() *templateCache {
+	return &templateCache{entries: make(map[string]cachedTemplate)}
+}
+
+// parse returns the template in the file path, using funcMap and the left
+// and right delimiters delims, or {{ and }} if delims is empty. The parsed
+// template is shared through the cache, so a clone bound to funcMap is
+// returned.
+// It returns an error if the file cannot be read or parsed.
+func (c *templateCache) parse(path string, delims []string, funcMap map[string]interface{}) (*template.Template, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	e, ok := c.entries[path]
+	c.mu.Unlock()
+	var d [2]string
+	copy(d[:], delims)
+	if !ok || !e.modTime.Equal(fi.ModTime()) || e.size != fi.Size() || e.delims != d {
+		tmpl, err := template.New(filepath.Base(path)).Delims(d[0], d[1]).Funcs(funcMap).ParseFiles(path)
+		if err != nil {
+			return nil, err
+		}
+		e = cachedTemplate{modTime: fi.ModTime(), size: fi.Size(), delims: d, tmpl: tmpl}
+		c.mu.Lock()
+		c.entries[path] = e
+		c.mu.Unlock()
+	}
+	tmpl, err := e.tmpl.Clone()
+	if err != nil {
+		return nil, err
+	}
+	return tmpl.Funcs(funcMap), nil
+}
@@ -0,0 +1,90 @@
+package template
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTemplateCacheReusesUnchangedTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.tmpl")
+	if err := ioutil.WriteFile(path, []byte(`{{toUpper "a"}}`), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	c := newTemplateCache()
+	render := func() string {
+		tmpl, err := c.parse(path, nil, newFuncMap())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, nil); err != nil {
+			t.Fatal(err.Error())
+		}
+		return b.String()
+	}
+
+	if got := render(); got != "A" {
+		t.Errorf("rendered %q, want %q", got, "A")
+	}
+	parsed := c.entries[path].tmpl
+	for i := 0; i < 3; i++ {
+		render()
+	}
+	if c.entries[path].tmpl != parsed {
+		t.Errorf("unchanged template was parsed again")
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{{toUpper "b"}}`), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	// Make sure the edit is visible even on filesystems with a coarse
+	// modification time.
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err.Error())
+	}
+	if got := render(); got != "B" {
+		t.Errorf("rendered %q after editing the template, want %q", got, "B")
+	}
+	if c.entries[path].tmpl == parsed {
+		t.Errorf("edited template was not parsed again")
+	}
+}
+
+func TestTemplateCacheBindsFuncMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.tmpl")
+	if err := ioutil.WriteFile(path, []byte(`{{value}}`), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	c := newTemplateCache()
+	for _, want := range []string{"first", "second"} {
+		v := want
+		tmpl, err := c.parse(path, nil, map[string]interface{}{"value": func() string { return v }})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, nil); err != nil {
+			t.Fatal(err.Error())
+		}
+		if b.String() != want {
+			t.Errorf("rendered %q, want %q", b.String(), want)
+		}
+	}
+}
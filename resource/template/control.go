@@ -0,0 +1,247 @@
+package template
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kelseyhightower/confd/log"
+)
+
+// A Controller is a Processor that can be driven through a ControlServer.
+type Controller interface {
+	Processor
+	// Sync runs a processing cycle immediately.
+	Sync() error
+	// Status describes the last processing cycle.
+	Status() CycleStatus
+	// Dump returns the key/value pairs fetched from the backend by the
+	// last processing cycle.
+	Dump() map[string]string
+}
+
+// CycleStatus describes the outcome of a processing cycle.
+type CycleStatus struct {
+	Time      time.Time
+	Duration  time.Duration
+	Resources int
+	Err       error
+}
+
+// cycleState serializes processing cycles and records their outcome. Full
+// cycles hold mu exclusively while single resources processed in watch mode
+// share it, so a forced sync never overlaps with a resource being processed.
+// Full cycles process up to concurrency resources at once.
+type cycleState struct {
+	mu          sync.RWMutex
+	ts          []*TemplateResource
+	concurrency int
+	statusMu    sync.Mutex
+	status      CycleStatus
+}
+
+// setResources sets the template resources processed by run(nil) and the
+// resources they describe to the resources template function.
+func (c *cycleState) setResources(ts []*TemplateResource) {
+	c.mu.Lock()
+	c.ts = ts
+	setResources(ts)
+	c.mu.Unlock()
+}
+
+// run processes ts, or the last processed resources if ts is nil, as a
+// single cycle.
+// It returns the last error encountered, if any.
+func (c *cycleState) run(ts []*TemplateResource) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ts != nil {
+		c.ts = ts
+	}
+	start := time.Now()
+	err := process(c.ts, c.concurrency)
+	c.record(CycleStatus{Time: start, Duration: time.Since(start), Resources: len(c.ts), Err: err})
+	return err
+}
+
+// runGroup processes the template resources ts, which share a watch, as a
+// single cycle, sending every error encountered to errChan. Reload commands
+// run once all of them are processed, once per distinct command.
+// The errors are sent once the cycle is done, so that a full errChan never
+// blocks setResources, run by the goroutine reading errChan, behind it.
+func (c *cycleState) runGroup(ts []*TemplateResource, errChan chan error) {
+	for _, err := range c.processGroup(ts) {
+		errChan <- err
+	}
+}
+
+// processGroup processes the template resources ts as a single cycle for
+// runGroup.
+// It returns every error encountered.
+func (c *cycleState) processGroup(ts []*TemplateResource) []error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	start := time.Now()
+	var errs []error
+	var lastErr error
+	report := func(err error) {
+		errs = append(errs, err)
+		if moreSevere(err, lastErr) {
+			lastErr = err
+		}
+	}
+	batch := newReloadBatch()
+	outcomes := make([]outcome, len(ts))
+	for i, t := range ts {
+		o, err := t.processBatched(batch)
+		if err != nil {
+			report(err)
+		}
+		outcomes[i] = o
+	}
+	reloadFailed, err := batch.run()
+	if err != nil {
+		report(err)
+	}
+	var summary cycleSummary
+	for i, t := range ts {
+		if reloadFailed[t] {
+			outcomes[i] = outcomeFailed
+		}
+		summary.add(t, outcomes[i])
+	}
+	log.Info(summary.String())
+	c.record(CycleStatus{Time: start, Duration: time.Since(start), Resources: len(ts), Err: lastErr})
+	return errs
+}
+
+// setConcurrency sets how many resources full cycles process at once.
+func (c *cycleState) setConcurrency(n int) {
+	c.mu.Lock()
+	c.concurrency = n
+	c.mu.Unlock()
+}
+
+func (c *cycleState) record(status CycleStatus) {
+	c.statusMu.Lock()
+	c.status = status
+	c.statusMu.Unlock()
+}
+
+// Status returns the outcome of the last processing cycle.
+func (c *cycleState) Status() CycleStatus {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	return c.status
+}
+
+// dump merges the values last fetched by every template resource.
+func (c *cycleState) dump() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	vars := make(map[string]string)
+	for _, t := range c.ts {
+		for k, v := range t.lastValues {
+			vars[k] = v
+		}
+	}
+	return vars
+}
+
+// A ControlServer accepts commands for a Controller on a unix socket. The
+// protocol is line based: clients send one command per line and every
+// response is terminated by an empty line. The supported commands are:
+//
+//	sync    run a processing cycle immediately
+//	status  describe the last processing cycle
+//	dump    list the key/value pairs fetched by the last processing cycle
+type ControlServer struct {
+	listener   net.Listener
+	controller Controller
+}
+
+// NewControlServer listens on the unix socket at path, replacing any stale
+// socket file left behind by a previous run.
+// It returns an error if the socket cannot be created.
+func NewControlServer(path string, c Controller) (*ControlServer, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Control socket listening on " + path)
+	return &ControlServer{listener: l, controller: c}, nil
+}
+
+// Serve accepts connections until the server is closed.
+func (s *ControlServer) Serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// Close stops the server and removes the socket file.
+func (s *ControlServer) Close() error {
+	return s.listener.Close()
+}
+
+func (s *ControlServer) handle(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		cmd := strings.TrimSpace(scanner.Text())
+		if cmd == "" {
+			continue
+		}
+		log.Debug("Control command: " + cmd)
+		s.execute(conn, cmd)
+		fmt.Fprintln(conn)
+	}
+}
+
+func (s *ControlServer) execute(w io.Writer, cmd string) {
+	switch cmd {
+	case "sync":
+		if err := s.controller.Sync(); err != nil {
+			fmt.Fprintf(w, "error: %s\n", err)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	case "status":
+		status := s.controller.Status()
+		if status.Time.IsZero() {
+			fmt.Fprintln(w, "last_run: never")
+			return
+		}
+		fmt.Fprintf(w, "last_run: %s\n", status.Time.Format(time.RFC3339))
+		fmt.Fprintf(w, "duration: %s\n", status.Duration)
+		fmt.Fprintf(w, "resources: %d\n", status.Resources)
+		if status.Err != nil {
+			fmt.Fprintf(w, "error: %s\n", status.Err)
+		}
+	case "dump":
+		vars := s.controller.Dump()
+		keys := make([]string, 0, len(vars))
+		for k := range vars {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s=%s\n", k, vars[k])
+		}
+	default:
+		fmt.Fprintf(w, "error: unknown command %q\n", cmd)
+	}
+}
@@ -0,0 +1,156 @@
+package template
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/confd/log"
+)
+
+// fakeController records syncs and serves a canned status and key map.
+type fakeController struct {
+	syncs   int
+	syncErr error
+	status  CycleStatus
+	vars    map[string]string
+}
+
+func (c *fakeController) Process() {}
+
+func (c *fakeController) Sync() error {
+	c.syncs++
+	return c.syncErr
+}
+
+func (c *fakeController) Status() CycleStatus {
+	return c.status
+}
+
+func (c *fakeController) Dump() map[string]string {
+	return c.vars
+}
+
+// controlCommand sends cmd on conn and returns the response lines.
+func controlCommand(t *testing.T, conn net.Conn, r *bufio.Reader, cmd string) []string {
+	if _, err := conn.Write([]byte(cmd + "\n")); err != nil {
+		t.Fatal(err.Error())
+	}
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%s: failed to read response: %s", cmd, err.Error())
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestControlServer(t *testing.T) {
+	log.SetLevel("warn")
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	c := &fakeController{
+		status: CycleStatus{
+			Time:      time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC),
+			Duration:  1500 * time.Millisecond,
+			Resources: 3,
+			Err:       errors.New("missing template"),
+		},
+		vars: map[string]string{
+			"/app/port": "8080",
+			"/app/host": "127.0.0.1",
+		},
+	}
+	socket := filepath.Join(dir, "confd.sock")
+	s, err := NewControlServer(socket, c)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer s.Close()
+	go s.Serve()
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	if got := controlCommand(t, conn, r, "sync"); len(got) != 1 || got[0] != "ok" {
+		t.Errorf("sync response = %q, want [ok]", got)
+	}
+	if c.syncs != 1 {
+		t.Errorf("sync ran %d cycles, want 1", c.syncs)
+	}
+	c.syncErr = errors.New("backend unavailable")
+	if got := controlCommand(t, conn, r, "sync"); len(got) != 1 || got[0] != "error: backend unavailable" {
+		t.Errorf("failed sync response = %q, want [error: backend unavailable]", got)
+	}
+
+	want := []string{
+		"last_run: 2018-05-01T12:00:00Z",
+		"duration: 1.5s",
+		"resources: 3",
+		"error: missing template",
+	}
+	if got := controlCommand(t, conn, r, "status"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("status response = %q, want %q", got, want)
+	}
+
+	want = []string{"/app/host=127.0.0.1", "/app/port=8080"}
+	if got := controlCommand(t, conn, r, "dump"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("dump response = %q, want %q", got, want)
+	}
+
+	if got := controlCommand(t, conn, r, "restart"); len(got) != 1 || !strings.HasPrefix(got[0], "error: unknown command") {
+		t.Errorf("unknown command response = %q", got)
+	}
+}
+
+func TestCycleStateRecordsStatusAndValues(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	storeClient := &mockStoreClient{values: map[string]string{"/app/port": "8080"}}
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + filepath.Join(confDir, "test.conf") + `"
+keys = ["/app"]
+`
+	tr := newTestResource(t, confDir, resourceToml, `port = {{getv "/app/port"}}`, storeClient)
+
+	var c cycleState
+	if status := c.Status(); !status.Time.IsZero() {
+		t.Errorf("Status() before the first cycle = %v, want zero", status)
+	}
+	if err := c.run([]*TemplateResource{tr}); err != nil {
+		t.Fatal(err.Error())
+	}
+	status := c.Status()
+	if status.Time.IsZero() || status.Resources != 1 || status.Err != nil {
+		t.Errorf("Status() = %+v, want a successful cycle of 1 resource", status)
+	}
+	if got := c.dump(); got["/app/port"] != "8080" {
+		t.Errorf("dump() = %v, want /app/port=8080", got)
+	}
+}
@@ -0,0 +1,60 @@
+package template
+
+// A FailureKind classifies why processing a template resource failed. The
+// kinds are ordered by increasing severity.
+type FailureKind int
+
+const (
+	// UnknownFailure is the kind of errors that were not classified.
+	UnknownFailure FailureKind = iota
+	// BackendFailure means the keys could not be fetched from the backend,
+	// or required keys were missing.
+	BackendFailure
+	// ConfigFailure means a template resource could not be loaded or is
+	// invalid.
+	ConfigFailure
+	// RenderFailure means the template could not be rendered or the
+	// destination file could not be written.
+	RenderFailure
+	// CheckFailure means the check command rejected the rendered file.
+	CheckFailure
+	// ReloadFailure means the reload command failed after the destination
+	// file was updated.
+	ReloadFailure
+)
+
+// A ProcessError records the kind of a template resource failure.
+type ProcessError struct {
+	Kind FailureKind
+	Err  error
+}
+
+func (e *ProcessError) Error() string {
+	return e.Err.Error()
+}
+
+// newError classifies err as kind. Nil and already classified errors are
+// returned unchanged.
+func newError(kind FailureKind, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*ProcessError); ok {
+		return err
+	}
+	return &ProcessError{Kind: kind, Err: err}
+}
+
+// Kind returns the FailureKind of err, or UnknownFailure if err was not
+// returned by template processing.
+func Kind(err error) FailureKind {
+	if e, ok := err.(*ProcessError); ok {
+		return e.Kind
+	}
+	return UnknownFailure
+}
+
+// moreSevere reports whether err is at least as severe as prev.
+func moreSevere(err, prev error) bool {
+	return prev == nil || Kind(err) >= Kind(prev)
+}
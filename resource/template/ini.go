@@ -0,0 +1,80 @@
+package template
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/kelseyhightower/memkv"
+)
+
+// FormatINI is the format of template resources rendering their keys as
+// an INI file instead of a src template.
+const FormatINI = "ini"
+
+// writeINI writes pairs to w as a Windows style INI file, with CRLF line
+// endings. The first path segment of a key names its section and the rest
+// of the path, with slashes replaced by dots, names its entry. Keys directly
+// under the prefix are written first, before any section. Sections and the
+// entries of each section are sorted by name.
+// Values that would be misread as written, such as values with leading or
+// trailing blanks, quotes, comment characters or line breaks, are quoted and
+// escaped with backslashes.
+// It returns an error if a section or entry name cannot be written.
+func writeINI(w io.Writer, pairs memkv.KVPairs) error {
+	sections := make(map[string]map[string]string)
+	for _, kv := range pairs {
+		segments := strings.Split(strings.Trim(kv.Key, "/"), "/")
+		section, name := "", segments[0]
+		if len(segments) > 1 {
+			section, name = segments[0], strings.Join(segments[1:], ".")
+		}
+		if strings.ContainsAny(section, "[]\r\n") {
+			return fmt.Errorf("Cannot write %s as an INI section name", section)
+		}
+		if name == "" || strings.ContainsAny(name, "=\r\n") || strings.ContainsAny(name[:1], "[;#") || strings.TrimSpace(name) != name {
+			return fmt.Errorf("Cannot write %s as an INI entry name", kv.Key)
+		}
+		if sections[section] == nil {
+			sections[section] = make(map[string]string)
+		}
+		sections[section][name] = kv.Value
+	}
+
+	names := make([]string, 0, len(sections))
+	for name := range sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	b := bufio.NewWriter(w)
+	for i, section := range names {
+		if section != "" {
+			if i > 0 {
+				b.WriteString("\r\n")
+			}
+			fmt.Fprintf(b, "[%s]\r\n", section)
+		}
+		entries := sections[section]
+		keys := make([]string, 0, len(entries))
+		for k := range entries {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(b, "%s=%s\r\n", k, iniValue(entries[k]))
+		}
+	}
+	return b.Flush()
+}
+
+// iniValue returns v, quoted and escaped if needed to be read back as is.
+func iniValue(v string) string {
+	if v == "" || (strings.TrimSpace(v) == v && !strings.ContainsAny(v, "\"\\;#\r\n")) {
+		return v
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\r", `\r`, "\n", `\n`)
+	return `"` + r.Replace(v) + `"`
+}
@@ -0,0 +1,93 @@
+package template
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kelseyhightower/confd/log"
+	"github.com/kelseyhightower/memkv"
+)
+
+func TestWriteINI(t *testing.T) {
+	pairs := memkv.KVPairs{
+		{Key: "/version", Value: "2"},
+		{Key: "/server/port", Value: "8080"},
+		{Key: "/server/host", Value: "0.0.0.0"},
+		{Key: "/database/name", Value: "app"},
+		{Key: "/database/password", Value: `p;a"ss\word`},
+		{Key: "/database/pool/size", Value: "10"},
+		{Key: "/database/motd", Value: " hello\nworld "},
+		{Key: "/database/empty", Value: ""},
+	}
+	want := "version=2\r\n" +
+		"\r\n[database]\r\n" +
+		"empty=\r\n" +
+		"motd=\" hello\\nworld \"\r\n" +
+		"name=app\r\n" +
+		"password=\"p;a\\\"ss\\\\word\"\r\n" +
+		"pool.size=10\r\n" +
+		"\r\n[server]\r\n" +
+		"host=0.0.0.0\r\n" +
+		"port=8080\r\n"
+	var b bytes.Buffer
+	if err := writeINI(&b, pairs); err != nil {
+		t.Fatal(err.Error())
+	}
+	if b.String() != want {
+		t.Errorf("writeINI() wrote %q, want %q", b.String(), want)
+	}
+}
+
+func TestWriteINIRejectsInvalidNames(t *testing.T) {
+	for _, key := range []string{"/sec]tion/key", "/section/a=b", "/section/;comment", "/section/ key"} {
+		var b bytes.Buffer
+		if err := writeINI(&b, memkv.KVPairs{{Key: key, Value: "v"}}); err == nil {
+			t.Errorf("writeINI() accepted the key %q", key)
+		}
+	}
+}
+
+func TestINIFormat(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "service.ini")
+	resourceToml := `
+[template]
+format = "ini"
+dest = "` + dest + `"
+prefix = "/legacy"
+keys = ["/"]
+`
+	resourcePath := filepath.Join(confDir, "conf.d", "service.toml")
+	if err := ioutil.WriteFile(resourcePath, []byte(resourceToml), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	storeClient := &mockStoreClient{values: map[string]string{
+		"/legacy/logging/level": "debug",
+		"/legacy/network/port":  "9000",
+		"/legacy/network/bind":  "127.0.0.1",
+	}}
+	tr, err := NewTemplateResource(resourcePath, testConfig(confDir, storeClient))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	got, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := "[logging]\r\nlevel=debug\r\n\r\n[network]\r\nbind=127.0.0.1\r\nport=9000\r\n"
+	if string(got) != want {
+		t.Errorf("%s = %q, want %q", dest, string(got), want)
+	}
+}
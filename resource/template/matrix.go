@@ -0,0 +1,162 @@
+package template
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/kelseyhightower/confd/log"
+)
+
+// A MatrixEntry is the data the template and dest of a matrix template
+// resource are rendered with, once for every child of the matrix key.
+type MatrixEntry struct {
+	// Name is the name of the child, such as "prod" for /envs/prod.
+	Name string
+	// Key is the full key of the child, relative to the prefix, such as
+	// "/envs/prod". Its subtree can be read with getv (printf "%s/port" .Key).
+	Key string
+}
+
+// matrixOutputs records the dest files last written for every matrix
+// template resource, by resource file, so that the files of removed entries
+// can be pruned. Template resources are recreated on every processing
+// cycle, so the record lives for the whole process; files of entries
+// removed while confd was not running are not pruned.
+var (
+	matrixOutputsMu sync.Mutex
+	matrixOutputs   = make(map[string][]string)
+)
+
+// processMatrix renders the template resource once for every child of its
+// matrix key. Dest is itself a template rendered with the MatrixEntry of
+// the child; check_cmd and reload_cmd run for every changed file, with
+// CONFD_DEST set to it. Files written for children that have since been
+// removed are deleted.
+// Children fail independently: the files of the others are still written.
+// With matrix_all_or_nothing set every file is rendered first, and none is
+// written if any of them cannot be rendered.
+// It returns an error counting the failed children, of the kind of the most
+// severe failure, if any.
+func (t *TemplateResource) processMatrix() error {
+	if err := t.setVars(); err != nil {
+		return newError(BackendFailure, err)
+	}
+	if t.skipEmpty() {
+		return nil
+	}
+	if missing := t.missingRequiredKeys(); len(missing) > 0 {
+		return newError(BackendFailure, fmt.Errorf("Missing required keys for %s: %s", t.Dest, strings.Join(missing, ", ")))
+	}
+	destTmpl, err := template.New("dest").Parse(t.Dest)
+	if err != nil {
+		return newError(ConfigFailure, fmt.Errorf("Invalid dest %s: %s", t.Dest, err))
+	}
+
+	var lastErr error
+	failed := 0
+	fail := func(err error) {
+		log.Error(err.Error())
+		failed++
+		if moreSevere(err, lastErr) {
+			lastErr = err
+		}
+	}
+	names := t.store.List(path.Join("/", t.Matrix))
+	var dests []string
+	var staged []*TemplateResource
+	for _, name := range names {
+		entry := MatrixEntry{Name: name, Key: path.Join("/", t.Matrix, name)}
+		var b bytes.Buffer
+		if err := destTmpl.Execute(&b, entry); err != nil {
+			fail(newError(ConfigFailure, fmt.Errorf("Invalid dest %s for matrix entry %s: %s", t.Dest, name, err)))
+			continue
+		}
+		entryResource := *t
+		entryResource.Dest = b.String()
+		entryResource.data = entry
+		dests = append(dests, entryResource.Dest)
+		if err := entryResource.stageEntry(); err != nil {
+			fail(err)
+			continue
+		}
+		if t.AllOrNothing {
+			staged = append(staged, &entryResource)
+			continue
+		}
+		t.syncEntry(&entryResource, fail)
+	}
+	discarded := t.AllOrNothing && failed > 0
+	for _, e := range staged {
+		if discarded {
+			os.Remove(e.StageFile.Name())
+			continue
+		}
+		t.syncEntry(e, fail)
+	}
+	// The file of a child whose dest could not be rendered is unknown, so
+	// nothing is pruned then, nor when no file was written at all.
+	if len(dests) == len(names) && !discarded {
+		t.pruneMatrix(dests)
+	}
+	if failed == 0 {
+		return nil
+	}
+	if discarded {
+		return newError(Kind(lastErr), fmt.Errorf("%d of %d entries of matrix %s failed, no file was written - %s", failed, len(names), t.Matrix, lastErr))
+	}
+	return newError(Kind(lastErr), fmt.Errorf("%d of %d entries of matrix %s failed - %s", failed, len(names), t.Matrix, lastErr))
+}
+
+// stageEntry renders the stage file of a single matrix entry.
+func (t *TemplateResource) stageEntry() error {
+	if err := t.resolveDest(); err != nil {
+		return newError(ConfigFailure, err)
+	}
+	if err := t.setFileMode(); err != nil {
+		return newError(ConfigFailure, err)
+	}
+	return newError(RenderFailure, t.createStageFile())
+}
+
+// syncEntry writes the staged file of the matrix entry e of t, recording
+// whether it was updated, and passes the error to fail, if any.
+func (t *TemplateResource) syncEntry(e *TemplateResource, fail func(error)) {
+	if err := newError(RenderFailure, e.sync()); err != nil {
+		fail(err)
+	}
+	if e.updated {
+		t.updated = true
+	}
+}
+
+// pruneMatrix records dests as the files of the matrix template resource and
+// deletes the files it wrote previously that are not among them.
+func (t *TemplateResource) pruneMatrix(dests []string) {
+	sort.Strings(dests)
+	matrixOutputsMu.Lock()
+	previous := matrixOutputs[t.configPath]
+	matrixOutputs[t.configPath] = dests
+	matrixOutputsMu.Unlock()
+
+	for _, dest := range previous {
+		i := sort.SearchStrings(dests, dest)
+		if i < len(dests) && dests[i] == dest {
+			continue
+		}
+		if t.dryRun || t.noop {
+			log.Warning("Not removing " + dest + " of a removed matrix entry")
+			continue
+		}
+		if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+			log.Error(err.Error())
+			continue
+		}
+		log.Info("Removed " + dest + " of a removed matrix entry")
+	}
+}
@@ -0,0 +1,42 @@
+package template
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+)
+
+// lookupUid returns the uid of owner, a user name or a numeric uid. Numeric
+// uids are used as is, without looking them up, since minimal images often
+// have no passwd entry for them.
+// It returns an error if owner is neither a number nor a known user.
+func lookupUid(owner string) (int, error) {
+	if uid, err := strconv.Atoi(owner); err == nil {
+		if uid < 0 {
+			return 0, fmt.Errorf("invalid owner %q", owner)
+		}
+		return uid, nil
+	}
+	u, err := user.Lookup(owner)
+	if err != nil {
+		return 0, fmt.Errorf("unknown owner %q", owner)
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// lookupGid returns the gid of group, a group name or a numeric gid.
+// Numeric gids are used as is, without looking them up.
+// It returns an error if group is neither a number nor a known group.
+func lookupGid(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		if gid < 0 {
+			return 0, fmt.Errorf("invalid group %q", group)
+		}
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, fmt.Errorf("unknown group %q", group)
+	}
+	return strconv.Atoi(g.Gid)
+}
@@ -1,7 +1,12 @@
 package template
 
 import (
+	"errors"
 	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,101 +18,432 @@ type Processor interface {
 	Process()
 }
 
+// A Rescanner is a Processor that can pick up template resources added to
+// or removed from the confdir without restarting.
+type Rescanner interface {
+	Processor
+	// Rescan re-reads the confdir, starts processing new template
+	// resources and stops processing deleted ones.
+	Rescan() error
+}
+
+// A Reconfigurer is a Processor that can switch to new settings, such as
+// those of a reloaded confd config file, without restarting.
+type Reconfigurer interface {
+	Processor
+	// Reconfigure processes the template resources with config from the
+	// next processing cycle on, every interval seconds for processors
+	// polling the backend.
+	Reconfigure(config Config, interval int)
+}
+
+// Process processes all template resources once. If FirstRunTimeout is set
+// it first waits, up to that many seconds, for the required keys of every
+// resource to appear; resources still missing keys are not rendered.
+// Template resources that cannot be loaded are skipped and the others are
+// still processed.
+// Errors are returned as a *ProcessError; when several resources fail the
+// most severe error is returned.
 func Process(config Config) error {
-	ts, err := getTemplateResources(config)
-	if err != nil {
+	ts, loadErr := getTemplateResources(config)
+	lastErr := newError(ConfigFailure, loadErr)
+	if config.FirstRunTimeout <= 0 {
+		if err := process(ts, config.Concurrency); err != nil && moreSevere(err, lastErr) {
+			return err
+		}
+		return lastErr
+	}
+	var ready []*TemplateResource
+	deadline := time.Now().Add(time.Duration(config.FirstRunTimeout) * time.Second)
+	for _, t := range ts {
+		if err := t.waitForRequiredKeys(deadline); err != nil {
+			log.Error(err.Error())
+			if err := newError(BackendFailure, err); moreSevere(err, lastErr) {
+				lastErr = err
+			}
+			continue
+		}
+		ready = append(ready, t)
+	}
+	if err := process(ready, config.Concurrency); err != nil && moreSevere(err, lastErr) {
 		return err
 	}
-	return process(ts)
+	return lastErr
 }
 
-func process(ts []*TemplateResource) error {
+// process processes every template resource in ts, up to concurrency of
+// them at once, or one at a time if concurrency is not positive. Reload
+// commands run once all of them are processed, once per distinct command,
+// in the order of ts whatever order the resources were processed in.
+// It returns the most severe error encountered, the last one in the order
+// of ts if several are equally severe.
+func process(ts []*TemplateResource, concurrency int) error {
+	batches := make([]*reloadBatch, len(ts))
+	outcomes := make([]outcome, len(ts))
+	errs := make([]error, len(ts))
+	processOne := func(i int) {
+		batches[i] = newReloadBatch()
+		if outcomes[i], errs[i] = ts[i].processBatched(batches[i]); errs[i] != nil {
+			log.Error(errs[i].Error())
+		}
+	}
+	if concurrency <= 1 {
+		for i := range ts {
+			processOne(i)
+		}
+	} else {
+		work := make(chan int)
+		var wg sync.WaitGroup
+		for w := 0; w < concurrency && w < len(ts); w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range work {
+					processOne(i)
+				}
+			}()
+		}
+		for i := range ts {
+			work <- i
+		}
+		close(work)
+		wg.Wait()
+	}
 	var lastErr error
-	for _, t := range ts {
-		if err := t.process(); err != nil {
-			log.Error(err.Error())
+	batch := newReloadBatch()
+	for i, err := range errs {
+		if err != nil && moreSevere(err, lastErr) {
+			lastErr = err
+		}
+		batch.merge(batches[i])
+	}
+	reloadFailed, err := batch.run()
+	if err != nil {
+		log.Error(err.Error())
+		if moreSevere(err, lastErr) {
 			lastErr = err
 		}
 	}
+	var summary cycleSummary
+	for i, t := range ts {
+		if reloadFailed[t] {
+			outcomes[i] = outcomeFailed
+		}
+		summary.add(t, outcomes[i])
+	}
+	log.Info(summary.String())
 	return lastErr
 }
 
 type intervalProcessor struct {
+	mu       sync.Mutex
 	config   Config
 	stopChan chan bool
 	doneChan chan bool
 	errChan  chan error
 	interval int
+	failures failureCounter
+	cycles   cycleState
 }
 
 func IntervalProcessor(config Config, stopChan, doneChan chan bool, errChan chan error, interval int) Processor {
-	return &intervalProcessor{config, stopChan, doneChan, errChan, interval}
+	return &intervalProcessor{
+		config:   config,
+		stopChan: stopChan,
+		doneChan: doneChan,
+		errChan:  errChan,
+		interval: interval,
+		failures: failureCounter{max: config.MaxConsecutiveFailures},
+		cycles:   cycleState{concurrency: config.Concurrency},
+	}
 }
 
 func (p *intervalProcessor) Process() {
 	defer close(p.doneChan)
 	for {
-		ts, err := getTemplateResources(p.config)
-		if err != nil {
-			log.Fatal(err.Error())
-			break
+		config, interval := p.settings()
+		err := p.runLoaded(config)
+		p.mu.Lock()
+		failed := p.failures.record(err)
+		p.mu.Unlock()
+		if failed {
+			log.Fatal(fmt.Sprintf("Exiting after %d consecutive failed processing cycles", p.failures.count))
 		}
-		process(ts)
 		select {
 		case <-p.stopChan:
 			break
-		case <-time.After(time.Duration(p.interval) * time.Second):
+		case <-time.After(time.Duration(interval) * time.Second):
 			continue
 		}
 	}
 }
 
+// settings returns the config and interval of the next processing cycle.
+func (p *intervalProcessor) settings() (Config, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.config, p.interval
+}
+
+// Reconfigure processes the template resources with config, every
+// interval seconds, from the next processing cycle on. The cycle waiting
+// for the current interval to elapse is not brought forward.
+func (p *intervalProcessor) Reconfigure(config Config, interval int) {
+	p.mu.Lock()
+	p.config, p.interval = config, interval
+	p.failures.max = config.MaxConsecutiveFailures
+	p.mu.Unlock()
+	p.cycles.setConcurrency(config.Concurrency)
+}
+
+// Sync reloads the template resources and processes them immediately.
+func (p *intervalProcessor) Sync() error {
+	config, _ := p.settings()
+	return p.runLoaded(config)
+}
+
+// runLoaded loads the template resources with config and processes those
+// that could be loaded as a cycle. No cycle is run if none could be loaded
+// because of an error, such as template resources sharing a dest.
+// It returns the error of the cycle or else the error of loading the
+// template resources, if any.
+func (p *intervalProcessor) runLoaded(config Config) error {
+	ts, loadErr := getTemplateResources(config)
+	if ts == nil && loadErr != nil {
+		log.Error(loadErr.Error())
+		return loadErr
+	}
+	if err := p.cycles.run(ts); err != nil {
+		return err
+	}
+	return loadErr
+}
+
+func (p *intervalProcessor) Status() CycleStatus {
+	return p.cycles.Status()
+}
+
+func (p *intervalProcessor) Dump() map[string]string {
+	return p.cycles.dump()
+}
+
+// failureCounter counts consecutive failed processing cycles. A max of 0
+// means the threshold is never reached.
+type failureCounter struct {
+	max   int
+	count int
+}
+
+// record records the outcome of a processing cycle. Any successful cycle
+// resets the count.
+// It returns true once the number of consecutive failures reaches max.
+func (c *failureCounter) record(err error) bool {
+	if err == nil {
+		c.count = 0
+		return false
+	}
+	c.count++
+	return c.max > 0 && c.count >= c.max
+}
+
 type watchProcessor struct {
-	config   Config
-	stopChan chan bool
-	doneChan chan bool
-	errChan  chan error
-	wg       sync.WaitGroup
+	config    Config
+	stopChan  chan bool
+	doneChan  chan bool
+	errChan   chan error
+	wg        sync.WaitGroup
+	cycles    cycleState
+	mu        sync.Mutex
+	resources map[string]*TemplateResource
+	groups    map[string]*watchGroup
 }
 
 func WatchProcessor(config Config, stopChan, doneChan chan bool, errChan chan error) Processor {
-	var wg sync.WaitGroup
-	return &watchProcessor{config, stopChan, doneChan, errChan, wg}
+	return &watchProcessor{
+		config:    config,
+		stopChan:  stopChan,
+		doneChan:  doneChan,
+		errChan:   errChan,
+		resources: make(map[string]*TemplateResource),
+		cycles:    cycleState{concurrency: config.Concurrency},
+	}
 }
 
 func (p *watchProcessor) Process() {
 	defer close(p.doneChan)
 	ts, err := getTemplateResources(p.config)
-	if err != nil {
-		log.Fatal(err.Error())
-		return
+	if ts == nil && err != nil {
+		log.Error(err.Error())
 	}
+	p.mu.Lock()
+	p.cycles.setResources(ts)
 	for _, t := range ts {
-		t := t
-		p.wg.Add(1)
-		go p.monitorPrefix(t)
+		p.resources[t.configPath] = t
 	}
+	p.regroup()
+	p.mu.Unlock()
+	<-p.stopChan
+	p.mu.Lock()
+	p.resources = make(map[string]*TemplateResource)
+	p.regroup()
+	p.mu.Unlock()
 	p.wg.Wait()
 }
 
-func (p *watchProcessor) monitorPrefix(t *TemplateResource) {
+// Reconfigure stops watching the template resources, then reads them again
+// with config and watches them. If config only changes how resources are
+// processed, such as Concurrency, the template resources keep their watch
+// and state. interval is not used.
+func (p *watchProcessor) Reconfigure(config Config, interval int) {
+	p.mu.Lock()
+	if !reflect.DeepEqual(resourceSettings(p.config), resourceSettings(config)) {
+		p.resources = make(map[string]*TemplateResource)
+		p.regroup()
+	}
+	p.config = config
+	p.mu.Unlock()
+	p.cycles.setConcurrency(config.Concurrency)
+	if err := p.Rescan(); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// resourceSettings returns config without the settings of processors,
+// which template resources do not depend on.
+func resourceSettings(config Config) Config {
+	config.Concurrency = 0
+	config.FirstRunTimeout = 0
+	config.MaxConsecutiveFailures = 0
+	return config
+}
+
+// Rescan re-reads the template resources in the confdir. New template
+// resources are validated and watched, and the watches of deleted ones are
+// stopped; template resources that are still present keep their watch and
+// state, so changes to their resource files need a restart.
+// It returns the last error encountered, if any.
+func (p *watchProcessor) Rescan() error {
+	paths, err := util.RecursiveFilesLookup(p.config.ConfigDir, "*toml")
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var lastErr error
+	found := make(map[string]bool)
+	ts := make([]*TemplateResource, 0, len(paths))
+	for _, path := range paths {
+		found[path] = true
+		if t, ok := p.resources[path]; ok {
+			ts = append(ts, t)
+		}
+	}
+	for path := range p.resources {
+		if !found[path] {
+			log.Info("Removed template resource " + path)
+			delete(p.resources, path)
+		}
+	}
+	for _, path := range paths {
+		if _, ok := p.resources[path]; ok {
+			continue
+		}
+		t, err := NewTemplateResource(path, p.config)
+		if err == nil {
+			_, err = t.renderer()
+		}
+		if err == nil {
+			err = checkDestConflicts(append(ts[:len(ts):len(ts)], t), p.config.AllowDuplicateDest)
+		}
+		if err != nil {
+			log.Error(fmt.Sprintf("Rejected template resource %s: %s", path, err))
+			lastErr = err
+			continue
+		}
+		log.Info("Added template resource " + path)
+		p.resources[path] = t
+		ts = append(ts, t)
+	}
+	p.regroup()
+	p.cycles.setResources(ts)
+	return lastErr
+}
+
+// regroup groups the watched template resources by nested prefix. Groups
+// whose members are unchanged keep their watch; the watches of other
+// groups are stopped and new ones started, fetching the keys of their
+// members once. p.mu must be held.
+func (p *watchProcessor) regroup() {
+	paths := make([]string, 0, len(p.resources))
+	for path := range p.resources {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	ts := make([]*TemplateResource, len(paths))
+	for i, path := range paths {
+		ts[i] = p.resources[path]
+	}
+	groups := groupWatches(ts)
+	for prefix, g := range p.groups {
+		if ng, ok := groups[prefix]; ok && sameMembers(g, ng) {
+			groups[prefix] = g
+			continue
+		}
+		close(g.stop)
+	}
+	for _, g := range groups {
+		if g.stop != nil {
+			continue
+		}
+		log.Debug(fmt.Sprintf("Watching %s for %d template resources", g.prefix, len(g.members)))
+		g.stop = make(chan bool)
+		p.wg.Add(1)
+		go p.monitorPrefix(g)
+	}
+	p.groups = groups
+}
+
+// monitorPrefix watches the prefix of g until g.stop is closed, processing
+// every member of g on each change.
+func (p *watchProcessor) monitorPrefix(g *watchGroup) {
 	defer p.wg.Done()
-	keys := util.AppendPrefix(t.Prefix, t.Keys)
+	storeClient := g.members[0].storeClient
+	var lastIndex uint64
 	for {
-		index, err := t.storeClient.WatchPrefix(t.Prefix, keys, t.lastIndex, p.stopChan)
+		index, err := storeClient.WatchPrefix(g.prefix, g.keys, lastIndex, g.stop)
+		select {
+		case <-g.stop:
+			return
+		default:
+		}
 		if err != nil {
 			p.errChan <- err
 			// Prevent backend errors from consuming all resources.
-			time.Sleep(time.Second * 2)
+			select {
+			case <-g.stop:
+				return
+			case <-time.After(time.Second * 2):
+			}
 			continue
 		}
-		t.lastIndex = index
-		if err := t.process(); err != nil {
-			p.errChan <- err
-		}
+		lastIndex = index
+		p.cycles.runGroup(g.members, p.errChan)
 	}
 }
 
+// Sync processes all watched template resources immediately.
+func (p *watchProcessor) Sync() error {
+	return p.cycles.run(nil)
+}
+
+func (p *watchProcessor) Status() CycleStatus {
+	return p.cycles.Status()
+}
+
+func (p *watchProcessor) Dump() map[string]string {
+	return p.cycles.dump()
+}
+
 func getTemplateResources(config Config) ([]*TemplateResource, error) {
 	var lastError error
 	templates := make([]*TemplateResource, 0)
@@ -129,10 +465,79 @@ func getTemplateResources(config Config) ([]*TemplateResource, error) {
 		log.Debug(fmt.Sprintf("Found template: %s", p))
 		t, err := NewTemplateResource(p, config)
 		if err != nil {
+			log.Error(err.Error())
 			lastError = err
 			continue
 		}
 		templates = append(templates, t)
 	}
+	if err := checkDestConflicts(templates, config.AllowDuplicateDest); err != nil {
+		return nil, err
+	}
+	setResources(templates)
 	return templates, lastError
 }
+
+// destConflicts returns the resource files of the template resources in
+// ts, sorted, by the dest they share with another one. Template resources
+// writing to standard output or rendering a matrix never conflict.
+func destConflicts(ts []*TemplateResource) map[string][]string {
+	byDest := make(map[string][]string)
+	for _, t := range ts {
+		if t.Dest == StdoutDest || t.Matrix != "" {
+			continue
+		}
+		dest := filepath.Clean(t.Dest)
+		byDest[dest] = append(byDest[dest], t.configPath)
+	}
+	for dest, paths := range byDest {
+		if len(paths) < 2 {
+			delete(byDest, dest)
+			continue
+		}
+		sort.Strings(paths)
+	}
+	return byDest
+}
+
+// checkDestConflicts reports template resources in ts sharing a dest, which
+// would overwrite each other on every cycle. With allow set conflicts are
+// logged as warnings instead.
+// It returns an error listing the conflicting resource files, if any.
+func checkDestConflicts(ts []*TemplateResource, allow bool) error {
+	conflicts := destConflicts(ts)
+	if len(conflicts) == 0 {
+		return nil
+	}
+	dests := make([]string, 0, len(conflicts))
+	for dest := range conflicts {
+		dests = append(dests, dest)
+	}
+	sort.Strings(dests)
+	var msgs []string
+	for _, dest := range dests {
+		msgs = append(msgs, fmt.Sprintf("%s is the dest of %s", dest, strings.Join(conflicts[dest], ", ")))
+	}
+	if allow {
+		for _, msg := range msgs {
+			log.Warning("Conflicting template resources: " + msg)
+		}
+		return nil
+	}
+	return errors.New("Conflicting template resources: " + strings.Join(msgs, "; "))
+}
+
+// setResources makes the resources template function of every template
+// resource in ts describe all of them, sorted by name.
+func setResources(ts []*TemplateResource) {
+	infos := make([]ResourceInfo, 0, len(ts))
+	for _, t := range ts {
+		infos = append(infos, t.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	for _, t := range ts {
+		addFuncs(t.funcMap, map[string]interface{}{
+			"resources": func() []ResourceInfo { return infos },
+		})
+	}
+}
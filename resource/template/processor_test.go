@@ -0,0 +1,927 @@
+package template
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/confd/log"
+	util "github.com/kelseyhightower/confd/util"
+)
+
+func TestFailureCounterThreshold(t *testing.T) {
+	c := failureCounter{max: 3}
+	failed := errors.New("backend unavailable")
+	for i := 1; i < 3; i++ {
+		if c.record(failed) {
+			t.Fatalf("threshold reached after %d failures, want 3", i)
+		}
+	}
+	if !c.record(failed) {
+		t.Errorf("threshold not reached after 3 consecutive failures")
+	}
+}
+
+func TestFailureCounterResetOnSuccess(t *testing.T) {
+	c := failureCounter{max: 2}
+	failed := errors.New("backend unavailable")
+	c.record(failed)
+	if c.record(nil) {
+		t.Errorf("threshold reached on a successful cycle")
+	}
+	if c.count != 0 {
+		t.Errorf("count = %d after a successful cycle, want 0", c.count)
+	}
+	if c.record(failed) {
+		t.Errorf("threshold reached after 1 failure following a reset")
+	}
+	if !c.record(failed) {
+		t.Errorf("threshold not reached after 2 consecutive failures")
+	}
+}
+
+func TestFailureCounterDisabled(t *testing.T) {
+	c := failureCounter{}
+	failed := errors.New("backend unavailable")
+	for i := 0; i < 100; i++ {
+		if c.record(failed) {
+			t.Fatalf("threshold reached with max 0")
+		}
+	}
+}
+
+func TestProcessIsolatesResourceFailures(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	resources := map[string]string{
+		"a":   `{{getv "/a"}}`,
+		"bad": `{{getv "/missing"}}`,
+		"c":   `{{getv "/c"}}`,
+	}
+	for name, tmpl := range resources {
+		resourceToml := `
+[template]
+src = "` + name + `.tmpl"
+dest = "` + filepath.Join(confDir, name+".conf") + `"
+keys = ["/"]
+`
+		if err := ioutil.WriteFile(filepath.Join(confDir, "conf.d", name+".toml"), []byte(resourceToml), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := ioutil.WriteFile(filepath.Join(confDir, "templates", name+".tmpl"), []byte(tmpl), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	storeClient := &mockStoreClient{values: map[string]string{"/a": "1", "/c": "3"}}
+
+	if err := Process(testConfig(confDir, storeClient)); err == nil {
+		t.Errorf("Process() returned no error although one resource failed")
+	}
+	for name, want := range map[string]string{"a": "1", "c": "3"} {
+		got, err := ioutil.ReadFile(filepath.Join(confDir, name+".conf"))
+		if err != nil {
+			t.Errorf("%s.conf was not written: %s", name, err.Error())
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("%s.conf = %q, want %q", name, string(got), want)
+		}
+	}
+	if util.IsFileExist(filepath.Join(confDir, "bad.conf")) {
+		t.Errorf("bad.conf was written although its template failed")
+	}
+}
+
+func TestProcessSkipsInvalidResources(t *testing.T) {
+	log.SetLevel("fatal")
+	defer log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	for name, mode := range map[string]string{"a": "0644", "badmode": "0999"} {
+		resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + filepath.Join(confDir, name+".conf") + `"
+keys = ["/"]
+mode = "` + mode + `"
+`
+		if err := ioutil.WriteFile(filepath.Join(confDir, "conf.d", name+".toml"), []byte(resourceToml), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(confDir, "templates", "test.tmpl"), []byte(`{{getv "/a"}}`), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	config := testConfig(confDir, &mockStoreClient{values: map[string]string{"/a": "1"}})
+	dest := filepath.Join(confDir, "a.conf")
+
+	err = Process(config)
+	if Kind(err) != ConfigFailure || !strings.Contains(err.Error(), "badmode.toml") {
+		t.Errorf("Process() = %v, want a config failure of badmode.toml", err)
+	}
+	if got, err := ioutil.ReadFile(dest); err != nil || string(got) != "1" {
+		t.Errorf("a.conf = %q, %v, want it rendered despite badmode.toml", string(got), err)
+	}
+
+	os.Remove(dest)
+	p := IntervalProcessor(config, make(chan bool), make(chan bool), make(chan error, 10), 60).(*intervalProcessor)
+	if err := p.Sync(); err == nil || !strings.Contains(err.Error(), "badmode.toml") {
+		t.Errorf("Sync() = %v, want the error of badmode.toml", err)
+	}
+	if got, err := ioutil.ReadFile(dest); err != nil || string(got) != "1" {
+		t.Errorf("a.conf = %q, %v after Sync(), want it rendered despite badmode.toml", string(got), err)
+	}
+}
+
+func TestProcessLogsSummary(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetLevel("info")
+	defer func() {
+		log.SetLevel("warn")
+		log.SetOutput(os.Stderr)
+	}()
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	for name, tmpl := range map[string]string{"a": `{{getv "/a"}}`, "b": `{{getv "/b"}}`, "bad": `{{getv "/missing"}}`} {
+		resourceToml := `
+[template]
+src = "` + name + `.tmpl"
+dest = "` + filepath.Join(confDir, name+".conf") + `"
+keys = ["/"]
+`
+		if err := ioutil.WriteFile(filepath.Join(confDir, "conf.d", name+".toml"), []byte(resourceToml), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := ioutil.WriteFile(filepath.Join(confDir, "templates", name+".tmpl"), []byte(tmpl), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	storeClient := &mockStoreClient{values: map[string]string{"/a": "1", "/b": "2"}}
+	config := testConfig(confDir, storeClient)
+
+	for _, tt := range []struct {
+		desc string
+		noop bool
+		set  string
+		want string
+	}{
+		{"first run", false, "", "Processed 3 resources: 2 updated, 0 unchanged, 1 failed"},
+		{"no change", false, "", "Processed 3 resources: 0 updated, 2 unchanged, 1 failed"},
+		{"noop", true, "/a", "Processed 3 resources: 1 would update, 1 unchanged, 1 failed"},
+	} {
+		buf.Reset()
+		if tt.set != "" {
+			storeClient.set(tt.set, "changed")
+		}
+		config.Noop = tt.noop
+		Process(config)
+		if !strings.Contains(buf.String(), tt.want) {
+			t.Errorf("%s: logged\n%s\nwant %q", tt.desc, buf.String(), tt.want)
+		}
+	}
+}
+
+func TestResourcesFunc(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	resources := map[string][2]string{
+		"app": {`
+prefix = "/production"
+keys = ["/app"]
+reload_cmd = "echo secret-token"
+`, `{{getv "/app/port"}}`},
+		"manifest": {`
+keys = ["/"]
+`, `{{range resources}}{{.Name}} {{.Dest}} {{.Prefix}} {{join .Keys ","}}
+{{end}}`},
+	}
+	for name, r := range resources {
+		resourceToml := `
+[template]
+src = "` + name + `.tmpl"
+dest = "` + filepath.Join(confDir, name+".conf") + `"
+` + r[0]
+		if err := ioutil.WriteFile(filepath.Join(confDir, "conf.d", name+".toml"), []byte(resourceToml), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := ioutil.WriteFile(filepath.Join(confDir, "templates", name+".tmpl"), []byte(r[1]), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	storeClient := &mockStoreClient{values: map[string]string{"/production/app/port": "80"}}
+
+	if err := Process(testConfig(confDir, storeClient)); err != nil {
+		t.Fatal(err.Error())
+	}
+	got, err := ioutil.ReadFile(filepath.Join(confDir, "manifest.conf"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := "app " + filepath.Join(confDir, "app.conf") + " /production /app\n" +
+		"manifest " + filepath.Join(confDir, "manifest.conf") + " / /\n"
+	if string(got) != want {
+		t.Errorf("manifest = %q, want %q", string(got), want)
+	}
+}
+
+func TestWatchProcessorRescan(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	writeResource := func(name, tmpl string) string {
+		resourceToml := `
+[template]
+src = "` + name + `.tmpl"
+dest = "` + filepath.Join(confDir, name+".conf") + `"
+keys = ["/"]
+`
+		path := filepath.Join(confDir, "conf.d", name+".toml")
+		if err := ioutil.WriteFile(path, []byte(resourceToml), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := ioutil.WriteFile(filepath.Join(confDir, "templates", name+".tmpl"), []byte(tmpl), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		return path
+	}
+	watching := func(p *watchProcessor) map[string]*TemplateResource {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		ts := make(map[string]*TemplateResource)
+		for path, t := range p.resources {
+			ts[path] = t
+		}
+		return ts
+	}
+
+	a := writeResource("a", `{{getv "/a"}}`)
+	config := testConfig(confDir, &mockStoreClient{values: map[string]string{"/a": "1"}})
+	p := WatchProcessor(config, make(chan bool), make(chan bool), make(chan error, 10)).(*watchProcessor)
+	if err := p.Rescan(); err != nil {
+		t.Fatal(err.Error())
+	}
+	first := watching(p)[a]
+	if first == nil {
+		t.Fatalf("%s is not watched after the first rescan", a)
+	}
+
+	b := writeResource("b", `{{getv "/b"}}`)
+	writeResource("bad", `{{getv "/b"`)
+	if err := p.Rescan(); err == nil {
+		t.Errorf("Rescan() returned no error although bad.toml has an invalid template")
+	}
+	ts := watching(p)
+	if len(ts) != 2 || ts[b] == nil {
+		t.Errorf("watching %v after adding b.toml, want a.toml and b.toml", ts)
+	}
+	if ts[a] != first {
+		t.Errorf("rescan replaced the unchanged template resource %s", a)
+	}
+	if len(p.cycles.ts) != 2 {
+		t.Errorf("cycle resources = %d, want 2", len(p.cycles.ts))
+	}
+
+	for _, path := range []string{a, b, filepath.Join(confDir, "conf.d", "bad.toml")} {
+		if err := os.Remove(path); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := p.Rescan(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if ts := watching(p); len(ts) != 0 {
+		t.Errorf("watching %v after removing every resource file, want none", ts)
+	}
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("watches of removed template resources did not stop")
+	}
+}
+
+// firstWatchClient triggers the first fetch of every watch, then waits
+// for the watch to stop.
+type firstWatchClient struct {
+	*mockStoreClient
+}
+
+func (c *firstWatchClient) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	if waitIndex == 0 {
+		return 1, nil
+	}
+	<-stopChan
+	return 0, nil
+}
+
+func TestRescanWithFullErrChan(t *testing.T) {
+	log.SetLevel("panic")
+	defer log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("bad%d", i)
+		resourceToml := `
+[template]
+src = "bad.tmpl"
+dest = "` + filepath.Join(confDir, name+".conf") + `"
+keys = ["/"]
+`
+		if err := ioutil.WriteFile(filepath.Join(confDir, "conf.d", name+".toml"), []byte(resourceToml), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(confDir, "templates", "bad.tmpl"), []byte(`{{getv "/missing"}}`), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	config := testConfig(confDir, &firstWatchClient{&mockStoreClient{values: map[string]string{}}})
+	// The processor's errors are only read once Rescan returns, as confd
+	// reads them from the goroutine handling SIGHUP.
+	errChan := make(chan error, 1)
+	p := WatchProcessor(config, make(chan bool), make(chan bool), errChan).(*watchProcessor)
+	if err := p.Rescan(); err != nil {
+		t.Fatal(err.Error())
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(errChan) < cap(errChan) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.Rescan()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Rescan() blocked behind a watch sending errors to the full errChan")
+	}
+
+	go func() {
+		for range errChan {
+		}
+	}()
+	p.mu.Lock()
+	p.resources = make(map[string]*TemplateResource)
+	p.regroup()
+	p.mu.Unlock()
+	p.wg.Wait()
+	close(errChan)
+}
+
+func TestReconfigure(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	resourceToml := `
+[template]
+src = "a.tmpl"
+dest = "` + filepath.Join(confDir, "a.conf") + `"
+keys = ["/a"]
+`
+	path := filepath.Join(confDir, "conf.d", "a.toml")
+	if err := ioutil.WriteFile(path, []byte(resourceToml), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ioutil.WriteFile(filepath.Join(confDir, "templates", "a.tmpl"), []byte(`{{getv "/a"}}`), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	oldClient := &mockStoreClient{values: map[string]string{"/a": "1"}}
+	newClient := &mockStoreClient{values: map[string]string{"/dev/a": "2"}}
+	newConfig := testConfig(confDir, newClient)
+	newConfig.Prefix = "/dev"
+	newConfig.Concurrency = 4
+
+	interval := IntervalProcessor(testConfig(confDir, oldClient), make(chan bool), make(chan bool), make(chan error, 10), 600).(*intervalProcessor)
+	interval.Reconfigure(newConfig, 5)
+	if config, n := interval.settings(); config.Prefix != "/dev" || n != 5 {
+		t.Errorf("settings() = prefix %q, interval %d, want /dev and 5", config.Prefix, n)
+	}
+	if interval.cycles.concurrency != 4 {
+		t.Errorf("concurrency = %d, want 4", interval.cycles.concurrency)
+	}
+	if err := interval.Sync(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(confDir, "a.conf")); string(got) != "2" {
+		t.Errorf("dest = %q after Sync, want it rendered from the new prefix and backend", string(got))
+	}
+
+	watch := WatchProcessor(testConfig(confDir, oldClient), make(chan bool), make(chan bool), make(chan error, 10)).(*watchProcessor)
+	if err := watch.Rescan(); err != nil {
+		t.Fatal(err.Error())
+	}
+	watch.Reconfigure(newConfig, 0)
+	watch.mu.Lock()
+	tr := watch.resources[path]
+	watch.mu.Unlock()
+	if tr == nil {
+		t.Fatalf("%s is not watched after Reconfigure", path)
+	}
+	if tr.Prefix != "/dev" {
+		t.Errorf("prefix = %q after Reconfigure, want /dev", tr.Prefix)
+	}
+	if tr.storeClient != newClient {
+		t.Errorf("resource still uses the previous backend after Reconfigure")
+	}
+
+	newConfig.Concurrency = 2
+	watch.Reconfigure(newConfig, 0)
+	watch.mu.Lock()
+	kept := watch.resources[path]
+	watch.mu.Unlock()
+	if kept != tr {
+		t.Errorf("Reconfigure with only a new concurrency read %s again, want it to keep its watch and state", path)
+	}
+	if watch.cycles.concurrency != 2 {
+		t.Errorf("concurrency = %d, want 2", watch.cycles.concurrency)
+	}
+}
+
+func TestDestConflicts(t *testing.T) {
+	log.SetLevel("warn")
+	tests := []struct {
+		desc      string
+		dests     map[string]string
+		allow     bool
+		wantError bool
+	}{
+		{"distinct dests", map[string]string{"a": "a.conf", "b": "b.conf", "c": "c.conf"}, false, false},
+		{"stdout is shared", map[string]string{"a": "-", "b": "-"}, false, false},
+		{"shared dest", map[string]string{"a": "a.conf", "b": "shared.conf", "c": "./shared.conf"}, false, true},
+		{"shared dest allowed", map[string]string{"a": "shared.conf", "b": "shared.conf"}, true, false},
+	}
+	for _, tt := range tests {
+		confDir, err := createTempDirs()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer os.RemoveAll(confDir)
+		for name, dest := range tt.dests {
+			if dest != StdoutDest {
+				dest = filepath.Join(confDir, dest)
+			}
+			resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/"]
+`
+			if err := ioutil.WriteFile(filepath.Join(confDir, "conf.d", name+".toml"), []byte(resourceToml), 0644); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		config := testConfig(confDir, &mockStoreClient{})
+		config.AllowDuplicateDest = tt.allow
+		ts, err := getTemplateResources(config)
+		if tt.wantError {
+			if err == nil {
+				t.Errorf("%s: getTemplateResources() returned no error", tt.desc)
+				continue
+			}
+			for _, name := range []string{"b.toml", "c.toml", "shared.conf"} {
+				if !strings.Contains(err.Error(), name) {
+					t.Errorf("%s: error %q does not mention %s", tt.desc, err.Error(), name)
+				}
+			}
+			if strings.Contains(err.Error(), "a.toml") {
+				t.Errorf("%s: error %q mentions a.toml which does not conflict", tt.desc, err.Error())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: getTemplateResources() returned %s", tt.desc, err.Error())
+		}
+		if len(ts) != len(tt.dests) {
+			t.Errorf("%s: loaded %d template resources, want %d", tt.desc, len(ts), len(tt.dests))
+		}
+	}
+}
+
+func TestGroupWatches(t *testing.T) {
+	resource := func(prefix string, keys ...string) *TemplateResource {
+		return &TemplateResource{Prefix: prefix, Keys: keys}
+	}
+	app := resource("/app", "/")
+	db := resource("/app/db", "/host", "/port")
+	web := resource("/app/web", "/")
+	dbReplica := resource("/app/db", "/host")
+	application := resource("/application", "/")
+	other := resource("/other", "/")
+
+	groups := groupWatches([]*TemplateResource{db, app, web, dbReplica, application, other})
+	if len(groups) != 3 {
+		t.Fatalf("groupWatches() returned %d groups, want 3", len(groups))
+	}
+	g := groups["/app"]
+	if g == nil {
+		t.Fatalf("groupWatches() has no group for /app: %v", groups)
+	}
+	wantMembers := []*TemplateResource{db, app, web, dbReplica}
+	if !sameMembers(g, &watchGroup{members: wantMembers}) {
+		t.Errorf("/app members = %v, want %v", g.members, wantMembers)
+	}
+	wantKeys := []string{"/app/db/host", "/app/db/port", "/app", "/app/web"}
+	if !reflect.DeepEqual(g.keys, wantKeys) {
+		t.Errorf("/app keys = %v, want %v", g.keys, wantKeys)
+	}
+	for _, prefix := range []string{"/application", "/other"} {
+		if g := groups[prefix]; g == nil || len(g.members) != 1 {
+			t.Errorf("group %s = %v, want a single member", prefix, g)
+		}
+	}
+
+	root := resource("/", "/")
+	if groups := groupWatches([]*TemplateResource{app, other, root}); len(groups) != 1 || groups["/"] == nil {
+		t.Errorf("groupWatches() with a root prefix = %v, want a single / group", groups)
+	}
+}
+
+// watchCountingClient counts the backend watches in progress by prefix.
+type watchCountingClient struct {
+	*mockStoreClient
+	mu      sync.Mutex
+	watches map[string]int
+}
+
+func (c *watchCountingClient) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	c.mu.Lock()
+	c.watches[prefix]++
+	c.mu.Unlock()
+	<-stopChan
+	c.mu.Lock()
+	c.watches[prefix]--
+	c.mu.Unlock()
+	return 0, nil
+}
+
+func (c *watchCountingClient) count() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	watches := make(map[string]int)
+	for prefix, n := range c.watches {
+		if n > 0 {
+			watches[prefix] = n
+		}
+	}
+	return watches
+}
+
+func TestWatchProcessorGroupsNestedPrefixes(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	prefixes := map[string]string{"app": "/app", "db": "/app/db", "web": "/app/web", "other": "/other"}
+	for name, prefix := range prefixes {
+		resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + filepath.Join(confDir, name+".conf") + `"
+prefix = "` + prefix + `"
+keys = ["/"]
+`
+		if err := ioutil.WriteFile(filepath.Join(confDir, "conf.d", name+".toml"), []byte(resourceToml), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(confDir, "templates", "test.tmpl"), []byte("ok\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	storeClient := &watchCountingClient{mockStoreClient: &mockStoreClient{values: map[string]string{}}, watches: make(map[string]int)}
+	stopChan, doneChan := make(chan bool), make(chan bool)
+	p := WatchProcessor(testConfig(confDir, storeClient), stopChan, doneChan, make(chan error, 10))
+	go p.Process()
+
+	want := map[string]int{"/app": 1, "/other": 1}
+	deadline := time.Now().Add(5 * time.Second)
+	for !reflect.DeepEqual(storeClient.count(), want) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := storeClient.count(); !reflect.DeepEqual(got, want) {
+		t.Errorf("backend watches = %v, want %v", got, want)
+	}
+
+	close(stopChan)
+	select {
+	case <-doneChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Process() did not return after stopping")
+	}
+	if got := storeClient.count(); len(got) != 0 {
+		t.Errorf("backend watches after stopping = %v, want none", got)
+	}
+}
+
+// droppingWatchClient fails the second watch, as if the connection to the
+// backend dropped, and records the index every watch resumes from.
+type droppingWatchClient struct {
+	*mockStoreClient
+	mu          sync.Mutex
+	waitIndexes []uint64
+}
+
+func (c *droppingWatchClient) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	c.mu.Lock()
+	c.waitIndexes = append(c.waitIndexes, waitIndex)
+	n := len(c.waitIndexes)
+	c.mu.Unlock()
+	switch n {
+	case 1:
+		return 5, nil
+	case 2:
+		return waitIndex, errors.New("connection reset by peer")
+	}
+	<-stopChan
+	return waitIndex, nil
+}
+
+func (c *droppingWatchClient) indexes() []uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]uint64(nil), c.waitIndexes...)
+}
+
+func TestWatchProcessorResumesAfterDroppedWatch(t *testing.T) {
+	log.SetLevel("panic")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	storeClient := &droppingWatchClient{mockStoreClient: &mockStoreClient{values: map[string]string{"/app/port": "8080"}}}
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + filepath.Join(confDir, "test.conf") + `"
+keys = ["/app"]
+`
+	newTestResource(t, confDir, resourceToml, `port = {{getv "/app/port"}}`, storeClient)
+	stopChan, doneChan, errChan := make(chan bool), make(chan bool), make(chan error, 10)
+	p := WatchProcessor(testConfig(confDir, storeClient), stopChan, doneChan, errChan)
+	go p.Process()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for len(storeClient.indexes()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stopChan)
+	<-doneChan
+
+	if got, want := storeClient.indexes(), []uint64{0, 5, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("watches resumed from indexes %v, want %v", got, want)
+	}
+	select {
+	case err := <-errChan:
+		if !strings.Contains(err.Error(), "connection reset") {
+			t.Errorf("reported error %q, want the dropped watch", err.Error())
+		}
+	default:
+		t.Error("the dropped watch was not reported")
+	}
+}
+
+func TestProcessSharedReloadCmd(t *testing.T) {
+	log.SetLevel("warn")
+	for _, perResource := range []bool{false, true} {
+		confDir, err := createTempDirs()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer os.RemoveAll(confDir)
+
+		reloads := filepath.Join(confDir, "reloads")
+		for _, name := range []string{"a", "b", "c"} {
+			resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + filepath.Join(confDir, name+".conf") + `"
+keys = ["/app"]
+reload_cmd = "echo reload >> ` + reloads + `"
+`
+			if err := ioutil.WriteFile(filepath.Join(confDir, "conf.d", name+".toml"), []byte(resourceToml), 0644); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + filepath.Join(confDir, "other.conf") + `"
+keys = ["/app"]
+reload_cmd = "echo other >> ` + reloads + `"
+`
+		if err := ioutil.WriteFile(filepath.Join(confDir, "conf.d", "other.toml"), []byte(resourceToml), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := ioutil.WriteFile(filepath.Join(confDir, "templates", "test.tmpl"), []byte(`port = {{getv "/app/port"}}`), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		config := testConfig(confDir, &mockStoreClient{values: map[string]string{"/app/port": "80"}})
+		config.ReloadPerResource = perResource
+		if err := Process(config); err != nil {
+			t.Fatal(err.Error())
+		}
+		got, err := ioutil.ReadFile(reloads)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		want := "reload\nother\n"
+		if perResource {
+			want = "reload\nreload\nreload\nother\n"
+		}
+		if string(got) != want {
+			t.Errorf("reload_per_resource = %t: reloads = %q, want %q", perResource, string(got), want)
+		}
+	}
+}
+
+func TestSharedReloadFailureFailsResources(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetLevel("info")
+	defer func() {
+		log.SetLevel("warn")
+		log.SetOutput(os.Stderr)
+	}()
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	for name, reloadCmd := range map[string]string{"a": "exit 1", "b": "exit 1", "c": "true"} {
+		resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + filepath.Join(confDir, name+".conf") + `"
+keys = ["/app"]
+reload_cmd = "` + reloadCmd + `"
+`
+		if err := ioutil.WriteFile(filepath.Join(confDir, "conf.d", name+".toml"), []byte(resourceToml), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(confDir, "templates", "test.tmpl"), []byte(`port = {{getv "/app/port"}}`), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	storeClient := &mockStoreClient{values: map[string]string{"/app/port": "80"}}
+	config := testConfig(confDir, storeClient)
+	want := "Processed 3 resources: 1 updated, 0 unchanged, 2 failed"
+
+	if err := Process(config); Kind(err) != ReloadFailure {
+		t.Errorf("Process() = %v, want a reload failure", err)
+	}
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("interval cycle logged\n%s\nwant %q", buf.String(), want)
+	}
+
+	// Watched resources are processed by runGroup.
+	buf.Reset()
+	storeClient.set("/app/port", "8080")
+	ts, err := getTemplateResources(config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var c cycleState
+	errChan := make(chan error, 10)
+	c.runGroup(ts, errChan)
+	if len(errChan) != 1 || Kind(<-errChan) != ReloadFailure {
+		t.Errorf("runGroup() did not report the failed reload_cmd")
+	}
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("watch cycle logged\n%s\nwant %q", buf.String(), want)
+	}
+	if status := c.Status(); Kind(status.Err) != ReloadFailure {
+		t.Errorf("Status().Err = %v, want a reload failure", status.Err)
+	}
+}
+
+// slowClient counts how many fetches are in flight at once, each taking
+// 20ms.
+type slowClient struct {
+	client      *mockStoreClient
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+func (c *slowClient) GetValues(keys []string) (map[string]string, error) {
+	c.mu.Lock()
+	c.inFlight++
+	if c.inFlight > c.maxInFlight {
+		c.maxInFlight = c.inFlight
+	}
+	c.mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	c.mu.Lock()
+	c.inFlight--
+	c.mu.Unlock()
+	return c.client.GetValues(keys)
+}
+
+func (c *slowClient) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	return c.client.WatchPrefix(prefix, keys, waitIndex, stopChan)
+}
+
+func TestProcessConcurrency(t *testing.T) {
+	log.SetLevel("warn")
+	for _, concurrency := range []int{1, 3} {
+		confDir, err := createTempDirs()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer os.RemoveAll(confDir)
+
+		reloads := filepath.Join(confDir, "reloads")
+		names := []string{"a", "b", "bad", "c", "d", "e"}
+		for _, name := range names {
+			reloadCmd := "echo shared >> " + reloads
+			if name == "e" {
+				reloadCmd = "echo e >> " + reloads
+			}
+			resourceToml := `
+[template]
+src = "` + name + `.tmpl"
+dest = "` + filepath.Join(confDir, name+".conf") + `"
+keys = ["/app"]
+reload_cmd = "` + reloadCmd + `"
+`
+			tmpl := `port = {{getv "/app/port"}}`
+			if name == "bad" {
+				tmpl = `{{getv "/app/missing"}}`
+			}
+			if err := ioutil.WriteFile(filepath.Join(confDir, "conf.d", name+".toml"), []byte(resourceToml), 0644); err != nil {
+				t.Fatal(err.Error())
+			}
+			if err := ioutil.WriteFile(filepath.Join(confDir, "templates", name+".tmpl"), []byte(tmpl), 0644); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		storeClient := &slowClient{client: &mockStoreClient{values: map[string]string{"/app/port": "80"}}}
+		config := testConfig(confDir, storeClient)
+		config.Concurrency = concurrency
+
+		if err := Process(config); err == nil || !strings.Contains(err.Error(), "bad.tmpl") {
+			t.Errorf("concurrency %d: Process() = %v, want the error of bad.tmpl", concurrency, err)
+		}
+		if storeClient.maxInFlight != concurrency {
+			t.Errorf("concurrency %d: %d fetches ran at once", concurrency, storeClient.maxInFlight)
+		}
+		for _, name := range names {
+			if _, err := os.Stat(filepath.Join(confDir, name+".conf")); (err == nil) == (name == "bad") {
+				t.Errorf("concurrency %d: %s.conf written = %t", concurrency, name, err == nil)
+			}
+		}
+		if got, err := ioutil.ReadFile(reloads); err != nil || string(got) != "shared\ne\n" {
+			t.Errorf("concurrency %d: reloads = %q, %v, want %q", concurrency, string(got), err, "shared\ne\n")
+		}
+	}
+}
@@ -2,17 +2,22 @@ package template
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/kelseyhightower/confd/backends"
@@ -23,15 +28,35 @@ import (
 )
 
 type Config struct {
-	ConfDir       string `toml:"confdir"`
-	ConfigDir     string
-	KeepStageFile bool
-	Noop          bool   `toml:"noop"`
-	Prefix        string `toml:"prefix"`
-	StoreClient   backends.StoreClient
-	SyncOnly      bool `toml:"sync-only"`
-	TemplateDir   string
-	PGPPrivateKey []byte
+	AllowDuplicateDest     bool   `toml:"allow_duplicate_dest"`
+	BackupFormat           string `toml:"backup_format"`
+	BackupSuffix           string `toml:"backup_suffix"`
+	Backups                int    `toml:"backups"`
+	CompareMethod          string `toml:"compare_method"`
+	Concurrency            int    `toml:"concurrency"`
+	ConfDir                string `toml:"confdir"`
+	ConfigDir              string
+	DefaultMode            string `toml:"default_mode"`
+	DryRun                 bool   `toml:"dry_run"`
+	TemplateErrorContext   int    `toml:"template_error_context"`
+	FirstRunTimeout        int    `toml:"first_run_timeout"`
+	KeepStageFile          bool
+	LockDest               bool     `toml:"lock_dest"`
+	MaxConcurrentReloads   int      `toml:"max_concurrent_reloads"`
+	MaxDepth               int      `toml:"max_depth"`
+	MaxConsecutiveFailures int      `toml:"max_consecutive_failures"`
+	NoFollowSymlinks       bool     `toml:"no_follow_symlinks"`
+	Noop                   bool     `toml:"noop"`
+	Prefix                 string   `toml:"prefix"`
+	SecretKeys             []string `toml:"secret_keys"`
+	ShadowRoot             string   `toml:"shadow_root"`
+	SkipOnEmpty            bool     `toml:"skip_on_empty"`
+	StoreClient            backends.StoreClient
+	SyncOnly               bool `toml:"sync-only"`
+	TemplateDir            string
+	Umask                  string `toml:"umask"`
+	PGPPrivateKey          []byte
+	ReloadPerResource      bool `toml:"reload_per_resource"`
 }
 
 // TemplateResourceConfig holds the parsed template resource.
@@ -41,29 +66,145 @@ type TemplateResourceConfig struct {
 
 // TemplateResource is the representation of a parsed template resource.
 type TemplateResource struct {
-	CheckCmd      string `toml:"check_cmd"`
-	Dest          string
-	FileMode      os.FileMode
-	Gid           int
-	Keys          []string
-	Mode          string
-	Prefix        string
-	ReloadCmd     string `toml:"reload_cmd"`
-	Src           string
-	StageFile     *os.File
-	Uid           int
-	funcMap       map[string]interface{}
-	lastIndex     uint64
-	keepStageFile bool
-	noop          bool
-	store         memkv.Store
-	storeClient   backends.StoreClient
-	syncOnly      bool
-	PGPPrivateKey []byte
+	AllOrNothing      bool   `toml:"matrix_all_or_nothing"`
+	BackupFormat      string `toml:"backup_format"`
+	BackupSuffix      string `toml:"backup_suffix"`
+	Backups           int    `toml:"backups"`
+	CheckAttempts     int    `toml:"check_attempts"`
+	CheckCmd          string `toml:"check_cmd"`
+	CheckDelay        string `toml:"check_delay"`
+	DeleteOnMissing   string `toml:"delete_on_missing"`
+	Delims            []string
+	Dest              string
+	Env               map[string]string
+	FileMode          os.FileMode
+	Format            string
+	Gid               int
+	Group             string
+	IgnoreMissingKeys bool `toml:"ignore_missing_keys"`
+	Keys              []string
+	Matrix            string
+	MaxDepth          int `toml:"max_depth"`
+	MinTTL            int `toml:"min_ttl"`
+	Mode              string
+	Owner             string
+	PerKey            bool `toml:"per_key"`
+	Prefix            string
+	PostReloadCheck   string `toml:"post_reload_check"`
+	Prefixes          []string
+	ReloadCmd         string   `toml:"reload_cmd"`
+	ReloadIf          string   `toml:"reload_if"`
+	ReloadStdin       string   `toml:"reload_stdin"`
+	RequiredKeys      []string `toml:"required_keys"`
+	SecretKeys        []string `toml:"secret_keys"`
+	SkipOnEmpty       bool     `toml:"skip_on_empty"`
+	Src               string
+	StableFor         string `toml:"stable_for"`
+	StageFile         *os.File
+	TransformCmd      string `toml:"transform_cmd"`
+	Uid               int
+	WriteBackKey      string `toml:"write_back_key"`
+	WriteBackValue    string `toml:"write_back_value"`
+	batch             *reloadBatch
+	changedKeys       []string
+	checkDelay        time.Duration
+	checkOutput       string
+	commandSlots      chan struct{}
+	compareMethod     string
+	configPath        string
+	data              interface{}
+	destFile          string
+	destTemplate      string
+	dryRun            bool
+	errorContext      int
+	followLinks       bool
+	funcMap           map[string]interface{}
+	keepGroup         bool
+	lastValues        map[string]string
+	keepStageFile     bool
+	kvPairs           memkv.KVPairs
+	lockDest          bool
+	name              string
+	noop              bool
+	reloadPerResource bool
+	secretKeys        []string
+	secretValues      []string
+	shadowRoot        string
+	stableFor         time.Duration
+	store             memkv.Store
+	storeClient       backends.StoreClient
+	syncOnly          bool
+	updated           bool
+	ttls              map[string]int64
+	types             map[string]interface{}
+	umask             os.FileMode
+	writeBackKey      string
+	PGPPrivateKey     []byte
 }
 
 var ErrEmptySrc = errors.New("empty src template")
 
+// The values of reload_stdin, selecting what reload_cmd reads on its
+// standard input.
+const (
+	// ReloadStdinDiff passes the unified diff of the update to dest.
+	ReloadStdinDiff = "diff"
+	// ReloadStdinKeys passes the keys whose values changed, one per line.
+	ReloadStdinKeys = "keys"
+)
+
+// A ResourceInfo describes a loaded template resource to templates through
+// the resources function. It deliberately leaves out the commands and env
+// of the resource, which may hold secrets.
+type ResourceInfo struct {
+	Name   string
+	Src    string
+	Dest   string
+	Prefix string
+	Keys   []string
+}
+
+// info returns the ResourceInfo of the template resource.
+func (t *TemplateResource) info() ResourceInfo {
+	keys := make([]string, len(t.Keys))
+	copy(keys, t.Keys)
+	return ResourceInfo{Name: t.name, Src: t.Src, Dest: t.Dest, Prefix: t.Prefix, Keys: keys}
+}
+
+// StdoutDest is the dest of template resources rendered to standard output.
+const StdoutDest = "-"
+
+// commandSlotsByLimit holds the semaphores shared by every template
+// resource limiting how many commands run at once, by limit.
+var (
+	commandSlotsMu      sync.Mutex
+	commandSlotsByLimit = make(map[int]chan struct{})
+)
+
+// commandSlots returns the semaphore allowing at most limit check and reload
+// commands to run at once. Template resources are recreated on every
+// processing cycle, so the semaphore lives for the whole process.
+// It returns nil, meaning no limit, if limit is not positive.
+func commandSlots(limit int) chan struct{} {
+	if limit <= 0 {
+		return nil
+	}
+	commandSlotsMu.Lock()
+	defer commandSlotsMu.Unlock()
+	slots, ok := commandSlotsByLimit[limit]
+	if !ok {
+		slots = make(chan struct{}, limit)
+		commandSlotsByLimit[limit] = slots
+	}
+	return slots
+}
+
+// The backoff between fetches while waiting for required keys to appear.
+var (
+	requiredKeysBackoff    = 500 * time.Millisecond
+	maxRequiredKeysBackoff = 10 * time.Second
+)
+
 // NewTemplateResource creates a TemplateResource.
 func NewTemplateResource(path string, config Config) (*TemplateResource, error) {
 	if config.StoreClient == nil {
@@ -81,20 +222,70 @@ func NewTemplateResource(path string, config Config) (*TemplateResource, error)
 	}
 
 	tr := tc.TemplateResource
+	tr.configPath = path
+	tr.lastValues = lastFetched(path)
+	tr.name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	tr.commandSlots = commandSlots(config.MaxConcurrentReloads)
+	tr.compareMethod = config.CompareMethod
+	if tr.compareMethod == "" {
+		tr.compareMethod = util.CompareHash
+	}
+	tr.dryRun = config.DryRun
+	tr.errorContext = config.TemplateErrorContext
+	tr.followLinks = !config.NoFollowSymlinks
 	tr.keepStageFile = config.KeepStageFile
+	tr.lockDest = config.LockDest
+	if tr.MaxDepth == 0 {
+		tr.MaxDepth = config.MaxDepth
+	}
+	if tr.Backups == 0 {
+		tr.Backups = config.Backups
+	}
+	if tr.BackupFormat == "" {
+		tr.BackupFormat = config.BackupFormat
+	}
+	if tr.BackupSuffix == "" {
+		tr.BackupSuffix = config.BackupSuffix
+	}
+	if tr.BackupSuffix == "" {
+		tr.BackupSuffix = DefaultBackupSuffix
+	}
 	tr.noop = config.Noop
+	tr.reloadPerResource = config.ReloadPerResource
+	if config.SkipOnEmpty {
+		tr.SkipOnEmpty = true
+	}
 	tr.storeClient = config.StoreClient
 	tr.funcMap = newFuncMap()
 	tr.store = memkv.New()
 	tr.syncOnly = config.SyncOnly
 	addFuncs(tr.funcMap, tr.store.FuncMap)
+	addFuncs(tr.funcMap, map[string]interface{}{
+		"resources":      func() []ResourceInfo { return nil },
+		"backendHealthy": tr.backendHealthy,
+		"clusterLeader":  tr.clusterLeader,
+		"getTyped":       tr.getTyped,
+		"ttlRemaining":   tr.ttlRemaining,
+	})
+	if tr.IgnoreMissingKeys {
+		tr.funcMap["getv"] = tr.getvOrEmpty
+	}
 
-	if config.Prefix != "" {
+	// The prefix of the template resource wins over the global one.
+	if tr.Prefix == "" {
 		tr.Prefix = config.Prefix
 	}
+	tr.Prefix = util.NormalizePrefix(tr.Prefix)
 
-	if !strings.HasPrefix(tr.Prefix, "/") {
-		tr.Prefix = "/" + tr.Prefix
+	for i, p := range tr.Prefixes {
+		tr.Prefixes[i] = util.NormalizePrefix(p)
+	}
+
+	if tr.WriteBackKey != "" {
+		tr.writeBackKey = util.AppendPrefix(tr.Prefix, []string{tr.WriteBackKey})[0]
+		if key := tr.watchedKey(tr.writeBackKey); key != "" {
+			return nil, fmt.Errorf("Cannot process template resource %s - write_back_key %s is under the key %s it watches, writing it would trigger the template resource again", path, tr.writeBackKey, key)
+		}
 	}
 
 	if len(config.PGPPrivateKey) > 0 {
@@ -102,8 +293,106 @@ func NewTemplateResource(path string, config Config) (*TemplateResource, error)
 		addCryptFuncs(&tr)
 	}
 
-	if tr.Src == "" {
-		return nil, ErrEmptySrc
+	switch tr.Format {
+	case "":
+		if tr.Src == "" {
+			return nil, ErrEmptySrc
+		}
+	case FormatINI:
+		if tr.Src != "" {
+			return nil, fmt.Errorf("Cannot process template resource %s - src cannot be used with format %q", path, tr.Format)
+		}
+	default:
+		return nil, fmt.Errorf("Cannot process template resource %s - invalid format %q, the only format is ini", path, tr.Format)
+	}
+
+	switch tr.ReloadStdin {
+	case "", ReloadStdinDiff, ReloadStdinKeys:
+	default:
+		return nil, fmt.Errorf("Cannot process template resource %s - invalid reload_stdin %q, valid values are diff and keys", path, tr.ReloadStdin)
+	}
+
+	if tr.Backups < 0 {
+		return nil, fmt.Errorf("Cannot process template resource %s - invalid backups %d, it cannot be negative", path, tr.Backups)
+	}
+	switch tr.BackupFormat {
+	case "", BackupNumbered, BackupTimestamp:
+	default:
+		return nil, fmt.Errorf("Cannot process template resource %s - invalid backup_format %q, valid values are numbered and timestamp", path, tr.BackupFormat)
+	}
+	if strings.ContainsAny(tr.BackupSuffix, `/\`) {
+		return nil, fmt.Errorf("Cannot process template resource %s - invalid backup_suffix %q, backups are kept next to dest", path, tr.BackupSuffix)
+	}
+	tr.secretKeys = append(append([]string(nil), config.SecretKeys...), tr.SecretKeys...)
+	if !validSecretKeys(tr.secretKeys) {
+		return nil, fmt.Errorf("Cannot process template resource %s - invalid secret_keys %q", path, tr.secretKeys)
+	}
+	if len(tr.Delims) > 0 && (len(tr.Delims) != 2 || tr.Delims[0] == "" || tr.Delims[1] == "" || tr.Delims[0] == tr.Delims[1]) {
+		return nil, fmt.Errorf("Cannot process template resource %s - invalid delims %q, want two different delimiters, such as [\"<%%\", \"%%>\"]", path, tr.Delims)
+	}
+
+	if tr.PostReloadCheck != "" && tr.ReloadCmd == "" {
+		return nil, fmt.Errorf("Cannot process template resource %s - post_reload_check needs a reload_cmd", path)
+	}
+
+	if tr.ReloadIf != "" {
+		if _, err := template.New("reload_if").Funcs(tr.funcMap).Parse(tr.ReloadIf); err != nil {
+			return nil, fmt.Errorf("Cannot process template resource %s - invalid reload_if: %s", path, err.Error())
+		}
+	}
+
+	if tr.CheckDelay != "" {
+		tr.checkDelay, err = time.ParseDuration(tr.CheckDelay)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot process template resource %s - invalid check_delay: %s", path, err.Error())
+		}
+	}
+
+	if tr.Mode == "" {
+		tr.Mode = config.DefaultMode
+	}
+	if tr.Mode != "" {
+		if tr.FileMode, err = util.ParseMode(tr.Mode); err != nil {
+			return nil, fmt.Errorf("Cannot process template resource %s - %s", path, err.Error())
+		}
+	}
+
+	tr.umask, err = util.ParseUmask(config.Umask)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot process template resource %s - %s", path, err.Error())
+	}
+	if config.Umask == "" {
+		tr.umask = 022
+	}
+
+	if tr.StableFor != "" {
+		tr.stableFor, err = time.ParseDuration(tr.StableFor)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot process template resource %s - invalid stable_for: %s", path, err.Error())
+		}
+	}
+
+	if tr.Owner != "" {
+		if tr.Uid != -1 {
+			return nil, fmt.Errorf("Cannot process template resource %s - set uid or owner, not both", path)
+		}
+		tr.Uid, err = lookupUid(tr.Owner)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot process template resource %s - %s", path, err.Error())
+		}
+	}
+
+	// An owner set on its own leaves the group of dest as it is.
+	tr.keepGroup = tr.Owner != "" && tr.Group == "" && tr.Gid == -1
+
+	if tr.Group != "" {
+		if tr.Gid != -1 {
+			return nil, fmt.Errorf("Cannot process template resource %s - set gid or group, not both", path)
+		}
+		tr.Gid, err = lookupGid(tr.Group)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot process template resource %s - %s", path, err.Error())
+		}
 	}
 
 	if tr.Uid == -1 {
@@ -114,7 +403,24 @@ func NewTemplateResource(path string, config Config) (*TemplateResource, error)
 		tr.Gid = os.Getegid()
 	}
 
-	tr.Src = filepath.Join(config.TemplateDir, tr.Src)
+	// A dest with actions is rendered with the keys on every run.
+	if tr.Matrix == "" && strings.Contains(tr.Dest, "{{") {
+		if _, err := template.New("dest").Funcs(tr.funcMap).Parse(tr.Dest); err != nil {
+			return nil, fmt.Errorf("Cannot process template resource %s - invalid dest %s: %s", path, tr.Dest, err.Error())
+		}
+		tr.destTemplate = tr.Dest
+	}
+
+	if config.ShadowRoot != "" && tr.Dest != StdoutDest {
+		tr.shadowRoot = config.ShadowRoot
+		shadowDest := filepath.Join(config.ShadowRoot, tr.Dest)
+		log.Debug(fmt.Sprintf("Shadow render: writing %s to %s", tr.Dest, shadowDest))
+		tr.Dest = shadowDest
+	}
+
+	if tr.Src != "" {
+		tr.Src = filepath.Join(config.TemplateDir, tr.Src)
+	}
 	return &tr, nil
 }
 
@@ -171,51 +477,384 @@ func addCryptFuncs(tr *TemplateResource) {
 	})
 }
 
-// setVars sets the Vars for template resource.
+// setVars sets the Vars for template resource. When several prefixes are
+// configured the keys are fetched relative to each of them and merged into
+// a single view. If the same relative key exists under more than one
+// prefix, the value from the prefix listed last wins.
 func (t *TemplateResource) setVars() error {
-	var err error
 	log.Debug("Retrieving keys from store")
-	log.Debug("Key prefix set to " + t.Prefix)
 
-	result, err := t.storeClient.GetValues(util.AppendPrefix(t.Prefix, t.Keys))
-	if err != nil {
-		return err
+	fetched := make(map[string]string)
+	vars := make(map[string]string)
+	expiries := make(map[string]int64)
+	types := make(map[string]interface{})
+	var queried []string
+	for _, prefix := range t.prefixes() {
+		log.Debug("Key prefix set to " + prefix)
+		keys := util.AppendPrefix(prefix, t.Keys)
+		queried = append(queried, keys...)
+		result, ttls, typed, err := t.getValues(keys)
+		if err != nil {
+			return err
+		}
+		log.Debug("Got the following map from store: %v", t.maskedValues(result, prefix))
+
+		for k, v := range result {
+			key, ok := util.TrimPathPrefix(k, prefix)
+			if !ok {
+				log.Debug(fmt.Sprintf("Skipping key %s which is not under the prefix %s", k, prefix))
+				continue
+			}
+			if t.MaxDepth > 0 && strings.Count(key, "/") > t.MaxDepth {
+				log.Debug(fmt.Sprintf("Skipping key %s which is more than %d levels below %s", k, t.MaxDepth, prefix))
+				continue
+			}
+			fetched[k] = v
+			ttl, ok := ttls[k]
+			if ok && ttl < int64(t.MinTTL) {
+				log.Debug(fmt.Sprintf("Skipping key %s which expires in %d seconds", k, ttl))
+				continue
+			}
+			delete(expiries, key)
+			if ok {
+				expiries[key] = ttl
+			}
+			delete(types, key)
+			if typ, ok := typed[k]; ok {
+				types[key] = typ
+			}
+			vars[key] = v
+		}
 	}
-	log.Debug("Got the following map from store: %v", result)
 
+	t.logResolution(queried, len(fetched))
+	t.setSecretValues(fetched)
+	t.changedKeys = changedKeys(t.lastValues, fetched)
+	t.lastValues = fetched
+	recordFetched(t.configPath, fetched)
+	t.ttls = expiries
+	t.types = types
 	t.store.Purge()
+	t.kvPairs = make(memkv.KVPairs, 0, len(vars))
+	for k, v := range vars {
+		t.store.Set(k, v)
+		t.kvPairs = append(t.kvPairs, memkv.KVPair{Key: k, Value: v})
+	}
+	sort.Sort(t.kvPairs)
+	return nil
+}
 
-	for k, v := range result {
-		t.store.Set(path.Join("/", strings.TrimPrefix(k, t.Prefix)), v)
+// waitStable waits, when stable_for is set and the last fetch changed any
+// value since the previous one, which may be from an earlier cycle, until the values of the template resource stay unchanged for
+// stable_for. Values are fetched again after every stable_for and any
+// change restarts the wait, so oscillating values are never rendered. The
+// changed keys are then those that differ from prev, the values fetched
+// before the wait started.
+// It returns an error if fetching the values fails.
+func (t *TemplateResource) waitStable(prev map[string]string) error {
+	if t.stableFor <= 0 || len(t.changedKeys) == 0 {
+		return nil
 	}
+	for len(t.changedKeys) > 0 {
+		log.Debug(fmt.Sprintf("Waiting %s for the values of %s to settle", t.stableFor, t.Dest))
+		time.Sleep(t.stableFor)
+		if err := t.setVars(); err != nil {
+			return err
+		}
+		if len(t.changedKeys) > 0 {
+			log.Info(fmt.Sprintf("Values of %s changed within %s (%s), waiting again", t.Dest, t.stableFor, strings.Join(t.changedKeys, " ")))
+		}
+	}
+	t.changedKeys = changedKeys(prev, t.lastValues)
 	return nil
 }
 
+// resolutionLogged records the template resources, by resource file, whose
+// key resolution has been logged.
+var (
+	resolutionLoggedMu sync.Mutex
+	resolutionLogged   = make(map[string]bool)
+)
+
+// logResolution logs, once per template resource file, the keys that were
+// queried after composing the prefixes and how many keys matched, which
+// reveals a misconfigured prefix right away.
+func (t *TemplateResource) logResolution(queried []string, matched int) {
+	resolutionLoggedMu.Lock()
+	logged := resolutionLogged[t.configPath]
+	resolutionLogged[t.configPath] = true
+	resolutionLoggedMu.Unlock()
+	if logged {
+		return
+	}
+	msg := fmt.Sprintf("Template resource %s queries %s, %d keys matched", t.configPath, strings.Join(queried, ", "), matched)
+	if matched == 0 {
+		log.Warning(msg)
+		return
+	}
+	log.Info(msg)
+}
+
+// fetchedValues records the values last fetched for every template
+// resource, by resource file. Template resources are recreated on every
+// processing cycle in interval and onetime mode, so the record lives for the
+// whole process, letting every new TemplateResource tell the keys that
+// changed since the previous cycle.
+var (
+	fetchedValuesMu sync.Mutex
+	fetchedValues   = make(map[string]map[string]string)
+)
+
+// lastFetched returns the values last fetched for the template resource
+// file configPath, or nil if it was never fetched.
+func lastFetched(configPath string) map[string]string {
+	fetchedValuesMu.Lock()
+	defer fetchedValuesMu.Unlock()
+	return fetchedValues[configPath]
+}
+
+// recordFetched records values as the last fetched for the template
+// resource file configPath. values must not be modified afterwards.
+func recordFetched(configPath string, values map[string]string) {
+	fetchedValuesMu.Lock()
+	fetchedValues[configPath] = values
+	fetchedValuesMu.Unlock()
+}
+
+// changedKeys returns the sorted keys added, removed or modified between the
+// prev and cur fetches.
+func changedKeys(prev, cur map[string]string) []string {
+	var changed []string
+	for k, v := range cur {
+		if old, ok := prev[k]; !ok || old != v {
+			changed = append(changed, k)
+		}
+	}
+	for k := range prev {
+		if _, ok := cur[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// getValues fetches keys from the store client, along with their TTLs or
+// their types if the backend reports them.
+func (t *TemplateResource) getValues(keys []string) (map[string]string, map[string]int64, map[string]interface{}, error) {
+	if c, ok := t.storeClient.(backends.TTLStoreClient); ok {
+		result, ttls, err := c.GetValuesWithTTL(keys)
+		return result, ttls, nil, err
+	}
+	if c, ok := t.storeClient.(backends.TypedStoreClient); ok {
+		result, types, err := c.GetTypedValues(keys)
+		if err != backends.ErrTypedValuesUnsupported {
+			return result, nil, types, err
+		}
+	}
+	result, err := t.storeClient.GetValues(keys)
+	return result, nil, nil, err
+}
+
+// prefixes returns the key prefixes of the template resource in order of
+// increasing precedence.
+func (t *TemplateResource) prefixes() []string {
+	if len(t.Prefixes) > 0 {
+		return t.Prefixes
+	}
+	return []string{t.Prefix}
+}
+
+// watchKeys returns the prefix to watch for changes and the keys that
+// should trigger an update. With several prefixes configured the watch is
+// placed on their longest common parent.
+func (t *TemplateResource) watchKeys() (string, []string) {
+	var keys []string
+	prefixes := t.prefixes()
+	for _, prefix := range prefixes {
+		keys = append(keys, util.AppendPrefix(prefix, t.Keys)...)
+	}
+	return commonPrefix(prefixes), keys
+}
+
+// commonPrefix returns the longest common parent path of prefixes.
+func commonPrefix(prefixes []string) string {
+	common := strings.Split(path.Clean(prefixes[0]), "/")
+	for _, p := range prefixes[1:] {
+		parts := strings.Split(path.Clean(p), "/")
+		i := 0
+		for i < len(common) && i < len(parts) && common[i] == parts[i] {
+			i++
+		}
+		common = common[:i]
+	}
+	return path.Join("/", strings.Join(common, "/"))
+}
+
+// missingRequiredKeys returns the required keys absent from the last fetch.
+func (t *TemplateResource) missingRequiredKeys() []string {
+	var missing []string
+	for _, k := range t.RequiredKeys {
+		if !t.store.Exists(path.Join("/", k)) {
+			missing = append(missing, k)
+		}
+	}
+	return missing
+}
+
+// waitForRequiredKeys fetches the keys of the template resource until all
+// of its required keys exist, backing off exponentially between attempts.
+// It returns an error if they have not all appeared by deadline.
+func (t *TemplateResource) waitForRequiredKeys(deadline time.Time) error {
+	backoff := requiredKeysBackoff
+	for {
+		err := t.setVars()
+		if err == nil {
+			missing := t.missingRequiredKeys()
+			if len(missing) == 0 {
+				return nil
+			}
+			err = errors.New("missing " + strings.Join(missing, ", "))
+		}
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			return fmt.Errorf("Timed out waiting for required keys of %s: %s", t.Dest, err)
+		}
+		log.Info(fmt.Sprintf("Waiting for required keys of %s: %s", t.Dest, err))
+		if backoff > remaining {
+			backoff = remaining
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxRequiredKeysBackoff {
+			backoff = maxRequiredKeysBackoff
+		}
+	}
+}
+
+// getvOrEmpty is getv for template resources with ignore_missing_keys set:
+// a key that was not fetched, and has no default, is rendered as an empty
+// string, with a warning, instead of failing the template.
+func (t *TemplateResource) getvOrEmpty(key string, v ...string) (string, error) {
+	value, err := t.store.GetValue(key, v...)
+	if e, ok := err.(*memkv.KeyError); ok && e.Err == memkv.ErrNotExist {
+		log.Warning(fmt.Sprintf("Key %s of %s is missing, rendering it as empty since ignore_missing_keys is set", key, t.configPath))
+		return "", nil
+	}
+	return value, err
+}
+
+// ttlRemaining returns the remaining TTL in seconds of key as reported by
+// the last fetch. It returns 0 for keys that do not expire, and for all keys
+// when the backend does not report TTLs. Only etcd reports TTLs, so MinTTL
+// has no effect with other backends.
+func (t *TemplateResource) ttlRemaining(key string) int64 {
+	return t.ttls[key]
+}
+
+// clusterLeader returns the leader of the backend cluster, or "" if the
+// cluster has no leader. Every call asks the backend.
+// It returns an error if the backend cannot tell its leader or cannot be
+// reached.
+func (t *TemplateResource) clusterLeader() (string, error) {
+	c, ok := t.storeClient.(backends.LeaderClient)
+	if !ok {
+		return "", backends.ErrLeaderUnsupported
+	}
+	return c.ClusterLeader()
+}
+
+// backendHealthy reports whether the backend cluster has a leader, and so
+// quorum. A cluster that cannot be reached is reported as unhealthy.
+// It returns an error if the backend cannot tell its leader.
+func (t *TemplateResource) backendHealthy() (bool, error) {
+	c, ok := t.storeClient.(backends.LeaderClient)
+	if !ok {
+		return false, backends.ErrLeaderUnsupported
+	}
+	leader, err := c.ClusterLeader()
+	if err != nil {
+		log.Warning(fmt.Sprintf("Cannot get the leader of the backend cluster, reporting it as unhealthy: %s", err))
+		return false, nil
+	}
+	return leader != "", nil
+}
+
+// getTyped returns the value of key with the type the backend stores it
+// with, as only the file backend reports. With other backends, which store
+// strings, values written as a bool, integer, number, JSON object or JSON
+// array are returned as a bool, int64, float64, map[string]interface{} or
+// []interface{}, and any other value as a string.
+// It returns an error if key does not exist.
+func (t *TemplateResource) getTyped(key string) (interface{}, error) {
+	key = path.Join("/", key)
+	kv, err := t.store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := t.types[key]; ok {
+		return v, nil
+	}
+	return parseTyped(kv.Value), nil
+}
+
+// parseTyped returns v as the value it unambiguously spells out, or v
+// itself. Numbers are only parsed in their canonical form, so that values
+// such as "0755" or "1.10" stay strings.
+func parseTyped(v string) interface{} {
+	switch v {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	if i, err := strconv.ParseInt(v, 10, 64); err == nil && strconv.FormatInt(i, 10) == v {
+		return i
+	}
+	if f, err := strconv.ParseFloat(v, 64); err == nil && strconv.FormatFloat(f, 'f', -1, 64) == v {
+		return f
+	}
+	if strings.HasPrefix(v, "{") || strings.HasPrefix(v, "[") {
+		var decoded interface{}
+		if err := json.Unmarshal([]byte(v), &decoded); err == nil {
+			return decoded
+		}
+	}
+	return v
+}
+
 // createStageFile stages the src configuration file by processing the src
 // template and setting the desired owner, group, and mode. It also sets the
 // StageFile for the template resource.
 // It returns an error if any.
 func (t *TemplateResource) createStageFile() error {
-	log.Debug("Using source template " + t.Src)
-
-	if !util.IsFileExist(t.Src) {
-		return errors.New("Missing template: " + t.Src)
+	render, err := t.renderer()
+	if err != nil {
+		return err
 	}
 
-	log.Debug("Compiling source template " + t.Src)
-
-	tmpl, err := template.New(filepath.Base(t.Src)).Funcs(t.funcMap).ParseFiles(t.Src)
-	if err != nil {
-		return fmt.Errorf("Unable to process template %s, %s", t.Src, err)
+	// The shadow root mirrors the real dest paths and need not exist yet.
+	dest := t.target()
+	if t.shadowRoot != "" {
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
 	}
 
 	// create TempFile in Dest directory to avoid cross-filesystem issues
-	temp, err := ioutil.TempFile(filepath.Dir(t.Dest), "."+filepath.Base(t.Dest))
+	temp, err := ioutil.TempFile(filepath.Dir(dest), "."+filepath.Base(dest))
 	if err != nil {
 		return err
 	}
 
-	if err = tmpl.Execute(temp, nil); err != nil {
+	if err = render(temp); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+	// Flush the contents to disk so that a crash after the rename over dest
+	// cannot leave dest empty.
+	if err = temp.Sync(); err != nil {
 		temp.Close()
 		os.Remove(temp.Name())
 		return err
@@ -230,37 +869,185 @@ func (t *TemplateResource) createStageFile() error {
 	return nil
 }
 
+// renderer returns the function writing the contents of dest: the src
+// template, or the keys in the format of the template resource, passed
+// through transform_cmd if set.
+// It returns an error if the src template cannot be compiled.
+func (t *TemplateResource) renderer() (func(io.Writer) error, error) {
+	var render func(io.Writer) error
+	if t.Format == FormatINI {
+		render = func(w io.Writer) error { return writeINI(w, t.kvPairs) }
+	} else {
+		tmpl, err := t.parseTemplate()
+		if err != nil {
+			return nil, err
+		}
+		render = func(w io.Writer) error {
+			if err := t.execute(tmpl, w); err != nil {
+				return t.templateError(err)
+			}
+			return nil
+		}
+	}
+	if t.TransformCmd == "" {
+		return render, nil
+	}
+	return func(w io.Writer) error {
+		var b bytes.Buffer
+		if err := render(&b); err != nil {
+			return err
+		}
+		out, err := t.runCommand(t.TransformCmd, b.Bytes())
+		if err != nil {
+			return fmt.Errorf("Transform command %q of %s failed: %s", t.TransformCmd, t.Src, err)
+		}
+		_, err = w.Write(out)
+		return err
+	}, nil
+}
+
+// parseTemplate returns the compiled src template.
+func (t *TemplateResource) parseTemplate() (*template.Template, error) {
+	log.Debug("Using source template " + t.Src)
+
+	if !util.IsFileExist(t.Src) {
+		return nil, errors.New("Missing template: " + t.Src)
+	}
+
+	log.Debug("Compiling source template " + t.Src)
+
+	tmpl, err := templates.parse(t.Src, t.Delims, t.funcMap)
+	if err != nil {
+		return nil, t.templateError(err)
+	}
+	return tmpl, nil
+}
+
+// Render fetches the keys of the template resource from its StoreClient
+// and writes the rendered src template to w, leaving dest untouched and
+// running none of its commands. Nothing is written if the template cannot
+// be rendered, or if skip_on_empty is set and the backend returns no keys.
+// Render lets templates be previewed or tested against a StoreClient
+// serving known values.
+// It returns the error processing the template resource would, if any.
+func (t *TemplateResource) Render(w io.Writer) error {
+	if err := t.setVars(); err != nil {
+		return newError(BackendFailure, err)
+	}
+	if t.skipEmpty() {
+		return nil
+	}
+	if missing := t.missingRequiredKeys(); len(missing) > 0 {
+		return newError(BackendFailure, fmt.Errorf("Missing required keys for %s: %s", t.Src, strings.Join(missing, ", ")))
+	}
+	render, err := t.renderer()
+	if err != nil {
+		return newError(RenderFailure, err)
+	}
+	// Render fully first so that a failing template writes nothing.
+	var b bytes.Buffer
+	if err := render(&b); err != nil {
+		return newError(RenderFailure, err)
+	}
+	_, err = b.WriteTo(w)
+	return newError(RenderFailure, err)
+}
+
+// execute renders tmpl to w. With PerKey set the template is rendered once
+// for every key/value pair of the template resource, in key order, with the
+// memkv.KVPair as data so that .Key and .Value name the key, relative to the
+// prefix, and its value. The renderings are concatenated, so each one should
+// end with its own newline.
+func (t *TemplateResource) execute(tmpl *template.Template, w io.Writer) error {
+	if !t.PerKey {
+		return tmpl.Execute(w, t.data)
+	}
+	for _, kv := range t.kvPairs {
+		if err := tmpl.Execute(w, kv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // sync compares the staged and dest config files and attempts to sync them
 // if they differ. sync will run a config check command if set before
 // overwriting the target config file. Finally, sync will run a reload command
 // if set to have the application or service pick up the changes.
+// With LockDest set the comparison, write and reload happen while holding
+// an advisory lock on a ".lock" file next to the destination, so confd
+// processes sharing a filesystem never interleave updates of the same file.
+// The lock file is left in place. Locking is not supported on Windows.
+// With Backups set the previous dest is backed up before it is overwritten.
 // It returns an error if any.
 func (t *TemplateResource) sync() error {
 	staged := t.StageFile.Name()
+	t.checkOutput = ""
 	if t.keepStageFile {
 		log.Info("Keeping staged file: " + staged)
 	} else {
 		defer os.Remove(staged)
 	}
 
-	log.Debug("Comparing candidate config to " + t.Dest)
-	ok, err := util.IsConfigChanged(staged, t.Dest)
+	dest := t.target()
+	if t.lockDest && !t.dryRun && !t.noop {
+		log.Debug("Locking " + dest + ".lock")
+		unlock, err := util.LockFile(dest + ".lock")
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	log.Debug("Comparing candidate config to " + dest)
+	ok, err := util.IsConfigChangedWith(staged, dest, t.compareMethod)
 	if err != nil {
 		log.Error(err.Error())
 	}
+	t.updated = ok
+	if t.dryRun {
+		return t.dryRunCheck()
+	}
 	if t.noop {
 		log.Warning("Noop mode enabled. " + t.Dest + " will not be modified")
+		if ok {
+			diff, err := noopDiff(t.Dest, staged, dest)
+			if err != nil {
+				return err
+			}
+			log.Info("Pending changes to " + t.Dest + ":\n" + strings.TrimSuffix(diff, "\n"))
+		}
+		if ok && !t.syncOnly && t.ReloadCmd != "" {
+			log.Warning("Noop mode enabled. Would run reload_cmd: " + t.ReloadCmd)
+		}
 		return nil
 	}
 	if ok {
 		log.Info("Target config " + t.Dest + " out of sync")
 		if !t.syncOnly && t.CheckCmd != "" {
 			if err := t.check(); err != nil {
-				return errors.New("Config check failed: " + err.Error())
+				return newError(CheckFailure, errors.New("Config check failed: "+err.Error()))
+			}
+		}
+		stdin, err := t.reloadInput(staged, dest)
+		if err != nil {
+			return err
+		}
+		var backup string
+		if t.PostReloadCheck != "" && t.shadowRoot == "" && !t.syncOnly {
+			if backup, err = backupFile(dest); err != nil {
+				return err
+			}
+			if backup != "" {
+				defer os.Remove(backup)
 			}
 		}
-		log.Debug("Overwriting target config " + t.Dest)
-		err := os.Rename(staged, t.Dest)
+		if t.Backups > 0 {
+			if err := t.keepBackup(dest); err != nil {
+				return err
+			}
+		}
+		log.Debug("Overwriting target config " + dest)
+		err = os.Rename(staged, dest)
 		if err != nil {
 			if strings.Contains(err.Error(), "device or resource busy") {
 				log.Debug("Rename failed - target is likely a mount. Trying to write instead")
@@ -271,9 +1058,9 @@ func (t *TemplateResource) sync() error {
 				if rerr != nil {
 					return rerr
 				}
-				err := ioutil.WriteFile(t.Dest, contents, t.FileMode)
+				err := ioutil.WriteFile(dest, contents, t.FileMode)
 				// make sure owner and group match the temp file, in case the file was created with WriteFile
-				os.Chown(t.Dest, t.Uid, t.Gid)
+				os.Chown(dest, t.Uid, t.Gid)
 				if err != nil {
 					return err
 				}
@@ -281,9 +1068,23 @@ func (t *TemplateResource) sync() error {
 				return err
 			}
 		}
-		if !t.syncOnly && t.ReloadCmd != "" {
-			if err := t.reload(); err != nil {
-				return err
+		if t.shadowRoot != "" && t.ReloadCmd != "" {
+			log.Info("Shadow render: skipping reload_cmd for " + t.Dest)
+		} else if !t.syncOnly && t.ReloadCmd != "" {
+			reload, err := t.reloadIf()
+			if err != nil {
+				return newError(ReloadFailure, err)
+			}
+			if !reload {
+				log.Info("reload_if is false, not reloading " + t.Dest)
+			} else if t.batch != nil && stdin == nil && !t.lockDest && t.PostReloadCheck == "" {
+				t.batch.queue(t)
+			} else if err := t.reload(stdin); err != nil {
+				return newError(ReloadFailure, err)
+			} else if t.PostReloadCheck != "" {
+				if err := t.postReloadCheck(dest, backup); err != nil {
+					return newError(ReloadFailure, err)
+				}
 			}
 		}
 		log.Info("Target config " + t.Dest + " has been updated")
@@ -293,11 +1094,55 @@ func (t *TemplateResource) sync() error {
 	return nil
 }
 
+// maxNoopDiffLines bounds the lines of the diffs logged in noop mode.
+const maxNoopDiffLines = 200
+
+// noopDiff returns the unified diff, named name, turning dest into staged,
+// or showing all of staged as added if dest does not exist. Diffs longer
+// than maxNoopDiffLines are cut, ending with the number of lines left out.
+func noopDiff(name, staged, dest string) (string, error) {
+	old, err := ioutil.ReadFile(dest)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	cur, err := ioutil.ReadFile(staged)
+	if err != nil {
+		return "", err
+	}
+	lines := strings.SplitAfter(util.UnifiedDiff(name, name, old, cur), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) <= maxNoopDiffLines {
+		return strings.Join(lines, ""), nil
+	}
+	return fmt.Sprintf("%s... %d more lines", strings.Join(lines[:maxNoopDiffLines], ""), len(lines)-maxNoopDiffLines), nil
+}
+
+// dryRunCheck runs the check command against the staged file and reports
+// the result without modifying the destination or running the reload
+// command.
+// It returns an error if the check command fails.
+func (t *TemplateResource) dryRunCheck() error {
+	if t.CheckCmd == "" {
+		log.Info("Dry run: no check_cmd for " + t.Dest)
+		return nil
+	}
+	if err := t.check(); err != nil {
+		log.Error("Dry run: check failed for " + t.Dest)
+		return newError(CheckFailure, errors.New("Config check failed: "+err.Error()))
+	}
+	log.Info("Dry run: check passed for " + t.Dest)
+	return nil
+}
+
 // check executes the check command to validate the staged config file. The
 // command is modified so that any references to src template are substituted
 // with a string representing the full path of the staged file. This allows the
 // check to be run on the staged file before overwriting the destination config
-// file.
+// file. A failing check command is run up to CheckAttempts times in total,
+// waiting CheckDelay between attempts, to ride out transient failures. The
+// standard output of the last attempt is kept for reload_if.
 // It returns nil if the check command returns 0 and there are no other errors.
 func (t *TemplateResource) check() error {
 	var cmdBuffer bytes.Buffer
@@ -310,20 +1155,262 @@ func (t *TemplateResource) check() error {
 	if err := tmpl.Execute(&cmdBuffer, data); err != nil {
 		return err
 	}
-	return runCommand(cmdBuffer.String())
+	for attempt := 1; ; attempt++ {
+		var output []byte
+		output, err = t.runCommand(cmdBuffer.String(), nil)
+		t.checkOutput = strings.TrimSpace(string(output))
+		if err == nil || attempt >= t.CheckAttempts {
+			return err
+		}
+		log.Warning(fmt.Sprintf("Check for %s failed (attempt %d of %d), retrying in %s: %s", t.Dest, attempt, t.CheckAttempts, t.checkDelay, err))
+		time.Sleep(t.checkDelay)
+	}
 }
 
-// reload executes the reload command.
+// reload executes the reload command with stdin, if not nil, as its
+// standard input.
 // It returns nil if the reload command returns 0.
-func (t *TemplateResource) reload() error {
-	return runCommand(t.ReloadCmd)
+func (t *TemplateResource) reload(stdin []byte) error {
+	_, err := t.runCommand(t.ReloadCmd, stdin)
+	return err
+}
+
+// postReloadCheck runs post_reload_check once reload_cmd has applied the
+// update of dest. If it fails, dest is restored from backup, the copy of
+// dest made before the update, or removed if backup is "" as dest did not
+// exist, and reload_cmd runs again to apply the previous config.
+// It returns an error if the check fails, including any error restoring
+// the previous config.
+func (t *TemplateResource) postReloadCheck(dest, backup string) error {
+	_, err := t.runCommand(t.PostReloadCheck, nil)
+	if err == nil {
+		return nil
+	}
+	log.Error(fmt.Sprintf("Post reload check of %s failed, restoring the previous config", t.Dest))
+	if backup != "" {
+		if rerr := os.Rename(backup, dest); rerr != nil {
+			return fmt.Errorf("Post reload check of %s failed: %s, and restoring the previous config failed: %s", t.Dest, err, rerr)
+		}
+	} else if rerr := os.Remove(dest); rerr != nil {
+		return fmt.Errorf("Post reload check of %s failed: %s, and removing it failed: %s", t.Dest, err, rerr)
+	}
+	if rerr := t.reload(nil); rerr != nil {
+		return fmt.Errorf("Post reload check of %s failed: %s, and reloading the previous config failed: %s", t.Dest, err, rerr)
+	}
+	return fmt.Errorf("Post reload check of %s failed, restored the previous config: %s", t.Dest, err)
+}
+
+// backupFile copies the file at path, with its mode and owner, to a hidden
+// file next to it.
+// It returns the path of the copy, or "" if there is no file at path.
+func backupFile(path string) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	fi, err := util.FileStat(path)
+	if err != nil {
+		return "", err
+	}
+	backup, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".rollback")
+	if err != nil {
+		return "", err
+	}
+	defer backup.Close()
+	if _, err := backup.Write(contents); err != nil {
+		os.Remove(backup.Name())
+		return "", err
+	}
+	os.Chmod(backup.Name(), fi.Mode)
+	os.Chown(backup.Name(), int(fi.Uid), int(fi.Gid))
+	return backup.Name(), nil
+}
+
+// A reloadBatch defers the reload commands of the template resources
+// updated during a processing cycle until all of them are rendered, so
+// that a reload_cmd shared by several of them runs once per cycle.
+type reloadBatch struct {
+	cmds   []string
+	queued map[string][]*TemplateResource
+}
+
+func newReloadBatch() *reloadBatch {
+	return &reloadBatch{queued: make(map[string][]*TemplateResource)}
+}
+
+// queue defers the reload_cmd of t to run.
+func (b *reloadBatch) queue(t *TemplateResource) {
+	log.Debug(fmt.Sprintf("Deferring reload_cmd of %s to the end of the cycle", t.Dest))
+	if _, ok := b.queued[t.ReloadCmd]; !ok {
+		b.cmds = append(b.cmds, t.ReloadCmd)
+	}
+	b.queued[t.ReloadCmd] = append(b.queued[t.ReloadCmd], t)
+}
+
+// merge queues the reload commands queued in o after those of b.
+func (b *reloadBatch) merge(o *reloadBatch) {
+	for _, cmd := range o.cmds {
+		if _, ok := b.queued[cmd]; !ok {
+			b.cmds = append(b.cmds, cmd)
+		}
+		b.queued[cmd] = append(b.queued[cmd], o.queued[cmd]...)
+	}
+}
+
+// run runs every queued reload_cmd once, in the order they were first
+// queued, with the environment of the first template resource queuing it.
+// It returns the template resources whose reload_cmd failed, and the last
+// error encountered, if any.
+func (b *reloadBatch) run() (map[*TemplateResource]bool, error) {
+	failed := make(map[*TemplateResource]bool)
+	var lastErr error
+	for _, cmd := range b.cmds {
+		ts := b.queued[cmd]
+		dests := make([]string, len(ts))
+		for i, t := range ts {
+			dests[i] = t.Dest
+		}
+		if len(ts) > 1 {
+			log.Info(fmt.Sprintf("Running reload_cmd shared by %s once", strings.Join(dests, ", ")))
+		}
+		if err := ts[0].reload(nil); err != nil {
+			lastErr = newError(ReloadFailure, fmt.Errorf("Reload command of %s failed: %s", strings.Join(dests, ", "), err))
+			for _, t := range ts {
+				failed[t] = true
+			}
+		}
+	}
+	return failed, lastErr
+}
+
+// processBatched processes t, deferring its reload_cmd to batch unless
+// reload_per_resource is set.
+// It returns what processing did to dest, and the error if it failed.
+func (t *TemplateResource) processBatched(batch *reloadBatch) (outcome, error) {
+	if !t.reloadPerResource {
+		t.batch = batch
+		defer func() { t.batch = nil }()
+	}
+	if err := t.process(); err != nil {
+		return outcomeFailed, err
+	}
+	if t.updated {
+		return outcomeUpdated, nil
+	}
+	return outcomeUnchanged, nil
+}
+
+// reloadIf evaluates the reload_if template of the template resource, which
+// must render true or false, or anything else strconv.ParseBool accepts. It
+// is executed with:
+//
+//	.check_output  the standard output of check_cmd, without surrounding
+//	               blanks, or "" if check_cmd did not run
+//	.changed_keys  the keys whose values changed since the previous fetch
+//
+// It returns true if reload_if is not set.
+func (t *TemplateResource) reloadIf() (bool, error) {
+	if t.ReloadIf == "" {
+		return true, nil
+	}
+	tmpl, err := template.New("reload_if").Funcs(t.funcMap).Parse(t.ReloadIf)
+	if err != nil {
+		return false, err
+	}
+	var b bytes.Buffer
+	data := map[string]interface{}{
+		"check_output": t.checkOutput,
+		"changed_keys": t.changedKeys,
+	}
+	if err := tmpl.Execute(&b, data); err != nil {
+		return false, fmt.Errorf("Unable to evaluate reload_if of %s, %s", t.Dest, err)
+	}
+	reload, err := strconv.ParseBool(strings.TrimSpace(b.String()))
+	if err != nil {
+		return false, fmt.Errorf("reload_if of %s rendered %q, want true or false", t.Dest, t.maskSecrets(b.String()))
+	}
+	return reload, nil
+}
+
+// reloadInput returns what reload_cmd reads on its standard input, as
+// selected by reload_stdin, when the file at dest is replaced by the file at
+// staged:
+//
+//	diff  the unified diff turning the old dest into the new one, with three
+//	      lines of context and both file headers naming dest; a missing dest
+//	      diffs as an empty file
+//	keys  the keys whose values changed since the previous fetch, one per
+//	      line, every key on the first fetch
+//
+// It returns nil if reload_stdin is not set.
+func (t *TemplateResource) reloadInput(staged, dest string) ([]byte, error) {
+	switch t.ReloadStdin {
+	case ReloadStdinDiff:
+		old, err := ioutil.ReadFile(dest)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		cur, err := ioutil.ReadFile(staged)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(util.UnifiedDiff(t.Dest, t.Dest, old, cur)), nil
+	case ReloadStdinKeys:
+		var keys bytes.Buffer
+		for _, k := range t.changedKeys {
+			keys.WriteString(k + "\n")
+		}
+		return keys.Bytes(), nil
+	}
+	return nil, nil
+}
+
+// runCommand runs cmd with the environment of the template resource, and
+// stdin as its standard input if not nil, once one of the global command
+// slots is free.
+func (t *TemplateResource) runCommand(cmd string, stdin []byte) ([]byte, error) {
+	if t.commandSlots != nil {
+		t.commandSlots <- struct{}{}
+		defer func() { <-t.commandSlots }()
+	}
+	return runCommand(cmd, t.commandEnv(), stdin)
+}
+
+// commandEnv returns the environment variables, in addition to those of
+// confd itself, that transform_cmd, check_cmd and reload_cmd run with:
+//
+//	CONFD_DEST          the path of the destination file
+//	CONFD_SRC           the path of the source template
+//	CONFD_RESOURCE      the name of the template resource file, without .toml
+//	CONFD_CHANGED_KEYS  the space separated keys whose values changed since
+//	                    the previous fetch, every key on the first one
+//
+// followed by the variables of the resource env table, which may override
+// them.
+func (t *TemplateResource) commandEnv() []string {
+	env := []string{
+		"CONFD_DEST=" + t.Dest,
+		"CONFD_SRC=" + t.Src,
+		"CONFD_RESOURCE=" + t.name,
+		"CONFD_CHANGED_KEYS=" + strings.Join(t.changedKeys, " "),
+	}
+	for k, v := range t.Env {
+		env = append(env, k+"="+v)
+	}
+	return env
 }
 
 // runCommand is a shared function used by check and reload
-// to run the given command and log its output.
-// It returns nil if the given cmd returns 0.
+// to run the given command and log its output. env is added to the
+// environment of confd and stdin, if not nil, is the standard input of the
+// command.
+// It returns the standard output of the command, and a nil error if the
+// given cmd returns 0.
 // The command can be run on unix and windows.
-func runCommand(cmd string) error {
+func runCommand(cmd string, env []string, stdin []byte) ([]byte, error) {
 	log.Debug("Running " + cmd)
 	var c *exec.Cmd
 	if runtime.GOOS == "windows" {
@@ -331,14 +1418,35 @@ func runCommand(cmd string) error {
 	} else {
 		c = exec.Command("/bin/sh", "-c", cmd)
 	}
+	c.Env = append(os.Environ(), env...)
+	if stdin != nil {
+		c.Stdin = bytes.NewReader(stdin)
+	}
 
-	output, err := c.CombinedOutput()
+	var stdout, output bytes.Buffer
+	combined := &syncWriter{w: &output}
+	c.Stdout = io.MultiWriter(&stdout, combined)
+	c.Stderr = combined
+	err := c.Run()
 	if err != nil {
-		log.Error(fmt.Sprintf("%q", string(output)))
-		return err
+		log.Error(fmt.Sprintf("%q", output.String()))
+		return stdout.Bytes(), err
 	}
-	log.Debug(fmt.Sprintf("%q", string(output)))
-	return nil
+	log.Debug(fmt.Sprintf("%q", output.String()))
+	return stdout.Bytes(), nil
+}
+
+// A syncWriter serializes writes to w, such as those of the goroutines
+// copying the stdout and stderr of a command to the same buffer.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
 }
 
 // process is a convenience function that wraps calls to the three main tasks
@@ -347,26 +1455,307 @@ func runCommand(cmd string) error {
 // things up.
 // It returns an error if any.
 func (t *TemplateResource) process() error {
-	if err := t.setFileMode(); err != nil {
-		return err
+	t.updated = false
+	if t.Dest == StdoutDest {
+		return t.processStdout()
 	}
+	if t.Matrix != "" {
+		return t.processMatrix()
+	}
+	if t.destTemplate == "" {
+		if err := t.prepareDest(); err != nil {
+			return err
+		}
+	}
+	prev := t.lastValues
 	if err := t.setVars(); err != nil {
-		return err
+		return newError(BackendFailure, err)
+	}
+	if err := t.waitStable(prev); err != nil {
+		return newError(BackendFailure, err)
+	}
+	if t.skipEmpty() {
+		return nil
+	}
+	if t.destTemplate != "" {
+		if err := t.renderDest(); err != nil {
+			return newError(ConfigFailure, err)
+		}
+		if err := t.prepareDest(); err != nil {
+			return err
+		}
+	}
+	if t.DeleteOnMissing != "" && !t.store.Exists(path.Join("/", t.DeleteOnMissing)) {
+		return t.deleteDest()
+	}
+	if missing := t.missingRequiredKeys(); len(missing) > 0 {
+		return newError(BackendFailure, fmt.Errorf("Missing required keys for %s: %s", t.Dest, strings.Join(missing, ", ")))
 	}
 	if err := t.createStageFile(); err != nil {
-		return err
+		return newError(RenderFailure, err)
 	}
 	if err := t.sync(); err != nil {
+		return newError(RenderFailure, err)
+	}
+	if t.DeleteOnMissing != "" {
+		if err := t.markOwned(); err != nil {
+			return newError(RenderFailure, err)
+		}
+	}
+	if t.WriteBackKey != "" {
+		return newError(BackendFailure, t.writeBack())
+	}
+	return nil
+}
+
+// prepareDest resolves the file written to update Dest and the mode it is
+// written with.
+func (t *TemplateResource) prepareDest() error {
+	if err := t.resolveDest(); err != nil {
+		return newError(ConfigFailure, err)
+	}
+	if err := t.setFileMode(); err != nil {
+		return newError(ConfigFailure, err)
+	}
+	return nil
+}
+
+// renderDest sets Dest to the path the dest template renders with the keys
+// last fetched, under the shadow root if there is one.
+// It returns an error if the path is empty or relative, or if its
+// directory does not exist.
+func (t *TemplateResource) renderDest() error {
+	tmpl, err := template.New("dest").Funcs(t.funcMap).Parse(t.destTemplate)
+	if err != nil {
+		return fmt.Errorf("Cannot process template resource %s - invalid dest %s: %s", t.configPath, t.destTemplate, err.Error())
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, t.data); err != nil {
+		return fmt.Errorf("Cannot process template resource %s - cannot render dest %s: %s", t.configPath, t.destTemplate, err.Error())
+	}
+	dest := b.String()
+	if dest == "" {
+		return fmt.Errorf("Cannot process template resource %s - dest %s rendered an empty path", t.configPath, t.destTemplate)
+	}
+	if !filepath.IsAbs(dest) {
+		return fmt.Errorf("Cannot process template resource %s - dest %s rendered %s, which is not an absolute path", t.configPath, t.destTemplate, dest)
+	}
+	if t.shadowRoot != "" {
+		dest = filepath.Join(t.shadowRoot, dest)
+	} else if !util.IsFileExist(filepath.Dir(dest)) {
+		return fmt.Errorf("Cannot process template resource %s - dest %s rendered %s, whose directory does not exist", t.configPath, t.destTemplate, dest)
+	}
+	log.Debug(fmt.Sprintf("Dest %s rendered %s", t.destTemplate, dest))
+	t.Dest = dest
+	return nil
+}
+
+// skipEmpty reports whether the template resource is left alone, with a
+// warning, because SkipOnEmpty is set and the backend returned no keys for
+// it, as it does for a mistyped prefix or a wiped cluster.
+func (t *TemplateResource) skipEmpty() bool {
+	if !t.SkipOnEmpty || len(t.lastValues) > 0 {
+		return false
+	}
+	log.Warning(fmt.Sprintf("The backend returned no keys for %s, leaving %s untouched", t.configPath, t.Dest))
+	return true
+}
+
+// watchedKey returns the key watched by the template resource that key is
+// equal to or nested under, or "" if there is none.
+func (t *TemplateResource) watchedKey(key string) string {
+	_, keys := t.watchKeys()
+	for _, k := range keys {
+		if key == k || strings.HasPrefix(key, strings.TrimSuffix(k, "/")+"/") {
+			return k
+		}
+	}
+	return ""
+}
+
+// writeBack writes the write_back_value template, or the contents of dest
+// if it is not set, to write_back_key in the backend. The value is not
+// written if the backend already holds it, so template resources writing
+// keys that others watch settle instead of updating each other forever.
+// It returns an error if the backend does not support writing keys.
+func (t *TemplateResource) writeBack() error {
+	if t.dryRun || t.noop || t.shadowRoot != "" {
+		log.Info("Skipping the write back of " + t.writeBackKey)
+		return nil
+	}
+	c, ok := t.storeClient.(backends.WriteStoreClient)
+	if !ok {
+		return backends.ErrWriteUnsupported
+	}
+	var value bytes.Buffer
+	if t.WriteBackValue == "" {
+		contents, err := ioutil.ReadFile(t.target())
+		if err != nil {
+			return err
+		}
+		value.Write(contents)
+	} else {
+		tmpl, err := template.New("write_back_value").Funcs(t.funcMap).Parse(t.WriteBackValue)
+		if err != nil {
+			return fmt.Errorf("Unable to parse write_back_value of %s, %s", t.Dest, err)
+		}
+		if err := tmpl.Execute(&value, t.data); err != nil {
+			return err
+		}
+	}
+	current, err := t.storeClient.GetValues([]string{t.writeBackKey})
+	if err != nil {
 		return err
 	}
+	if v, ok := current[t.writeBackKey]; ok && v == value.String() {
+		log.Debug(t.writeBackKey + " already holds the written back value")
+		return nil
+	}
+	log.Info("Writing back " + t.writeBackKey)
+	return c.SetValue(t.writeBackKey, value.String())
+}
+
+// ownerMarker returns the path of the file recording that confd wrote the
+// destination of a template resource with DeleteOnMissing set.
+func (t *TemplateResource) ownerMarker() string {
+	dest := t.target()
+	return filepath.Join(filepath.Dir(dest), "."+filepath.Base(dest)+".confd")
+}
+
+// markOwned records that confd wrote the destination file, which allows
+// deleteDest to remove it.
+func (t *TemplateResource) markOwned() error {
+	if t.dryRun || t.noop || util.IsFileExist(t.ownerMarker()) {
+		return nil
+	}
+	return ioutil.WriteFile(t.ownerMarker(), nil, 0644)
+}
+
+// deleteDest removes the destination file, once the DeleteOnMissing key is
+// absent, and runs the reload command. Only files confd wrote itself, as
+// recorded by markOwned, are removed.
+// It returns an error if any.
+func (t *TemplateResource) deleteDest() error {
+	dest := t.target()
+	if !util.IsFileExist(dest) {
+		log.Debug(fmt.Sprintf("%s is absent and %s does not exist", t.DeleteOnMissing, dest))
+		return nil
+	}
+	if !util.IsFileExist(t.ownerMarker()) {
+		log.Warning(fmt.Sprintf("%s is absent but %s was not written by confd, not deleting it", t.DeleteOnMissing, dest))
+		return nil
+	}
+	t.updated = true
+	if t.dryRun || t.noop {
+		log.Warning(fmt.Sprintf("%s is absent, %s would be deleted", t.DeleteOnMissing, dest))
+		return nil
+	}
+	stdin, err := t.reloadInput(os.DevNull, dest)
+	if err != nil {
+		return newError(RenderFailure, err)
+	}
+	if err := os.Remove(dest); err != nil {
+		return newError(RenderFailure, err)
+	}
+	os.Remove(t.ownerMarker())
+	log.Info(fmt.Sprintf("Removed %s since %s is absent", dest, t.DeleteOnMissing))
+	if t.shadowRoot == "" && !t.syncOnly && t.ReloadCmd != "" {
+		if err := t.reload(stdin); err != nil {
+			return newError(ReloadFailure, err)
+		}
+	}
+	return nil
+}
+
+// processStdout is process for template resources whose dest is
+// StdoutDest. The template is rendered on every run, and since there is no
+// file to replace check_cmd and reload_cmd are not run. Logs go to standard
+// error and do not mix with the output.
+func (t *TemplateResource) processStdout() error {
+	if t.dryRun || t.noop {
+		if err := t.Render(ioutil.Discard); err != nil {
+			return err
+		}
+		log.Info("Not writing the rendered " + t.Src + " to standard output")
+		return nil
+	}
+	return t.Render(os.Stdout)
+}
+
+// resolveDest determines the file written to update Dest. When Dest is a
+// symlink the atomic rename of the stage file would replace the link itself,
+// so unless NoFollowSymlinks is set the file the link points to is renamed
+// over instead and the link is left intact.
+// The stage file is then created next to that file, keeping the rename on
+// a single filesystem.
+// It returns an error if Dest is a symlink and NoFollowSymlinks is set,
+// or if the file to write is a directory.
+func (t *TemplateResource) resolveDest() error {
+	t.destFile = t.Dest
+	fi, err := os.Lstat(t.Dest)
+	if err != nil {
+		return nil
+	}
+	if fi.IsDir() {
+		return t.destIsDir(t.Dest)
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+	if !t.followLinks {
+		return fmt.Errorf("Refusing to replace symlink %s, enable -follow-symlinks to write to its target", t.Dest)
+	}
+	target, err := filepath.EvalSymlinks(t.Dest)
+	if err != nil {
+		// A dangling link: create the file it points to.
+		link, err := os.Readlink(t.Dest)
+		if err != nil {
+			return err
+		}
+		if !filepath.IsAbs(link) {
+			link = filepath.Join(filepath.Dir(t.Dest), link)
+		}
+		target = link
+	}
+	if fi, err := os.Stat(target); err == nil && fi.IsDir() {
+		return t.destIsDir(target)
+	}
+	log.Debug(fmt.Sprintf("%s is a symlink, writing to %s", t.Dest, target))
+	t.destFile = target
 	return nil
 }
 
-// setFileMode sets the FileMode.
+// destIsDir returns the error reported when the file written to update
+// Dest, at path, is an existing directory.
+func (t *TemplateResource) destIsDir(path string) error {
+	if path != t.Dest {
+		return fmt.Errorf("Cannot process template resource %s - dest %s points to %s, which is a directory", t.configPath, t.Dest, path)
+	}
+	return fmt.Errorf("Cannot process template resource %s - dest %s is a directory", t.configPath, t.Dest)
+}
+
+// target returns the file written to update Dest, as set by resolveDest.
+func (t *TemplateResource) target() string {
+	if t.destFile != "" {
+		return t.destFile
+	}
+	return t.Dest
+}
+
+// setFileMode sets the FileMode: the explicit mode if set, or else the mode
+// of the existing dest, or else 0666 less the umask. With only owner set it
+// also sets the Gid to the group of the existing dest.
 func (t *TemplateResource) setFileMode() error {
+	if t.keepGroup && util.IsFileExist(t.Dest) {
+		fi, err := util.FileStat(t.Dest)
+		if err != nil {
+			return err
+		}
+		t.Gid = int(fi.Gid)
+	}
 	if t.Mode == "" {
 		if !util.IsFileExist(t.Dest) {
-			t.FileMode = 0644
+			t.FileMode = 0666 &^ t.umask
 		} else {
 			fi, err := os.Stat(t.Dest)
 			if err != nil {
@@ -375,11 +1764,11 @@ func (t *TemplateResource) setFileMode() error {
 			t.FileMode = fi.Mode()
 		}
 	} else {
-		mode, err := strconv.ParseUint(t.Mode, 0, 32)
+		mode, err := util.ParseMode(t.Mode)
 		if err != nil {
 			return err
 		}
-		t.FileMode = os.FileMode(mode)
+		t.FileMode = mode
 	}
 	return nil
 }
@@ -1,14 +1,25 @@
 package template
 
 import (
+	"bytes"
+	"errors"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"text/template"
+	"time"
 
+	"github.com/kelseyhightower/confd/backends"
 	"github.com/kelseyhightower/confd/backends/env"
+	"github.com/kelseyhightower/confd/backends/file"
 	"github.com/kelseyhightower/confd/log"
+	util "github.com/kelseyhightower/confd/util"
 )
 
 // createTempDirs is a helper function which creates temporary directories
@@ -107,3 +118,2813 @@ func TestProcessTemplateResources(t *testing.T) {
 		t.Errorf("Expected contents of dest == '%s', got %s", expected, string(results))
 	}
 }
+
+// mockStoreClient is a backends.TTLStoreClient and
+// backends.WriteStoreClient serving key/value pairs from memory and
+// recording the keys written. Like the real backends, a requested key
+// matches every stored key it prefixes.
+type mockStoreClient struct {
+	sync.Mutex
+	values map[string]string
+	ttls   map[string]int64
+	writes []string
+}
+
+// set stores value under key, safe for use while the client is queried.
+func (c *mockStoreClient) set(key, value string) {
+	c.Lock()
+	c.values[key] = value
+	c.Unlock()
+}
+
+func (c *mockStoreClient) GetValues(keys []string) (map[string]string, error) {
+	vars, _, err := c.GetValuesWithTTL(keys)
+	return vars, err
+}
+
+func (c *mockStoreClient) GetValuesWithTTL(keys []string) (map[string]string, map[string]int64, error) {
+	c.Lock()
+	defer c.Unlock()
+	vars := make(map[string]string)
+	ttls := make(map[string]int64)
+	for k, v := range c.values {
+		for _, key := range keys {
+			if strings.HasPrefix(k, key) {
+				vars[k] = v
+				if ttl, ok := c.ttls[k]; ok {
+					ttls[k] = ttl
+				}
+			}
+		}
+	}
+	return vars, ttls, nil
+}
+
+func (c *mockStoreClient) SetValue(key, value string) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.values == nil {
+		c.values = make(map[string]string)
+	}
+	c.values[key] = value
+	c.writes = append(c.writes, key)
+	return nil
+}
+
+func (c *mockStoreClient) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	<-stopChan
+	return 0, nil
+}
+
+// testConfig returns the Config of a confd instance using confDir and
+// storeClient.
+func testConfig(confDir string, storeClient backends.StoreClient) Config {
+	return Config{
+		ConfDir:     confDir,
+		ConfigDir:   filepath.Join(confDir, "conf.d"),
+		StoreClient: storeClient,
+		TemplateDir: filepath.Join(confDir, "templates"),
+	}
+}
+
+// newTestResource writes resourceToml to conf.d and tmpl to the templates
+// directory of confDir, then loads the template resource backed by
+// storeClient.
+func newTestResource(t *testing.T, confDir, resourceToml, tmpl string, storeClient backends.StoreClient) *TemplateResource {
+	resourcePath := filepath.Join(confDir, "conf.d", "test.toml")
+	if err := ioutil.WriteFile(resourcePath, []byte(resourceToml), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ioutil.WriteFile(filepath.Join(confDir, "templates", "test.tmpl"), []byte(tmpl), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	tr, err := NewTemplateResource(resourcePath, testConfig(confDir, storeClient))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return tr
+}
+
+func TestSetVarsSkipsExpiringKeys(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	storeClient := &mockStoreClient{
+		values: map[string]string{
+			"/app/members/a": "10.0.0.1",
+			"/app/members/b": "10.0.0.2",
+			"/app/members/c": "10.0.0.3",
+		},
+		ttls: map[string]int64{
+			"/app/members/a": 60,
+			"/app/members/b": 3,
+		},
+	}
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + filepath.Join(confDir, "test.conf") + `"
+prefix = "/app"
+min_ttl = 5
+keys = ["/members"]
+`
+	tmpl := `{{range gets "/members/*"}}{{base .Key}}={{ttlRemaining .Key}}
+{{end}}`
+	tr := newTestResource(t, confDir, resourceToml, tmpl, storeClient)
+	if err := tr.setVars(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if tr.store.Exists("/members/b") {
+		t.Errorf("key /members/b expiring in 3s was not skipped with min_ttl = 5")
+	}
+	if err := tr.createStageFile(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Remove(tr.StageFile.Name())
+	actual, err := ioutil.ReadFile(tr.StageFile.Name())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := "a=60\nc=0\n"
+	if string(actual) != expected {
+		t.Errorf("Expected contents of stage file == '%s', got '%s'", expected, string(actual))
+	}
+}
+
+// leaderClient is a mockStoreClient reporting a fixed cluster leader.
+type leaderClient struct {
+	*mockStoreClient
+	leader string
+	err    error
+}
+
+func (c *leaderClient) ClusterLeader() (string, error) {
+	return c.leader, c.err
+}
+
+func TestClusterHealthFuncs(t *testing.T) {
+	log.SetLevel("panic")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "test.conf")
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/app"]
+`
+	tmpl := `leader = {{clusterLeader}}
+writable = {{backendHealthy}}
+`
+	values := map[string]string{"/app/port": "8080"}
+	tests := []struct {
+		desc   string
+		client *leaderClient
+		want   string
+	}{
+		{"healthy", &leaderClient{mockStoreClient: &mockStoreClient{values: values}, leader: "etcd-1"}, "leader = etcd-1\nwritable = true\n"},
+		{"degraded", &leaderClient{mockStoreClient: &mockStoreClient{values: values}}, "leader = \nwritable = false\n"},
+	}
+	for _, tt := range tests {
+		tr := newTestResource(t, confDir, resourceToml, tmpl, tt.client)
+		if err := tr.process(); err != nil {
+			t.Errorf("%s: process() returned %s", tt.desc, err.Error())
+			continue
+		}
+		if got, err := ioutil.ReadFile(dest); err != nil || string(got) != tt.want {
+			t.Errorf("%s: dest = %q, %v, want %q", tt.desc, string(got), err, tt.want)
+		}
+	}
+
+	// An unreachable cluster is unhealthy, but has no leader to render.
+	unreachable := &leaderClient{mockStoreClient: &mockStoreClient{values: values}, err: errors.New("connection refused")}
+	tr := newTestResource(t, confDir, resourceToml, "writable = {{backendHealthy}}\n", unreachable)
+	if err := tr.process(); err != nil {
+		t.Errorf("unreachable: process() returned %s", err.Error())
+	} else if got, _ := ioutil.ReadFile(dest); string(got) != "writable = false\n" {
+		t.Errorf("unreachable: dest = %q, want writable = false", string(got))
+	}
+	tr = newTestResource(t, confDir, resourceToml, tmpl, unreachable)
+	if err := tr.process(); err == nil {
+		t.Error("unreachable: clusterLeader rendered without a leader")
+	}
+
+	// Backends that cannot tell their leader fail the render.
+	tr = newTestResource(t, confDir, resourceToml, tmpl, &mockStoreClient{values: values})
+	if err := tr.process(); err == nil || !strings.Contains(err.Error(), "leader") {
+		t.Errorf("process() with a backend without a leader = %v, want an error", err)
+	}
+}
+
+func TestDryRunRunsCheckCmd(t *testing.T) {
+	log.SetLevel("warn")
+	var tests = []struct {
+		desc     string
+		checkCmd string
+		wantErr  bool
+	}{
+		{"passing check", "grep -q bar {{.src}}", false},
+		{"failing check", "grep -q baz {{.src}}", true},
+	}
+	for _, tt := range tests {
+		confDir, err := createTempDirs()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer os.RemoveAll(confDir)
+
+		dest := filepath.Join(confDir, "test.conf")
+		if err := ioutil.WriteFile(dest, []byte("foo = old"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/foo"]
+check_cmd = "` + tt.checkCmd + `"
+reload_cmd = "touch ` + filepath.Join(confDir, "reloaded") + `"
+`
+		storeClient := &mockStoreClient{values: map[string]string{"/foo": "bar"}}
+		tr := newTestResource(t, confDir, resourceToml, `foo = {{getv "/foo"}}`, storeClient)
+		tr.dryRun = true
+
+		err = tr.process()
+		if tt.wantErr && err == nil {
+			t.Errorf("%s: expected an error in dry run mode", tt.desc)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("%s: unexpected error in dry run mode: %s", tt.desc, err.Error())
+		}
+		contents, err := ioutil.ReadFile(dest)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(contents) != "foo = old" {
+			t.Errorf("%s: dest modified in dry run mode: %s", tt.desc, string(contents))
+		}
+		if util.IsFileExist(filepath.Join(confDir, "reloaded")) {
+			t.Errorf("%s: reload_cmd ran in dry run mode", tt.desc)
+		}
+	}
+}
+
+func TestShadowRootRedirectsWrites(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "etc", "app", "app.conf")
+	reloaded := filepath.Join(confDir, "reloaded")
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/foo"]
+reload_cmd = "touch ` + reloaded + `"
+`
+	if err := ioutil.WriteFile(filepath.Join(confDir, "conf.d", "test.toml"), []byte(resourceToml), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ioutil.WriteFile(filepath.Join(confDir, "templates", "test.tmpl"), []byte(`foo = {{getv "/foo"}}`), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	shadowRoot := filepath.Join(confDir, "shadow")
+	config := testConfig(confDir, &mockStoreClient{values: map[string]string{"/foo": "bar"}})
+	config.ShadowRoot = shadowRoot
+
+	if err := Process(config); err != nil {
+		t.Fatal(err.Error())
+	}
+	contents, err := ioutil.ReadFile(filepath.Join(shadowRoot, dest))
+	if err != nil {
+		t.Fatalf("shadow file was not written: %s", err.Error())
+	}
+	if string(contents) != "foo = bar" {
+		t.Errorf("shadow file = %q, want %q", string(contents), "foo = bar")
+	}
+	if util.IsFileExist(dest) {
+		t.Errorf("real dest %s was written in shadow mode", dest)
+	}
+	if util.IsFileExist(reloaded) {
+		t.Errorf("reload_cmd ran in shadow mode")
+	}
+}
+
+func TestCommandsRunWithResourceEnv(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "test.conf")
+	envFile := filepath.Join(confDir, "env")
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/app"]
+check_cmd = "test \"$CONFD_DEST\" = ` + dest + `"
+reload_cmd = "env > ` + envFile + `"
+
+[template.env]
+SERVICE = "web"
+`
+	storeClient := &mockStoreClient{values: map[string]string{"/app/host": "a", "/app/port": "80"}}
+	tr := newTestResource(t, confDir, resourceToml, `{{getv "/app/host"}}:{{getv "/app/port"}}`, storeClient)
+
+	readEnv := func() map[string]string {
+		contents, err := ioutil.ReadFile(envFile)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		env := make(map[string]string)
+		for _, line := range strings.Split(string(contents), "\n") {
+			if i := strings.Index(line, "="); i > 0 {
+				env[line[:i]] = line[i+1:]
+			}
+		}
+		return env
+	}
+
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	want := map[string]string{
+		"CONFD_DEST":         dest,
+		"CONFD_SRC":          filepath.Join(confDir, "templates", "test.tmpl"),
+		"CONFD_RESOURCE":     "test",
+		"CONFD_CHANGED_KEYS": "/app/host /app/port",
+		"SERVICE":            "web",
+	}
+	env := readEnv()
+	for k, v := range want {
+		if env[k] != v {
+			t.Errorf("%s = %q, want %q", k, env[k], v)
+		}
+	}
+
+	storeClient.set("/app/port", "8080")
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if got := readEnv()["CONFD_CHANGED_KEYS"]; got != "/app/port" {
+		t.Errorf("CONFD_CHANGED_KEYS = %q after changing /app/port", got)
+	}
+
+	// Resources are recreated on every cycle in interval mode.
+	storeClient.set("/app/host", "b")
+	tr = newTestResource(t, confDir, resourceToml, `{{getv "/app/host"}}:{{getv "/app/port"}}`, storeClient)
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if got := readEnv()["CONFD_CHANGED_KEYS"]; got != "/app/host" {
+		t.Errorf("CONFD_CHANGED_KEYS = %q after changing /app/host in a new cycle", got)
+	}
+}
+
+func TestMaxConcurrentReloads(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	running := filepath.Join(confDir, "running")
+	if err := os.Mkdir(running, 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	counts := filepath.Join(confDir, "counts")
+	// Every command records how many commands are running, itself included.
+	reloadCmd := "touch " + running + "/$$; ls " + running + " | wc -l >> " + counts + "; sleep 0.05; rm " + running + "/$$"
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + filepath.Join(confDir, "test.conf") + `"
+keys = ["/foo"]
+reload_cmd = "` + reloadCmd + `"
+`
+	resourcePath := filepath.Join(confDir, "conf.d", "test.toml")
+	if err := ioutil.WriteFile(resourcePath, []byte(resourceToml), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	config := testConfig(confDir, &mockStoreClient{})
+	config.MaxConcurrentReloads = 2
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		tr, err := NewTemplateResource(resourcePath, config)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := tr.reload(nil); err != nil {
+				t.Error(err.Error())
+			}
+		}()
+	}
+	wg.Wait()
+
+	contents, err := ioutil.ReadFile(counts)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	lines := strings.Fields(string(contents))
+	if len(lines) != 8 {
+		t.Errorf("%d commands ran, want 8", len(lines))
+	}
+	for _, line := range lines {
+		if n, _ := strconv.Atoi(line); n > 2 {
+			t.Errorf("%d commands ran at once, want at most 2", n)
+		}
+	}
+}
+
+func TestSymlinkedDest(t *testing.T) {
+	log.SetLevel("panic")
+	for _, follow := range []bool{true, false} {
+		confDir, err := createTempDirs()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer os.RemoveAll(confDir)
+
+		target := filepath.Join(confDir, "real.conf")
+		if err := ioutil.WriteFile(target, []byte("foo = old"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		dest := filepath.Join(confDir, "test.conf")
+		if err := os.Symlink("real.conf", dest); err != nil {
+			t.Fatal(err.Error())
+		}
+		resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/foo"]
+`
+		storeClient := &mockStoreClient{values: map[string]string{"/foo": "bar"}}
+		tr := newTestResource(t, confDir, resourceToml, `foo = {{getv "/foo"}}`, storeClient)
+		// testConfig leaves NoFollowSymlinks unset, so links are followed.
+		if !follow {
+			tr.followLinks = false
+		}
+
+		err = tr.process()
+		if fi, lerr := os.Lstat(dest); lerr != nil || fi.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("follow=%v: dest is no longer a symlink", follow)
+		}
+		contents, rerr := ioutil.ReadFile(target)
+		if rerr != nil {
+			t.Fatal(rerr.Error())
+		}
+		if follow {
+			if err != nil {
+				t.Errorf("follow=%v: unexpected error: %s", follow, err.Error())
+			}
+			if string(contents) != "foo = bar" {
+				t.Errorf("follow=%v: symlink target = %q, want %q", follow, string(contents), "foo = bar")
+			}
+		} else {
+			if err == nil {
+				t.Errorf("follow=%v: expected an error for a symlinked dest", follow)
+			}
+			if string(contents) != "foo = old" {
+				t.Errorf("follow=%v: symlink target modified: %q", follow, string(contents))
+			}
+		}
+	}
+}
+
+func TestDestIsDirectory(t *testing.T) {
+	log.SetLevel("panic")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dir := filepath.Join(confDir, "test.conf")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	link := filepath.Join(confDir, "link.conf")
+	if err := os.Symlink("test.conf", link); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, dest := range []string{dir, link} {
+		resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/foo"]
+`
+		storeClient := &mockStoreClient{values: map[string]string{"/foo": "bar"}}
+		tr := newTestResource(t, confDir, resourceToml, `foo = {{getv "/foo"}}`, storeClient)
+		tr.followLinks = true
+		err := tr.process()
+		if err == nil {
+			t.Errorf("%s: process() succeeded with a directory as dest", dest)
+			continue
+		}
+		if Kind(err) != ConfigFailure || !strings.Contains(err.Error(), "test.toml") || !strings.Contains(err.Error(), dir) || !strings.Contains(err.Error(), "a directory") {
+			t.Errorf("%s: process() = %v, want a ConfigFailure naming the resource and %s", dest, err, dir)
+		}
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("files were written to the directory: %v", files)
+	}
+}
+
+func TestSetVarsScopesKeysToResource(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	storeClient := &mockStoreClient{values: map[string]string{
+		"/app/web/port":  "80",
+		"/app/web/host":  "web.local",
+		"/app/db/port":   "5432",
+		"/other/secrets": "hunter2",
+	}}
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + filepath.Join(confDir, "test.conf") + `"
+prefix = "/app"
+keys = ["/web"]
+`
+	tr := newTestResource(t, confDir, resourceToml, `{{getv "/web/port"}}`, storeClient)
+	if err := tr.setVars(); err != nil {
+		t.Fatal(err.Error())
+	}
+	kvs, err := tr.store.GetAll("/*/*")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var keys []string
+	for _, kv := range kvs {
+		keys = append(keys, kv.Key)
+	}
+	sort.Strings(keys)
+	want := []string{"/web/host", "/web/port"}
+	if strings.Join(keys, " ") != strings.Join(want, " ") {
+		t.Errorf("store holds %v, want only %v", keys, want)
+	}
+	if len(tr.lastValues) != 2 {
+		t.Errorf("fetched %v, want only the keys under /app/web", tr.lastValues)
+	}
+}
+
+func TestPerKeyTemplate(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "test.conf")
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+prefix = "/app"
+keys = ["/"]
+per_key = true
+`
+	storeClient := &mockStoreClient{values: map[string]string{
+		"/app/port":       "8080",
+		"/app/db/host":    "db.local",
+		"/app/cache/size": "64m",
+	}}
+	tmpl := `export APP{{replace (toUpper .Key) "/" "_" -1}}={{printf "%q" .Value}}
+`
+	tr := newTestResource(t, confDir, resourceToml, tmpl, storeClient)
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	contents, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := `export APP_CACHE_SIZE="64m"
+export APP_DB_HOST="db.local"
+export APP_PORT="8080"
+`
+	if string(contents) != want {
+		t.Errorf("per_key rendering = %q, want %q", string(contents), want)
+	}
+}
+
+func TestLockDestSerializesWriters(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "test.conf")
+	events := filepath.Join(confDir, "events")
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/foo"]
+reload_cmd = "echo start >> ` + events + `; sleep 0.1; echo end >> ` + events + `"
+`
+	var writers []*TemplateResource
+	for _, value := range []string{"a", "b"} {
+		storeClient := &mockStoreClient{values: map[string]string{"/foo": value}}
+		tr := newTestResource(t, confDir, resourceToml, `foo = {{getv "/foo"}}`, storeClient)
+		tr.lockDest = true
+		writers = append(writers, tr)
+	}
+
+	var wg sync.WaitGroup
+	for _, tr := range writers {
+		wg.Add(1)
+		go func(tr *TemplateResource) {
+			defer wg.Done()
+			if err := tr.process(); err != nil {
+				t.Error(err.Error())
+			}
+		}(tr)
+	}
+	wg.Wait()
+
+	contents, err := ioutil.ReadFile(events)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got := strings.Fields(string(contents)); strings.Join(got, " ") != "start end start end" {
+		t.Errorf("reloads interleaved: %v", got)
+	}
+}
+
+func TestStdoutDest(t *testing.T) {
+	log.SetLevel("debug")
+	defer log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	reloaded := filepath.Join(confDir, "reloaded")
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "-"
+keys = ["/foo"]
+reload_cmd = "touch ` + reloaded + `"
+`
+	storeClient := &mockStoreClient{values: map[string]string{"/foo": "bar"}}
+	tr := newTestResource(t, confDir, resourceToml, "foo = {{getv \"/foo\"}}\n", storeClient)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	err = tr.process()
+	os.Stdout = stdout
+	w.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	output, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(output) != "foo = bar\n" {
+		t.Errorf("stdout = %q, want only the rendered template", string(output))
+	}
+	if util.IsFileExist("-") || util.IsFileExist(reloaded) {
+		t.Errorf("rendering to stdout wrote a file or ran reload_cmd")
+	}
+}
+
+func TestSetVarsMergesPrefixes(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	storeClient := &mockStoreClient{
+		values: map[string]string{
+			"/defaults/db/host":       "127.0.0.1",
+			"/defaults/db/port":       "5432",
+			"/defaults/log/level":     "info",
+			"/overrides/prod/db/host": "db.prod",
+			"/overrides/prod/region":  "eu-west-1",
+			"/overrides/dev/db/host":  "db.dev",
+		},
+	}
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + filepath.Join(confDir, "test.conf") + `"
+prefixes = ["/defaults", "overrides/prod"]
+keys = ["/"]
+`
+	tr := newTestResource(t, confDir, resourceToml, "", storeClient)
+	if err := tr.setVars(); err != nil {
+		t.Fatal(err.Error())
+	}
+	want := map[string]string{
+		"/db/host":   "db.prod",
+		"/db/port":   "5432",
+		"/log/level": "info",
+		"/region":    "eu-west-1",
+	}
+	for k, v := range want {
+		got, err := tr.store.GetValue(k)
+		if err != nil {
+			t.Errorf("key %s missing from merged view", k)
+			continue
+		}
+		if got != v {
+			t.Errorf("getv %s = %s, want %s", k, got, v)
+		}
+	}
+	if kvs, _ := tr.store.GetAll("/*/*"); len(kvs) != 3 {
+		t.Errorf("merged view has %d nested keys, want 3: %v", len(kvs), kvs)
+	}
+}
+
+func TestResourcePrefixOverridesGlobalPrefix(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	storeClient := &mockStoreClient{
+		values: map[string]string{
+			"/production/db/host":   "db.prod",
+			"/app/frontend/db/host": "db.frontend",
+		},
+	}
+	resourcePath := filepath.Join(confDir, "conf.d", "test.toml")
+	config := testConfig(confDir, storeClient)
+	config.Prefix = "/production"
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"", "db.prod"},
+		{`prefix = "app/frontend"`, "db.frontend"},
+	}
+	for _, tt := range tests {
+		resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + filepath.Join(confDir, "test.conf") + `"
+keys = ["/db"]
+` + tt.prefix + `
+`
+		if err := ioutil.WriteFile(resourcePath, []byte(resourceToml), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		tr, err := NewTemplateResource(resourcePath, config)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := tr.setVars(); err != nil {
+			t.Fatal(err.Error())
+		}
+		if got, err := tr.store.GetValue("/db/host"); err != nil || got != tt.want {
+			t.Errorf("%q: getv /db/host = %q, %v, want %q", tt.prefix, got, err, tt.want)
+		}
+	}
+}
+
+func TestPrefixSlashes(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	storeClient := &mockStoreClient{
+		values: map[string]string{
+			"/foo/db/host":    "db.foo",
+			"/foobar/db/host": "db.foobar",
+		},
+	}
+	resourcePath := filepath.Join(confDir, "conf.d", "test.toml")
+	for _, tt := range []struct {
+		global, prefix string
+		key            string
+	}{
+		{"", "", "/foo/db/host"},
+		{"/", "", "/foo/db/host"},
+		{"", "/", "/foo/db/host"},
+		{"", "/foo", "/db/host"},
+		{"", "/foo/", "/db/host"},
+		{"", "foo", "/db/host"},
+		{"foo/", "", "/db/host"},
+	} {
+		resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + filepath.Join(confDir, "test.conf") + `"
+prefix = "` + tt.prefix + `"
+keys = ["/"]
+`
+		if err := ioutil.WriteFile(resourcePath, []byte(resourceToml), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		config := testConfig(confDir, storeClient)
+		config.Prefix = tt.global
+		tr, err := NewTemplateResource(resourcePath, config)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := tr.setVars(); err != nil {
+			t.Fatal(err.Error())
+		}
+		if got, err := tr.store.GetValue(tt.key); err != nil || got != "db.foo" {
+			t.Errorf("prefix %q, global %q: getv %s = %q, %v, want db.foo", tt.prefix, tt.global, tt.key, got, err)
+		}
+		if tt.key == "/db/host" && tr.store.Exists("/bar/db/host") {
+			t.Errorf("prefix %q, global %q: /foobar/db/host was read as /bar/db/host", tt.prefix, tt.global)
+		}
+	}
+}
+
+func TestLsUnderResourcePrefix(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "test.conf")
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+prefix = "/production"
+keys = ["/upstreams"]
+`
+	storeClient := &mockStoreClient{
+		values: map[string]string{
+			"/production/upstreams/web2/addr": "10.0.0.2:80",
+			"/production/upstreams/web1/addr": "10.0.0.1:80",
+			"/production/upstreams/weight":    "5",
+			"/staging/upstreams/web3/addr":    "10.0.1.3:80",
+		},
+	}
+	tmpl := `ls:{{range ls "/upstreams"}} {{.}}{{end}}
+lsdir:{{range lsdir "/upstreams"}} {{.}}{{end}}
+missing: {{len (ls "/missing")}} {{len (lsdir "/missing")}}
+`
+	tr := newTestResource(t, confDir, resourceToml, tmpl, storeClient)
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	want := "ls: web1 web2 weight\nlsdir: web1 web2\nmissing: 0 0\n"
+	if got, _ := ioutil.ReadFile(dest); string(got) != want {
+		t.Errorf("dest = %q, want %q", string(got), want)
+	}
+}
+
+func TestCommonPrefix(t *testing.T) {
+	var tests = []struct {
+		prefixes []string
+		want     string
+	}{
+		{[]string{"/app"}, "/app"},
+		{[]string{"/defaults", "/overrides/prod"}, "/"},
+		{[]string{"/app/defaults", "/app/overrides/prod"}, "/app"},
+		{[]string{"/app/db", "/app/db/prod"}, "/app/db"},
+	}
+	for _, tt := range tests {
+		if got := commonPrefix(tt.prefixes); got != tt.want {
+			t.Errorf("commonPrefix(%v) = %s, want %s", tt.prefixes, got, tt.want)
+		}
+	}
+}
+
+func TestProcessWaitsForRequiredKeys(t *testing.T) {
+	log.SetLevel("warn")
+	defer func(b time.Duration) { requiredKeysBackoff = b }(requiredKeysBackoff)
+	requiredKeysBackoff = 10 * time.Millisecond
+
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "test.conf")
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/db"]
+required_keys = ["/db/host", "/db/port"]
+`
+	storeClient := &mockStoreClient{values: map[string]string{"/db/host": "127.0.0.1"}}
+	newTestResource(t, confDir, resourceToml, `{{getv "/db/host"}}:{{getv "/db/port"}}`, storeClient)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		storeClient.set("/db/port", "5432")
+	}()
+
+	c := testConfig(confDir, storeClient)
+	c.FirstRunTimeout = 5
+	if err := Process(c); err != nil {
+		t.Fatal(err.Error())
+	}
+	contents, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(contents) != "127.0.0.1:5432" {
+		t.Errorf("Expected contents of dest == '127.0.0.1:5432', got '%s'", string(contents))
+	}
+}
+
+func TestProcessTimesOutWaitingForRequiredKeys(t *testing.T) {
+	log.SetLevel("warn")
+	defer func(b time.Duration) { requiredKeysBackoff = b }(requiredKeysBackoff)
+	requiredKeysBackoff = 10 * time.Millisecond
+
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "test.conf")
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/db"]
+required_keys = ["/db/host", "/db/port"]
+`
+	storeClient := &mockStoreClient{values: map[string]string{"/db/host": "127.0.0.1"}}
+	newTestResource(t, confDir, resourceToml, `{{getv "/db/host"}}`, storeClient)
+
+	c := testConfig(confDir, storeClient)
+	c.FirstRunTimeout = 1
+	start := time.Now()
+	err = Process(c)
+	if err == nil || !strings.Contains(err.Error(), "/db/port") {
+		t.Errorf("Process() error = %v, want a timeout naming /db/port", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("Process() gave up after %s, want at least 1s", elapsed)
+	}
+	if util.IsFileExist(dest) {
+		t.Errorf("dest rendered although required keys never appeared")
+	}
+}
+
+func TestMatrixAddsAndPrunesEntries(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + filepath.Join(confDir, "{{.Name}}.conf") + `"
+keys = ["/envs"]
+matrix = "/envs"
+`
+	storeClient := &mockStoreClient{values: map[string]string{
+		"/envs/prod/port": "80",
+		"/envs/dev/port":  "8080",
+	}}
+	tmpl := `{{.Name}} port = {{getv (printf "%s/port" .Key)}}`
+
+	check := func(want map[string]string, gone ...string) {
+		// Resources are recreated on every cycle in interval mode.
+		tr := newTestResource(t, confDir, resourceToml, tmpl, storeClient)
+		if err := tr.process(); err != nil {
+			t.Fatal(err.Error())
+		}
+		for name, contents := range want {
+			got, err := ioutil.ReadFile(filepath.Join(confDir, name+".conf"))
+			if err != nil {
+				t.Errorf("%s.conf was not written: %s", name, err.Error())
+				continue
+			}
+			if string(got) != contents {
+				t.Errorf("%s.conf = %q, want %q", name, string(got), contents)
+			}
+		}
+		for _, name := range gone {
+			if util.IsFileExist(filepath.Join(confDir, name+".conf")) {
+				t.Errorf("%s.conf of a removed entry was not pruned", name)
+			}
+		}
+	}
+
+	check(map[string]string{"prod": "prod port = 80", "dev": "dev port = 8080"})
+
+	storeClient.Lock()
+	delete(storeClient.values, "/envs/dev/port")
+	storeClient.values["/envs/staging/port"] = "8000"
+	storeClient.Unlock()
+	check(map[string]string{"prod": "prod port = 80", "staging": "staging port = 8000"}, "dev")
+}
+
+func TestMatrixIsolatesEntries(t *testing.T) {
+	log.SetLevel("panic")
+	storeClient := &mockStoreClient{values: map[string]string{
+		"/envs/prod/port":    "80",
+		"/envs/dev/port":     "8080",
+		"/envs/staging/host": "staging",
+	}}
+	tmpl := `{{.Name}} port = {{getv (printf "%s/port" .Key)}}`
+
+	for _, allOrNothing := range []bool{false, true} {
+		confDir, err := createTempDirs()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer os.RemoveAll(confDir)
+
+		resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + filepath.Join(confDir, "{{.Name}}.conf") + `"
+keys = ["/envs"]
+matrix = "/envs"
+matrix_all_or_nothing = ` + strconv.FormatBool(allOrNothing) + `
+`
+		tr := newTestResource(t, confDir, resourceToml, tmpl, storeClient)
+		err = tr.process()
+		if err == nil {
+			t.Fatalf("matrix_all_or_nothing = %v: expected an error for the staging entry", allOrNothing)
+		}
+		if !strings.Contains(err.Error(), "1 of 3 entries") {
+			t.Errorf("matrix_all_or_nothing = %v: error %q does not count the failed entry", allOrNothing, err.Error())
+		}
+		for _, name := range []string{"prod", "dev"} {
+			written := util.IsFileExist(filepath.Join(confDir, name+".conf"))
+			if written == allOrNothing {
+				t.Errorf("matrix_all_or_nothing = %v: %s.conf written = %v", allOrNothing, name, written)
+			}
+		}
+		if allOrNothing && !strings.Contains(err.Error(), "no file was written") {
+			t.Errorf("error %q does not say that no file was written", err.Error())
+		}
+	}
+}
+
+func TestDeleteOnMissing(t *testing.T) {
+	log.SetLevel("panic")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "feature.conf")
+	reloaded := filepath.Join(confDir, "reloaded")
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/feature"]
+delete_on_missing = "/feature/enabled"
+reload_cmd = "touch ` + reloaded + `"
+`
+	storeClient := &mockStoreClient{values: map[string]string{"/feature/enabled": "true"}}
+	tr := newTestResource(t, confDir, resourceToml, `include feature.d/*.conf`, storeClient)
+
+	// Key present: the file is rendered.
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !util.IsFileExist(dest) {
+		t.Fatalf("%s was not rendered while the key is present", dest)
+	}
+	os.Remove(reloaded)
+
+	// Key absent: the file is deleted and the service reloaded.
+	storeClient.Lock()
+	delete(storeClient.values, "/feature/enabled")
+	storeClient.Unlock()
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if util.IsFileExist(dest) {
+		t.Errorf("%s was not deleted once the key is absent", dest)
+	}
+	if !util.IsFileExist(reloaded) {
+		t.Errorf("reload_cmd did not run after deleting %s", dest)
+	}
+
+	// Files confd did not write are left alone.
+	if err := ioutil.WriteFile(dest, []byte("hand written"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !util.IsFileExist(dest) {
+		t.Errorf("%s was deleted although confd did not write it", dest)
+	}
+}
+
+func TestCheckCmdRetries(t *testing.T) {
+	log.SetLevel("panic")
+	var tests = []struct {
+		desc     string
+		attempts int
+		wantErr  bool
+	}{
+		{"within the retry budget", 3, false},
+		{"retries exhausted", 2, true},
+	}
+	for _, tt := range tests {
+		confDir, err := createTempDirs()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer os.RemoveAll(confDir)
+
+		dest := filepath.Join(confDir, "test.conf")
+		if err := ioutil.WriteFile(dest, []byte("foo = old"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		// The check fails twice, then succeeds.
+		counter := filepath.Join(confDir, "attempts")
+		checkCmd := "n=$(cat " + counter + " 2>/dev/null || echo 0); n=$((n+1)); echo $n > " + counter + "; [ $n -ge 3 ]"
+		resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/foo"]
+check_cmd = "` + checkCmd + `"
+check_attempts = ` + strconv.Itoa(tt.attempts) + `
+check_delay = "10ms"
+`
+		storeClient := &mockStoreClient{values: map[string]string{"/foo": "bar"}}
+		tr := newTestResource(t, confDir, resourceToml, `foo = {{getv "/foo"}}`, storeClient)
+
+		err = tr.process()
+		contents, rerr := ioutil.ReadFile(dest)
+		if rerr != nil {
+			t.Fatal(rerr.Error())
+		}
+		if tt.wantErr {
+			if Kind(err) != CheckFailure {
+				t.Errorf("%s: process() = %v, want a check failure", tt.desc, err)
+			}
+			if string(contents) != "foo = old" {
+				t.Errorf("%s: dest modified after the check failed: %q", tt.desc, string(contents))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.desc, err.Error())
+		}
+		if string(contents) != "foo = bar" {
+			t.Errorf("%s: dest = %q, want %q", tt.desc, string(contents), "foo = bar")
+		}
+	}
+}
+
+func TestFailedCheckCmdKeepsDest(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetLevel("error")
+	defer func() {
+		log.SetLevel("warn")
+		log.SetOutput(os.Stderr)
+	}()
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "test.conf")
+	if err := ioutil.WriteFile(dest, []byte("foo = old"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/foo"]
+check_cmd = "echo unknown directive in {{.src}} >&2; exit 1"
+`
+	storeClient := &mockStoreClient{values: map[string]string{"/foo": "bar"}}
+	tr := newTestResource(t, confDir, resourceToml, `foo = {{getv "/foo"}}`, storeClient)
+
+	if err := tr.process(); Kind(err) != CheckFailure {
+		t.Errorf("process() = %v, want a check failure", err)
+	}
+	if contents, err := ioutil.ReadFile(dest); err != nil || string(contents) != "foo = old" {
+		t.Errorf("dest = %q, %v after the check failed, want it untouched", string(contents), err)
+	}
+	if _, err := os.Stat(tr.StageFile.Name()); !os.IsNotExist(err) {
+		t.Errorf("staged file %s left behind after the check failed", tr.StageFile.Name())
+	}
+	if !strings.Contains(buf.String(), "unknown directive in "+tr.StageFile.Name()) {
+		t.Errorf("the stderr of check_cmd was not logged: %q", buf.String())
+	}
+}
+
+func TestReloadCmdRunsOnlyOnChange(t *testing.T) {
+	log.SetLevel("panic")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "test.conf")
+	reloads := filepath.Join(confDir, "reloads")
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/foo"]
+reload_cmd = "echo reload >> ` + reloads + `"
+`
+	storeClient := &mockStoreClient{values: map[string]string{"/foo": "bar"}}
+	tr := newTestResource(t, confDir, resourceToml, `foo = {{getv "/foo"}}`, storeClient)
+	for i := 0; i < 3; i++ {
+		if err := tr.process(); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if got, _ := ioutil.ReadFile(reloads); string(got) != "reload\n" {
+		t.Errorf("reload_cmd ran %d times for a single change, want once", strings.Count(string(got), "reload"))
+	}
+
+	// A failed reload fails the resource, even though dest was updated.
+	resourceToml = strings.Replace(resourceToml, "echo reload >> "+reloads, "exit 1", 1)
+	tr = newTestResource(t, confDir, resourceToml, `foo = {{getv "/foo"}}`, storeClient)
+	storeClient.set("/foo", "baz")
+	if err := tr.process(); Kind(err) != ReloadFailure {
+		t.Errorf("process() with a failing reload_cmd = %v, want a ReloadFailure", err)
+	}
+	if got, _ := ioutil.ReadFile(dest); string(got) != "foo = baz" {
+		t.Errorf("dest = %q, want the update applied before the reload", string(got))
+	}
+}
+
+func TestNoopLogsReloadCmd(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetLevel("warn")
+	defer log.SetOutput(os.Stderr)
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "test.conf")
+	reloads := filepath.Join(confDir, "reloads")
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/foo"]
+reload_cmd = "echo reload >> ` + reloads + `"
+`
+	storeClient := &mockStoreClient{values: map[string]string{"/foo": "bar"}}
+	tr := newTestResource(t, confDir, resourceToml, `foo = {{getv "/foo"}}`, storeClient)
+	tr.noop = true
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := os.Stat(reloads); !os.IsNotExist(err) {
+		t.Error("reload_cmd ran in noop mode")
+	}
+	if !strings.Contains(buf.String(), "Would run reload_cmd: echo reload") {
+		t.Errorf("the reload_cmd noop mode skipped was not logged: %q", buf.String())
+	}
+}
+
+func TestSkipOnEmpty(t *testing.T) {
+	log.SetLevel("panic")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "test.conf")
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/app"]
+skip_on_empty = true
+`
+	tests := []struct {
+		desc   string
+		values map[string]string
+		want   string
+	}{
+		{"empty", map[string]string{"/other/port": "9090"}, "port = 80"},
+		{"normal", map[string]string{"/app/port": "8080"}, "port = 8080"},
+	}
+	for _, tt := range tests {
+		if err := ioutil.WriteFile(dest, []byte("port = 80"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		tmpl := `port = {{getv "/app/port" "none"}}`
+		tr := newTestResource(t, confDir, resourceToml, tmpl, &mockStoreClient{values: tt.values})
+		if err := tr.process(); err != nil {
+			t.Errorf("%s: process() returned %s", tt.desc, err.Error())
+		}
+		if got, _ := ioutil.ReadFile(dest); string(got) != tt.want {
+			t.Errorf("%s: dest = %q, want %q", tt.desc, string(got), tt.want)
+		}
+	}
+}
+
+func TestNoopLogsDiff(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetLevel("info")
+	defer func() {
+		log.SetLevel("warn")
+		log.SetOutput(os.Stderr)
+	}()
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "test.conf")
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/app"]
+`
+	tmpl := "host = {{getv \"/app/host\"}}\nport = {{getv \"/app/port\"}}\n"
+	storeClient := &mockStoreClient{values: map[string]string{"/app/host": "db1", "/app/port": "8080"}}
+	tests := []struct {
+		desc string
+		prev string
+		want []string
+	}{
+		{"changed", "host = db1\nport = 80\n", []string{" host = db1", "-port = 80", "+port = 8080"}},
+		{"new", "", []string{"@@ -0,0 +1,2 @@", "+host = db1", "+port = 8080"}},
+	}
+	for _, tt := range tests {
+		os.Remove(dest)
+		if tt.prev != "" {
+			if err := ioutil.WriteFile(dest, []byte(tt.prev), 0644); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		buf.Reset()
+		tr := newTestResource(t, confDir, resourceToml, tmpl, storeClient)
+		tr.noop = true
+		if err := tr.process(); err != nil {
+			t.Fatal(err.Error())
+		}
+		for _, line := range tt.want {
+			if !strings.Contains(buf.String(), line+"\n") {
+				t.Errorf("%s: noop log lacks %q: %s", tt.desc, line, buf.String())
+			}
+		}
+		if got, _ := ioutil.ReadFile(dest); string(got) != tt.prev {
+			t.Errorf("%s: noop mode modified dest: %q", tt.desc, string(got))
+		}
+	}
+}
+
+func TestNoopDiffTruncatesLargeDiffs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	staged := filepath.Join(dir, "staged")
+	if err := ioutil.WriteFile(staged, []byte(strings.Repeat("line\n", 500)), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	diff, err := noopDiff("test.conf", staged, filepath.Join(dir, "missing"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	lines := strings.Split(diff, "\n")
+	if len(lines) != maxNoopDiffLines+1 {
+		t.Errorf("diff has %d lines, want %d", len(lines), maxNoopDiffLines+1)
+	}
+	// 500 added lines less the 197 shown after the 3 header lines.
+	if want := "... 303 more lines"; lines[len(lines)-1] != want {
+		t.Errorf("diff ends with %q, want %q", lines[len(lines)-1], want)
+	}
+}
+
+func TestSetVarsLogsKeyResolution(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetLevel("info")
+	defer func() {
+		log.SetLevel("warn")
+		log.SetOutput(os.Stderr)
+	}()
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + filepath.Join(confDir, "test.conf") + `"
+prefix = "production"
+keys = ["/app", "/db"]
+`
+	config := testConfig(confDir, &mockStoreClient{values: map[string]string{"/production/app/port": "80"}})
+	resourcePath := filepath.Join(confDir, "conf.d", "test.toml")
+	if err := ioutil.WriteFile(resourcePath, []byte(resourceToml), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := 0; i < 2; i++ {
+		tr, err := NewTemplateResource(resourcePath, config)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := tr.setVars(); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	want := "queries /production/app, /production/db, 1 keys matched"
+	if n := strings.Count(buf.String(), want); n != 1 {
+		t.Errorf("log %q contains %q %d times, want once", buf.String(), want, n)
+	}
+}
+
+func TestReloadStdin(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "test.conf")
+	for _, tt := range []struct {
+		stdin string
+		want  string
+	}{
+		{"diff", "--- " + dest + "\n+++ " + dest + "\n@@ -1,3 +1,3 @@\n host = a\n-port = 80\n+port = 8080\n user = web\n"},
+		{"keys", "/app/port\n"},
+	} {
+		os.Remove(dest)
+		input := filepath.Join(confDir, "stdin")
+		resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/app"]
+reload_cmd = "cat > ` + input + `"
+reload_stdin = "` + tt.stdin + `"
+`
+		storeClient := &mockStoreClient{values: map[string]string{"/app/host": "a", "/app/port": "80"}}
+		tmpl := "host = {{getv \"/app/host\"}}\nport = {{getv \"/app/port\"}}\nuser = web\n"
+		tr := newTestResource(t, confDir, resourceToml, tmpl, storeClient)
+		if err := tr.process(); err != nil {
+			t.Fatal(err.Error())
+		}
+		storeClient.set("/app/port", "8080")
+		// Resources are recreated on every cycle in interval mode.
+		tr = newTestResource(t, confDir, resourceToml, tmpl, storeClient)
+		if err := tr.process(); err != nil {
+			t.Fatal(err.Error())
+		}
+		got, err := ioutil.ReadFile(input)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(got) != tt.want {
+			t.Errorf("reload_stdin = %s: reload_cmd read %q, want %q", tt.stdin, string(got), tt.want)
+		}
+	}
+}
+
+func TestReloadStdinInvalid(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + filepath.Join(confDir, "test.conf") + `"
+keys = ["/app"]
+reload_stdin = "values"
+`
+	resourcePath := filepath.Join(confDir, "conf.d", "test.toml")
+	if err := ioutil.WriteFile(resourcePath, []byte(resourceToml), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := NewTemplateResource(resourcePath, testConfig(confDir, &mockStoreClient{})); err == nil {
+		t.Errorf("NewTemplateResource() accepted reload_stdin = \"values\"")
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	storeClient := &mockStoreClient{values: map[string]string{
+		"/app/name":             "web",
+		"/app/db/host":          "db1",
+		"/app/db/replicas/db2":  "10.0.0.2",
+		"/app/db/replicas/db3":  "10.0.0.3",
+		"/other/deep/key/value": "x",
+	}}
+	tests := []struct {
+		global, resource int
+		want             []string
+	}{
+		{0, 0, []string{"/db/host", "/db/replicas/db2", "/db/replicas/db3", "/name"}},
+		{1, 0, []string{"/name"}},
+		{1, 2, []string{"/db/host", "/name"}},
+		{3, 0, []string{"/db/host", "/db/replicas/db2", "/db/replicas/db3", "/name"}},
+	}
+	for _, tt := range tests {
+		resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + filepath.Join(confDir, "test.conf") + `"
+prefix = "/app"
+keys = ["/"]
+max_depth = ` + strconv.Itoa(tt.resource) + `
+`
+		resourcePath := filepath.Join(confDir, "conf.d", "test.toml")
+		if err := ioutil.WriteFile(resourcePath, []byte(resourceToml), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		config := testConfig(confDir, storeClient)
+		config.MaxDepth = tt.global
+		tr, err := NewTemplateResource(resourcePath, config)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := tr.setVars(); err != nil {
+			t.Fatal(err.Error())
+		}
+		var got []string
+		for _, kv := range tr.kvPairs {
+			got = append(got, kv.Key)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("-max-depth=%d, max_depth = %d: keys = %v, want %v", tt.global, tt.resource, got, tt.want)
+		}
+	}
+}
+
+// fetchHookClient is a mockStoreClient calling onFetch before every fetch.
+type fetchHookClient struct {
+	*mockStoreClient
+	onFetch func()
+}
+
+func (c *fetchHookClient) GetValuesWithTTL(keys []string) (map[string]string, map[string]int64, error) {
+	c.onFetch()
+	return c.mockStoreClient.GetValuesWithTTL(keys)
+}
+
+// unreachableClient is a mockStoreClient whose backend cannot be reached.
+type unreachableClient struct {
+	*mockStoreClient
+}
+
+func (c *unreachableClient) GetValuesWithTTL(keys []string) (map[string]string, map[string]int64, error) {
+	return nil, nil, errors.New("dial tcp 127.0.0.1:2379: connection refused")
+}
+
+func TestGetvDefaultAppliesOnlyToMissingKeys(t *testing.T) {
+	log.SetLevel("panic")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "test.conf")
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/app"]
+`
+	tmpl := `timeout = {{getv "/app/timeout" "30"}}`
+	tr := newTestResource(t, confDir, resourceToml, tmpl, &mockStoreClient{values: map[string]string{"/app/port": "8080"}})
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if got, _ := ioutil.ReadFile(dest); string(got) != "timeout = 30" {
+		t.Errorf("dest = %q, want the default for the missing key", string(got))
+	}
+
+	tr = newTestResource(t, confDir, resourceToml, tmpl, &unreachableClient{&mockStoreClient{}})
+	if err := tr.process(); Kind(err) != BackendFailure {
+		t.Errorf("process() with an unreachable backend = %v, want a BackendFailure", err)
+	}
+}
+
+func TestMalformedBase64FailsRender(t *testing.T) {
+	log.SetLevel("panic")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "tls.key")
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/tls"]
+`
+	storeClient := &mockStoreClient{values: map[string]string{"/tls/key": "not base64!"}}
+	tr := newTestResource(t, confDir, resourceToml, `{{base64Decode (getv "/tls/key")}}`, storeClient)
+	err = tr.process()
+	if Kind(err) != RenderFailure {
+		t.Fatalf("process() = %v, want a RenderFailure", err)
+	}
+	// The source line shown with the error names the key.
+	if !strings.Contains(err.Error(), "base64") || !strings.Contains(err.Error(), `getv "/tls/key"`) {
+		t.Errorf("error %q does not point at the base64Decode of /tls/key", err.Error())
+	}
+	if util.IsFileExist(dest) {
+		t.Error("dest was written although base64Decode failed")
+	}
+}
+
+func TestMalformedJSONFailsRender(t *testing.T) {
+	log.SetLevel("panic")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "test.conf")
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/app"]
+`
+	storeClient := &mockStoreClient{values: map[string]string{"/app/config": `{"port":8080,`}}
+	tr := newTestResource(t, confDir, resourceToml, `{{$cfg := json (getv "/app/config")}}port = {{$cfg.port}}`, storeClient)
+	err = tr.process()
+	if Kind(err) != RenderFailure {
+		t.Fatalf("process() = %v, want a RenderFailure", err)
+	}
+	if !strings.Contains(err.Error(), `getv "/app/config"`) {
+		t.Errorf("error %q does not point at the json of /app/config", err.Error())
+	}
+	if util.IsFileExist(dest) {
+		t.Error("dest was written although json failed")
+	}
+}
+
+func TestStableFor(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "test.conf")
+	reloads := filepath.Join(confDir, "reloads")
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/app"]
+stable_for = "10ms"
+reload_cmd = "echo \"$CONFD_CHANGED_KEYS\" >> ` + reloads + `"
+`
+	// The port oscillates for the first fetches and then settles.
+	ports := []string{"80", "81", "80", "82", "82"}
+	fetches := 0
+	storeClient := &fetchHookClient{mockStoreClient: &mockStoreClient{values: map[string]string{"/app/host": "a"}}}
+	storeClient.onFetch = func() {
+		if fetches < len(ports) {
+			storeClient.set("/app/port", ports[fetches])
+		}
+		fetches++
+	}
+	tr := newTestResource(t, confDir, resourceToml, `{{getv "/app/host"}}:{{getv "/app/port"}}`, storeClient)
+
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if fetches != len(ports) {
+		t.Errorf("fetched %d times, want %d", fetches, len(ports))
+	}
+	got, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(got) != "a:82" {
+		t.Errorf("dest = %q, want the settled value a:82", string(got))
+	}
+
+	// Unchanged values are rendered without waiting.
+	fetches = 0
+	ports = nil
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if fetches != 1 {
+		t.Errorf("fetched %d times with unchanged values, want 1", fetches)
+	}
+
+	// Nor are they in the next cycle, which recreates resources in interval
+	// mode.
+	fetches = 0
+	tr = newTestResource(t, confDir, resourceToml, `{{getv "/app/host"}}:{{getv "/app/port"}}`, storeClient)
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if fetches != 1 {
+		t.Errorf("fetched %d times with values unchanged since the previous cycle, want 1", fetches)
+	}
+
+	contents, err := ioutil.ReadFile(reloads)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if want := "/app/host /app/port\n"; string(contents) != want {
+		t.Errorf("reload_cmd ran with changed keys %q, want %q once", string(contents), want)
+	}
+}
+
+func TestWriteBack(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + filepath.Join(confDir, "test.conf") + `"
+prefix = "/production"
+keys = ["/app"]
+write_back_key = "/derived/upstream"
+write_back_value = "{{getv \"/app/host\"}}:{{getv \"/app/port\"}}"
+`
+	storeClient := &mockStoreClient{values: map[string]string{"/production/app/host": "a", "/production/app/port": "80"}}
+	tr := newTestResource(t, confDir, resourceToml, `upstream {{getv "/app/host"}}`, storeClient)
+
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if got := storeClient.values["/production/derived/upstream"]; got != "a:80" {
+		t.Errorf("written back value = %q, want %q", got, "a:80")
+	}
+	// An unchanged value is not written again.
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	storeClient.set("/production/app/port", "8080")
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	want := []string{"/production/derived/upstream", "/production/derived/upstream"}
+	if !reflect.DeepEqual(storeClient.writes, want) {
+		t.Errorf("writes = %v, want %v", storeClient.writes, want)
+	}
+	if got := storeClient.values["/production/derived/upstream"]; got != "a:8080" {
+		t.Errorf("written back value = %q, want %q", got, "a:8080")
+	}
+}
+
+func TestWriteBackRejectsWatchedKey(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	for _, key := range []string{"/app", "/app/derived", "/other/../app/x"} {
+		resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + filepath.Join(confDir, "test.conf") + `"
+keys = ["/app", "/db"]
+write_back_key = "` + key + `"
+`
+		resourcePath := filepath.Join(confDir, "conf.d", "test.toml")
+		if err := ioutil.WriteFile(resourcePath, []byte(resourceToml), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := NewTemplateResource(resourcePath, testConfig(confDir, &mockStoreClient{})); err == nil {
+			t.Errorf("NewTemplateResource() accepted write_back_key = %q under the watched /app", key)
+		}
+	}
+}
+
+func TestReloadIf(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "test.conf")
+	reloads := filepath.Join(confDir, "reloads")
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/app"]
+check_cmd = "echo restart=$(cat {{.src}} | cut -d: -f1)"
+reload_cmd = "echo reloaded >> ` + reloads + `"
+reload_if = '{{or (eq .check_output "restart=yes") (gt (len .changed_keys) 1)}}'
+`
+	storeClient := &mockStoreClient{values: map[string]string{"/app/restart": "yes", "/app/port": "80"}}
+	countReloads := func() int {
+		contents, err := ioutil.ReadFile(reloads)
+		if os.IsNotExist(err) {
+			return 0
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return strings.Count(string(contents), "reloaded")
+	}
+
+	steps := []struct {
+		key, value string
+		reloads    int
+	}{
+		// Every key changed on the first fetch.
+		{"", "", 1},
+		// The check reports restart=yes.
+		{"/app/port", "81", 2},
+		// The check reports restart=no and a single key changed.
+		{"/app/restart", "no", 2},
+		{"/app/port", "82", 2},
+	}
+	for i, step := range steps {
+		if step.key != "" {
+			storeClient.set(step.key, step.value)
+		}
+		// Resources are recreated on every cycle in interval mode.
+		tr := newTestResource(t, confDir, resourceToml, `{{getv "/app/restart"}}:{{getv "/app/port"}}`, storeClient)
+		if err := tr.process(); err != nil {
+			t.Fatalf("step %d: %s", i, err.Error())
+		}
+		if got := countReloads(); got != step.reloads {
+			t.Errorf("step %d: reload_cmd ran %d times, want %d", i, got, step.reloads)
+		}
+	}
+	got, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(got) != "no:82" {
+		t.Errorf("dest = %q, want it updated to no:82 without reloading", string(got))
+	}
+}
+
+func TestReloadIfInvalidResult(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + filepath.Join(confDir, "test.conf") + `"
+keys = ["/app"]
+reload_cmd = "true"
+reload_if = "maybe"
+`
+	tr := newTestResource(t, confDir, resourceToml, `{{getv "/app/port"}}`, &mockStoreClient{values: map[string]string{"/app/port": "80"}})
+	if err := tr.process(); Kind(err) != ReloadFailure {
+		t.Errorf("process() = %v, want a reload failure", err)
+	}
+}
+
+func TestTemplateErrorContext(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + filepath.Join(confDir, "test.conf") + `"
+keys = ["/app"]
+`
+	tests := []struct {
+		desc, tmpl string
+		want       []string
+	}{
+		{"execution error", "line 1\nline 2\nline 3\nport = {{getv \"/app/missing\"}}\nline 5\nline 6\nline 7\n", []string{
+			"test.tmpl:4:",
+			"  2 | line 2",
+			"> 4 | port = {{getv \"/app/missing\"}}",
+			"    |          ^",
+			"  6 | line 6",
+		}},
+		{"parse error", "line 1\nline 2\n{{if}}\n", []string{
+			"test.tmpl:3:",
+			"  1 | line 1",
+			"> 3 | {{if}}",
+		}},
+	}
+	for _, tt := range tests {
+		storeClient := &mockStoreClient{values: map[string]string{"/app/port": "80"}}
+		tr := newTestResource(t, confDir, resourceToml, tt.tmpl, storeClient)
+		tr.errorContext = 2
+		if err := tr.setVars(); err != nil {
+			t.Fatal(err.Error())
+		}
+		err := tr.createStageFile()
+		if err == nil {
+			t.Errorf("%s: createStageFile() returned no error", tt.desc)
+			continue
+		}
+		want := append([]string{"template resource test", tr.Src}, tt.want...)
+		for _, w := range want {
+			if !strings.Contains(err.Error(), w) {
+				t.Errorf("%s: error %q does not contain %q", tt.desc, err.Error(), w)
+			}
+		}
+		if strings.Contains(err.Error(), "line 7") {
+			t.Errorf("%s: error %q shows more than 2 lines of context", tt.desc, err.Error())
+		}
+	}
+}
+
+func TestTemplateErrorContextDisabled(t *testing.T) {
+	err := errors.New(`template: test.tmpl:1: function "nope" not defined`)
+	if got := sourceContext("test.tmpl", err, 0); got != "" {
+		t.Errorf("sourceContext() with no context = %q, want none", got)
+	}
+	if got := sourceContext("other.tmpl", err, 2); got != "" {
+		t.Errorf("sourceContext() of an error in another template = %q, want none", got)
+	}
+}
+
+func TestTransformCmd(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "test.conf")
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/app"]
+transform_cmd = "tr a-z A-Z"
+check_cmd = "grep -q 'PORT = 8080' {{.src}}"
+`
+	storeClient := &mockStoreClient{values: map[string]string{"/app/port": "8080"}}
+	tr := newTestResource(t, confDir, resourceToml, "port = {{getv \"/app/port\"}}\n", storeClient)
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	got, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(got) != "PORT = 8080\n" {
+		t.Errorf("dest = %q, want the transformed %q", string(got), "PORT = 8080\n")
+	}
+}
+
+func TestTransformCmdFailure(t *testing.T) {
+	log.SetLevel("panic")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "test.conf")
+	if err := ioutil.WriteFile(dest, []byte("port = 80\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/app"]
+transform_cmd = "cat > /dev/null; exit 3"
+`
+	storeClient := &mockStoreClient{values: map[string]string{"/app/port": "8080"}}
+	tr := newTestResource(t, confDir, resourceToml, "port = {{getv \"/app/port\"}}\n", storeClient)
+	err = tr.process()
+	if err == nil {
+		t.Fatal("process() returned no error although transform_cmd failed")
+	}
+	if Kind(err) != RenderFailure {
+		t.Errorf("Kind(%q) = %v, want RenderFailure", err.Error(), Kind(err))
+	}
+	got, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(got) != "port = 80\n" {
+		t.Errorf("dest = %q after a failed transform_cmd, want it untouched", string(got))
+	}
+	files, err := filepath.Glob(filepath.Join(confDir, ".test.conf*"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(files) != 0 {
+		t.Errorf("stage files %v left behind after a failed transform_cmd", files)
+	}
+}
+
+func TestGetTypedFileBackend(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	values := filepath.Join(confDir, "values.json")
+	doc := `{"app": {"port": 8080, "ratio": 0.5, "debug": true, "version": "1.10", "replicas": "3", "name": "web"}}`
+	if err := ioutil.WriteFile(values, []byte(doc), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	storeClient, err := file.NewFileClient([]string{values}, "*", "", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + filepath.Join(confDir, "test.conf") + `"
+keys = ["/app"]
+`
+	tmpl := `{{range $k := ls "/app"}}{{$k}} {{printf "%T" (getTyped (printf "/app/%s" $k))}}
+{{end}}{{if getTyped "/app/debug"}}debug{{end}}`
+	tr := newTestResource(t, confDir, resourceToml, tmpl, storeClient)
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	got, err := ioutil.ReadFile(tr.Dest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := "debug bool\nname string\nport int64\nratio float64\nreplicas string\nversion string\ndebug"
+	if string(got) != want {
+		t.Errorf("dest = %q, want %q", string(got), want)
+	}
+}
+
+func TestGetTyped(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	storeClient := &mockStoreClient{values: map[string]string{
+		"/app/debug":    "true",
+		"/app/port":     "8080",
+		"/app/ratio":    "0.5",
+		"/app/mode":     "0755",
+		"/app/version":  "1.10",
+		"/app/limits":   `{"cpu": 2}`,
+		"/app/hosts":    `["a", "b"]`,
+		"/app/broken":   `{"cpu":`,
+		"/app/greeting": "hello",
+	}}
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + filepath.Join(confDir, "test.conf") + `"
+keys = ["/app"]
+`
+	tr := newTestResource(t, confDir, resourceToml, "", storeClient)
+	if err := tr.setVars(); err != nil {
+		t.Fatal(err.Error())
+	}
+	tests := map[string]interface{}{
+		"/app/debug":    true,
+		"/app/port":     int64(8080),
+		"/app/ratio":    0.5,
+		"/app/mode":     "0755",
+		"/app/version":  "1.10",
+		"/app/limits":   map[string]interface{}{"cpu": float64(2)},
+		"/app/hosts":    []interface{}{"a", "b"},
+		"/app/broken":   `{"cpu":`,
+		"/app/greeting": "hello",
+	}
+	for key, want := range tests {
+		got, err := tr.getTyped(key)
+		if err != nil {
+			t.Errorf("getTyped(%q) returned %s", key, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("getTyped(%q) = %#v, want %#v", key, got, want)
+		}
+	}
+	if _, err := tr.getTyped("/app/missing"); err == nil {
+		t.Errorf("getTyped() of a missing key returned no error")
+	}
+}
+
+func TestUmask(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	tests := []struct {
+		umask, mode string
+		want        os.FileMode
+	}{
+		{"", "", 0644},
+		{"027", "", 0640},
+		{"077", "", 0600},
+		{"077", "0664", 0664},
+	}
+	for _, tt := range tests {
+		dest := filepath.Join(confDir, "test.conf")
+		os.Remove(dest)
+		resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/app"]
+mode = "` + tt.mode + `"
+`
+		if err := ioutil.WriteFile(filepath.Join(confDir, "conf.d", "test.toml"), []byte(resourceToml), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := ioutil.WriteFile(filepath.Join(confDir, "templates", "test.tmpl"), []byte("ok\n"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		config := testConfig(confDir, &mockStoreClient{values: map[string]string{}})
+		config.Umask = tt.umask
+		tr, err := NewTemplateResource(filepath.Join(confDir, "conf.d", "test.toml"), config)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := tr.process(); err != nil {
+			t.Fatal(err.Error())
+		}
+		fi, err := os.Stat(dest)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if fi.Mode().Perm() != tt.want {
+			t.Errorf("umask %q, mode %q: dest mode = %o, want %o", tt.umask, tt.mode, fi.Mode().Perm(), tt.want)
+		}
+	}
+
+	config := testConfig(confDir, &mockStoreClient{})
+	config.Umask = "0999"
+	if _, err := NewTemplateResource(filepath.Join(confDir, "conf.d", "test.toml"), config); err == nil {
+		t.Errorf("NewTemplateResource() with an invalid umask returned no error")
+	}
+}
+
+func TestDefaultMode(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "test.conf")
+	resourcePath := filepath.Join(confDir, "conf.d", "test.toml")
+	if err := ioutil.WriteFile(filepath.Join(confDir, "templates", "test.tmpl"), []byte("ok\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	tests := []struct {
+		defaultMode, mode string
+		existing          os.FileMode
+		want              os.FileMode
+	}{
+		{"", "", 0, 0644},
+		{"", "", 0666, 0666},
+		{"0600", "", 0, 0600},
+		{"0600", "", 0666, 0600},
+		{"0640", "0600", 0, 0600},
+		{"", "600", 0, 0600},
+	}
+	for _, tt := range tests {
+		os.Remove(dest)
+		if tt.existing != 0 {
+			if err := ioutil.WriteFile(dest, []byte("old\n"), tt.existing); err != nil {
+				t.Fatal(err.Error())
+			}
+			os.Chmod(dest, tt.existing)
+		}
+		resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/app"]
+mode = "` + tt.mode + `"
+`
+		if err := ioutil.WriteFile(resourcePath, []byte(resourceToml), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		config := testConfig(confDir, &mockStoreClient{values: map[string]string{}})
+		config.DefaultMode = tt.defaultMode
+		tr, err := NewTemplateResource(resourcePath, config)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := tr.process(); err != nil {
+			t.Fatal(err.Error())
+		}
+		fi, err := os.Stat(dest)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if fi.Mode().Perm() != tt.want {
+			t.Errorf("default mode %q, mode %q: dest mode = %o, want %o", tt.defaultMode, tt.mode, fi.Mode().Perm(), tt.want)
+		}
+	}
+
+	for _, tt := range []struct{ defaultMode, mode string }{{"", "abc"}, {"", "0999"}, {"abc", ""}} {
+		resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/app"]
+mode = "` + tt.mode + `"
+`
+		if err := ioutil.WriteFile(resourcePath, []byte(resourceToml), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		config := testConfig(confDir, &mockStoreClient{})
+		config.DefaultMode = tt.defaultMode
+		_, err := NewTemplateResource(resourcePath, config)
+		if err == nil || !strings.Contains(err.Error(), "Invalid mode") || !strings.Contains(err.Error(), "test.toml") {
+			t.Errorf("default mode %q, mode %q: NewTemplateResource() = %v, want an invalid mode error", tt.defaultMode, tt.mode, err)
+		}
+	}
+}
+
+func TestOwnerAndGroup(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	resourcePath := filepath.Join(confDir, "conf.d", "test.toml")
+	newResource := func(settings string) (*TemplateResource, error) {
+		resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + filepath.Join(confDir, "test.conf") + `"
+keys = ["/app"]
+` + settings + `
+`
+		if err := ioutil.WriteFile(resourcePath, []byte(resourceToml), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		return NewTemplateResource(resourcePath, testConfig(confDir, &mockStoreClient{}))
+	}
+
+	uid, gid := os.Geteuid(), os.Getegid()
+	tr, err := newResource("owner = \"" + strconv.Itoa(uid) + "\"\ngroup = \"" + strconv.Itoa(gid) + "\"")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if tr.Uid != uid || tr.Gid != gid {
+		t.Errorf("numeric owner and group: uid, gid = %d, %d, want %d, %d", tr.Uid, tr.Gid, uid, gid)
+	}
+
+	if _, err := newResource(`owner = "no-such-user-confd"`); err == nil || !strings.Contains(err.Error(), resourcePath) {
+		t.Errorf("unknown owner: err = %v, want an error naming %s", err, resourcePath)
+	}
+	for _, settings := range []string{"owner = \"-1\"", "uid = 0\nowner = \"0\"", "gid = 0\ngroup = \"0\""} {
+		if _, err := newResource(settings); err == nil {
+			t.Errorf("NewTemplateResource accepted %q", settings)
+		}
+	}
+}
+
+func TestPostReloadCheck(t *testing.T) {
+	log.SetLevel("panic")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "test.conf")
+	reloads := filepath.Join(confDir, "reloads")
+	tests := []struct {
+		desc      string
+		prev      string
+		check     string
+		wantDest  string
+		wantError bool
+	}{
+		{"healthy", "port = 80\n", "grep -q 8080 " + dest, "port = 8080\n", false},
+		{"unhealthy", "port = 80\n", "grep -q '= 80$' " + dest, "port = 80\n", true},
+		{"unhealthy new dest", "", "exit 1", "", true},
+	}
+	for _, tt := range tests {
+		os.Remove(dest)
+		os.Remove(reloads)
+		if tt.prev != "" {
+			if err := ioutil.WriteFile(dest, []byte(tt.prev), 0640); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/app"]
+reload_cmd = "cat ` + dest + ` >> ` + reloads + ` || echo missing >> ` + reloads + `"
+post_reload_check = "` + tt.check + `"
+`
+		storeClient := &mockStoreClient{values: map[string]string{"/app/port": "8080"}}
+		tr := newTestResource(t, confDir, resourceToml, "port = {{getv \"/app/port\"}}\n", storeClient)
+		err := tr.process()
+		if tt.wantError {
+			if err == nil || Kind(err) != ReloadFailure {
+				t.Errorf("%s: process() = %v, want a ReloadFailure", tt.desc, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: process() returned %s", tt.desc, err.Error())
+		}
+
+		got, err := ioutil.ReadFile(dest)
+		if tt.wantDest == "" {
+			if !os.IsNotExist(err) {
+				t.Errorf("%s: dest exists after rolling back the update creating it", tt.desc)
+			}
+		} else if string(got) != tt.wantDest {
+			t.Errorf("%s: dest = %q, want %q", tt.desc, string(got), tt.wantDest)
+		}
+		if tt.wantError && tt.prev != "" {
+			if fi, err := os.Stat(dest); err != nil || fi.Mode().Perm() != 0640 {
+				t.Errorf("%s: restored dest mode = %v, want 640", tt.desc, fi.Mode().Perm())
+			}
+		}
+
+		wantReloads := "port = 8080\n"
+		if tt.wantError {
+			// reload_cmd runs again once the previous config is restored.
+			prev := tt.prev
+			if prev == "" {
+				prev = "missing\n"
+			}
+			wantReloads += prev
+		}
+		got, err = ioutil.ReadFile(reloads)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(got) != wantReloads {
+			t.Errorf("%s: reload_cmd saw %q, want %q", tt.desc, string(got), wantReloads)
+		}
+		backups, err := filepath.Glob(filepath.Join(confDir, ".test.conf.rollback*"))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(backups) != 0 {
+			t.Errorf("%s: backups %v left behind", tt.desc, backups)
+		}
+	}
+}
+
+func TestPostReloadCheckNeedsReloadCmd(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + filepath.Join(confDir, "test.conf") + `"
+keys = ["/app"]
+post_reload_check = "true"
+`
+	resourcePath := filepath.Join(confDir, "conf.d", "test.toml")
+	if err := ioutil.WriteFile(resourcePath, []byte(resourceToml), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := NewTemplateResource(resourcePath, testConfig(confDir, &mockStoreClient{})); err == nil {
+		t.Errorf("NewTemplateResource() returned no error for a post_reload_check without reload_cmd")
+	}
+}
+
+func TestDelims(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "test.conf")
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/app"]
+delims = ["<%", "%>"]
+`
+	storeClient := &mockStoreClient{values: map[string]string{"/app/port": "8080"}}
+	tr := newTestResource(t, confDir, resourceToml, "port = <% getv \"/app/port\" %>\nhelp = {{.Port}}\n", storeClient)
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if got, err := ioutil.ReadFile(dest); err != nil || string(got) != "port = 8080\nhelp = {{.Port}}\n" {
+		t.Errorf("dest = %q, %v, want the <%% %%> actions rendered and {{ }} kept", string(got), err)
+	}
+
+	resourcePath := filepath.Join(confDir, "conf.d", "test.toml")
+	for _, delims := range []string{`["<%"]`, `["<%", "<%"]`, `["", "%>"]`, `["<", "%", ">"]`} {
+		resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/app"]
+delims = ` + delims + `
+`
+		if err := ioutil.WriteFile(resourcePath, []byte(resourceToml), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		_, err := NewTemplateResource(resourcePath, testConfig(confDir, storeClient))
+		if err == nil || !strings.Contains(err.Error(), "invalid delims") {
+			t.Errorf("delims = %s: NewTemplateResource() returned %v, want an invalid delims error", delims, err)
+		}
+	}
+}
+
+func TestTemplatedDest(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + confDir + `/{{getv \"/app/env\"}}.conf"
+keys = ["/app"]
+`
+	storeClient := &mockStoreClient{values: map[string]string{"/app/env": "prod", "/app/port": "80"}}
+	tr := newTestResource(t, confDir, resourceToml, "port = {{getv \"/app/port\"}}\n", storeClient)
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	storeClient.set("/app/env", "stage")
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, name := range []string{"prod.conf", "stage.conf"} {
+		if got, err := ioutil.ReadFile(filepath.Join(confDir, name)); err != nil || string(got) != "port = 80\n" {
+			t.Errorf("%s = %q, %v, want the rendered template", name, string(got), err)
+		}
+	}
+
+	tests := []struct {
+		dest, want string
+	}{
+		{"", "empty path"},
+		{"relative.conf", "not an absolute path"},
+		{filepath.Join(confDir, "missing", "app.conf"), "directory does not exist"},
+	}
+	for _, tt := range tests {
+		resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "{{getv \"/app/dest\"}}"
+keys = ["/app"]
+`
+		storeClient := &mockStoreClient{values: map[string]string{"/app/dest": tt.dest, "/app/port": "80"}}
+		tr := newTestResource(t, confDir, resourceToml, "port = {{getv \"/app/port\"}}\n", storeClient)
+		err := tr.process()
+		if err == nil || Kind(err) != ConfigFailure || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("dest rendering %q: process() = %v, want a ConfigFailure mentioning %q", tt.dest, err, tt.want)
+		}
+	}
+
+	resourcePath := filepath.Join(confDir, "conf.d", "test.toml")
+	if err := ioutil.WriteFile(resourcePath, []byte("[template]\nsrc = \"test.tmpl\"\ndest = \"/etc/{{getv\"\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := NewTemplateResource(resourcePath, testConfig(confDir, storeClient)); err == nil {
+		t.Errorf("NewTemplateResource accepted a dest template that does not parse")
+	}
+}
+
+func TestSelfIncludingTemplate(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + filepath.Join(confDir, "test.conf") + `"
+keys = ["/app"]
+`
+	tmpl := `{{define "loop"}}{{template "loop" .}}{{end}}{{template "loop" .}}`
+	tr := newTestResource(t, confDir, resourceToml, tmpl, &mockStoreClient{values: map[string]string{}})
+	err = tr.process()
+	if err == nil {
+		t.Fatal("process() returned no error for a template including itself")
+	}
+	if Kind(err) != RenderFailure || !strings.Contains(err.Error(), "exceeded maximum template depth") {
+		t.Errorf("process() = %q, want a RenderFailure about the template depth", err.Error())
+	}
+	if util.IsFileExist(tr.Dest) {
+		t.Errorf("%s was written although its template failed", tr.Dest)
+	}
+}
+
+func TestRender(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "test.conf")
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/app"]
+required_keys = ["/app/port"]
+reload_cmd = "touch ` + filepath.Join(confDir, "reloaded") + `"
+`
+	storeClient := &mockStoreClient{values: map[string]string{"/app/port": "8080"}}
+	tr := newTestResource(t, confDir, resourceToml, "port = {{getv \"/app/port\"}}\n", storeClient)
+
+	var b bytes.Buffer
+	if err := tr.Render(&b); err != nil {
+		t.Fatal(err.Error())
+	}
+	if got := b.String(); got != "port = 8080\n" {
+		t.Errorf("Render() wrote %q, want %q", got, "port = 8080\n")
+	}
+	for _, path := range []string{dest, filepath.Join(confDir, "reloaded")} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Render() created %s", path)
+		}
+	}
+
+	delete(storeClient.values, "/app/port")
+	b.Reset()
+	if err := tr.Render(&b); Kind(err) != BackendFailure || !strings.Contains(err.Error(), "/app/port") {
+		t.Errorf("Render() = %v without the required key, want a backend failure naming it", err)
+	}
+	if b.Len() != 0 {
+		t.Errorf("Render() wrote %q although it failed", b.String())
+	}
+}
+
+func TestSecretKeysMasked(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetLevel("debug")
+	defer func() {
+		log.SetLevel("warn")
+		log.SetOutput(os.Stderr)
+	}()
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + filepath.Join(confDir, "test.conf") + `"
+prefix = "/app"
+keys = ["/db", "/api"]
+secret_keys = ["/db/password"]
+`
+	storeClient := &mockStoreClient{values: map[string]string{
+		"/app/db/user":     "app-user",
+		"/app/db/password": "hunter2",
+		"/app/api/token":   "tok-123",
+	}}
+	config := testConfig(confDir, storeClient)
+	config.SecretKeys = []string{"/api/*"}
+	if err := ioutil.WriteFile(filepath.Join(confDir, "templates", "test.tmpl"), []byte(`{{atoi (getv "/db/password")}}`), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	resourcePath := filepath.Join(confDir, "conf.d", "test.toml")
+	if err := ioutil.WriteFile(resourcePath, []byte(resourceToml), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	tr, err := NewTemplateResource(resourcePath, config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = tr.process()
+	if err == nil {
+		t.Fatal("process() rendered atoi of a non-number")
+	}
+	if strings.Contains(err.Error(), "hunter2") || !strings.Contains(err.Error(), "****") {
+		t.Errorf("process() = %s, want the secret value masked", err.Error())
+	}
+	logged := buf.String()
+	for _, secret := range []string{"hunter2", "tok-123"} {
+		if strings.Contains(logged, secret) {
+			t.Errorf("the secret value %s was logged:\n%s", secret, logged)
+		}
+	}
+	if !strings.Contains(logged, "app-user") {
+		t.Errorf("the value of /db/user was not logged:\n%s", logged)
+	}
+
+	config.SecretKeys = []string{"/db/["}
+	if _, err := NewTemplateResource(resourcePath, config); err == nil {
+		t.Errorf("NewTemplateResource accepted the invalid secret_keys pattern /db/[")
+	}
+}
+
+func TestIgnoreMissingKeys(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetLevel("warn")
+	defer log.SetOutput(os.Stderr)
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "test.conf")
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/app"]
+ignore_missing_keys = true
+`
+	tmpl := `host={{getv "/app/host"}} port={{getv "/app/port"}} tls={{getv "/app/tls" "off"}}` + "\n"
+	storeClient := &mockStoreClient{values: map[string]string{"/app/host": "db"}}
+	tr := newTestResource(t, confDir, resourceToml, tmpl, storeClient)
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if got, _ := ioutil.ReadFile(dest); string(got) != "host=db port= tls=off\n" {
+		t.Errorf("dest = %q, want the missing key rendered as empty", string(got))
+	}
+	if !strings.Contains(buf.String(), "/app/port") || strings.Contains(buf.String(), "/app/tls") {
+		t.Errorf("logged %q, want a warning for /app/port only", buf.String())
+	}
+
+	tr.storeClient = &unreachableClient{storeClient}
+	if err := tr.process(); Kind(err) != BackendFailure {
+		t.Errorf("process() = %v with an unreachable backend, want a backend failure", err)
+	}
+}
+
+func TestDestReplacedAtomically(t *testing.T) {
+	log.SetLevel("warn")
+	confDir, err := createTempDirs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(confDir)
+
+	dest := filepath.Join(confDir, "test.conf")
+	resourceToml := `
+[template]
+src = "test.tmpl"
+dest = "` + dest + `"
+keys = ["/app"]
+`
+	fills := []string{strings.Repeat("a", 1<<20), strings.Repeat("b", 1<<20)}
+	storeClient := &mockStoreClient{values: map[string]string{"/app/fill": fills[0]}}
+	tr := newTestResource(t, confDir, resourceToml, `{{getv "/app/fill"}}`, storeClient)
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	contents := map[string]bool{fills[0]: true, fills[1]: true}
+
+	done := make(chan struct{})
+	partial := make(chan string, 1)
+	go func() {
+		defer close(partial)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			got, err := ioutil.ReadFile(dest)
+			if err != nil {
+				partial <- "missing: " + err.Error()
+				return
+			}
+			if !contents[string(got)] {
+				partial <- strconv.Itoa(len(got)) + " bytes"
+				return
+			}
+		}
+	}()
+	for i := 1; i <= 10; i++ {
+		storeClient.set("/app/fill", fills[i%2])
+		if err := tr.process(); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	close(done)
+	if p, ok := <-partial; ok {
+		t.Errorf("a reader saw dest partially written: %s", p)
+	}
+	matches, _ := filepath.Glob(filepath.Join(confDir, ".test.conf*"))
+	if len(matches) != 0 {
+		t.Errorf("stage files left next to dest: %v", matches)
+	}
+}
@@ -0,0 +1,81 @@
+package template
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// secretMask replaces the values of secret keys in logs and errors.
+const secretMask = "****"
+
+// validSecretKeys reports whether every secret_keys pattern is a valid
+// path.Match pattern.
+func validSecretKeys(patterns []string) bool {
+	for _, p := range patterns {
+		if _, err := path.Match(p, "/"); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// isSecretKey reports whether the value of key, a key as read from the
+// backend, is secret. A secret_keys pattern matches key, relative to the
+// prefix it was read under or with the prefix, or any key below it.
+func (t *TemplateResource) isSecretKey(key, prefix string) bool {
+	relative := path.Join("/", strings.TrimPrefix(key, prefix))
+	for _, p := range t.secretKeys {
+		p = path.Join("/", p)
+		for _, k := range []string{path.Join("/", key), relative} {
+			if matched, _ := path.Match(p, k); matched || strings.HasPrefix(k, p+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// maskedValues returns a copy of result, read under prefix, with the values
+// of secret keys masked.
+func (t *TemplateResource) maskedValues(result map[string]string, prefix string) map[string]string {
+	if len(t.secretKeys) == 0 {
+		return result
+	}
+	masked := make(map[string]string, len(result))
+	for k, v := range result {
+		if t.isSecretKey(k, prefix) {
+			v = secretMask
+		}
+		masked[k] = v
+	}
+	return masked
+}
+
+// setSecretValues records the values of the secret keys among fetched,
+// read under prefixes, so that maskSecrets can hide them.
+func (t *TemplateResource) setSecretValues(fetched map[string]string) {
+	t.secretValues = nil
+	if len(t.secretKeys) == 0 {
+		return
+	}
+	for k, v := range fetched {
+		for _, prefix := range t.prefixes() {
+			if v != "" && t.isSecretKey(k, prefix) {
+				t.secretValues = append(t.secretValues, v)
+				break
+			}
+		}
+	}
+	// Mask longer values first so that a value containing another one is
+	// masked whole.
+	sort.Slice(t.secretValues, func(i, j int) bool { return len(t.secretValues[i]) > len(t.secretValues[j]) })
+}
+
+// maskSecrets returns s with the last fetched values of secret keys masked.
+func (t *TemplateResource) maskSecrets(s string) string {
+	for _, v := range t.secretValues {
+		s = strings.Replace(s, v, secretMask, -1)
+	}
+	return s
+}
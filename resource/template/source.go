@@ -0,0 +1,75 @@
+package template
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// templateErrorPosition matches the position text/template reports at the
+// start of parse and execution errors, such as "template: app.tmpl:12:" or
+// "template: app.tmpl:12:5:".
+var templateErrorPosition = regexp.MustCompile(`^template: ([^:]+):(\d+):(?:(\d+):)?`)
+
+// templateError adds the name of the template resource and its src to err,
+// a parse or execution error of the src template, followed by the lines of
+// the template around the line err points at. Up to t.errorContext lines
+// are shown before and after it; with errorContext 0 no source is shown.
+// Values of secret keys are masked.
+func (t *TemplateResource) templateError(err error) error {
+	return errors.New(t.maskSecrets(fmt.Sprintf("Unable to render template resource %s from %s, %s%s", t.name, t.Src, err, sourceContext(t.Src, err, t.errorContext))))
+}
+
+// sourceContext returns the lines of the template file src around the
+// position err points at, numbered and with the failing line marked, or ""
+// if err does not point into src or src cannot be read.
+func sourceContext(src string, err error, context int) string {
+	m := templateErrorPosition.FindStringSubmatch(err.Error())
+	if context <= 0 || m == nil || m[1] != filepath.Base(src) {
+		return ""
+	}
+	line, _ := strconv.Atoi(m[2])
+	b, readErr := ioutil.ReadFile(src)
+	if readErr != nil {
+		return ""
+	}
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+	first, last := line-context, line+context
+	if first < 1 {
+		first = 1
+	}
+	if last > len(lines) {
+		last = len(lines)
+	}
+	width := len(strconv.Itoa(last))
+	var out bytes.Buffer
+	for n := first; n <= last; n++ {
+		marker := " "
+		if n == line {
+			marker = ">"
+		}
+		fmt.Fprintf(&out, "\n%s %*d | %s", marker, width, n, lines[n-1])
+		if n == line && m[3] != "" {
+			// Execution errors also report the byte offset of the action
+			// in the line. Tabs are kept so the caret lines up below it.
+			if col, _ := strconv.Atoi(m[3]); col < len(lines[n-1]) {
+				indent := strings.Map(func(r rune) rune {
+					if r == '\t' {
+						return r
+					}
+					return ' '
+				}, lines[n-1][:col])
+				fmt.Fprintf(&out, "\n  %s | %s^", strings.Repeat(" ", width), indent)
+			}
+		}
+	}
+	return out.String()
+}
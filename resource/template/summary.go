@@ -0,0 +1,58 @@
+package template
+
+import (
+	"fmt"
+	"strings"
+)
+
+// An outcome is what processing a template resource did to its dest.
+type outcome int
+
+const (
+	// outcomeUnchanged means dest was already up to date.
+	outcomeUnchanged outcome = iota
+	// outcomeUpdated means dest was written or removed, or would have been
+	// in noop or dry-run mode.
+	outcomeUpdated
+	// outcomeFailed means processing the template resource failed.
+	outcomeFailed
+)
+
+// A cycleSummary tallies the outcomes of the template resources processed
+// by a cycle.
+type cycleSummary struct {
+	updated, unchanged, failed int
+	// pending is set when dest files are not modified, in noop or dry-run
+	// mode, so updates are reported as what would happen.
+	pending bool
+}
+
+// add records the outcome of processing t.
+func (s *cycleSummary) add(t *TemplateResource, o outcome) {
+	switch o {
+	case outcomeUpdated:
+		s.updated++
+	case outcomeFailed:
+		s.failed++
+	default:
+		s.unchanged++
+	}
+	if t.noop || t.dryRun {
+		s.pending = true
+	}
+}
+
+// String describes the summary on a single line, such as "Processed 80
+// resources: 3 updated, 76 unchanged, 1 failed".
+func (s cycleSummary) String() string {
+	updated := "updated"
+	if s.pending {
+		updated = "would update"
+	}
+	parts := []string{
+		fmt.Sprintf("%d %s", s.updated, updated),
+		fmt.Sprintf("%d unchanged", s.unchanged),
+		fmt.Sprintf("%d failed", s.failed),
+	}
+	return fmt.Sprintf("Processed %d resources: %s", s.updated+s.unchanged+s.failed, strings.Join(parts, ", "))
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"net"
 	"os"
 	"path"
@@ -12,6 +13,7 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	util "github.com/kelseyhightower/confd/util"
 	"github.com/kelseyhightower/memkv"
@@ -24,6 +26,7 @@ func newFuncMap() map[string]interface{} {
 	m["json"] = UnmarshalJsonObject
 	m["jsonArray"] = UnmarshalJsonArray
 	m["dir"] = path.Dir
+	m["lastN"] = LastN
 	m["map"] = CreateMap
 	m["getenv"] = Getenv
 	m["join"] = strings.Join
@@ -32,6 +35,8 @@ func newFuncMap() map[string]interface{} {
 	m["toLower"] = strings.ToLower
 	m["contains"] = strings.Contains
 	m["replace"] = strings.Replace
+	m["replaceAll"] = ReplaceAll
+	m["trim"] = strings.TrimSpace
 	m["trimSuffix"] = strings.TrimSuffix
 	m["lookupIP"] = LookupIP
 	m["lookupIPV4"] = LookupIPV4
@@ -44,12 +49,16 @@ func newFuncMap() map[string]interface{} {
 	m["reverse"] = Reverse
 	m["sortByLength"] = SortByLength
 	m["sortKVByLength"] = SortKVByLength
+	m["sortNatural"] = SortNatural
 	m["add"] = func(a, b int) int { return a + b }
 	m["sub"] = func(a, b int) int { return a - b }
 	m["div"] = func(a, b int) int { return a / b }
 	m["mod"] = func(a, b int) int { return a % b }
 	m["mul"] = func(a, b int) int { return a * b }
 	m["seq"] = Seq
+	m["padLeft"] = PadLeft
+	m["padRight"] = PadRight
+	m["weightedPick"] = WeightedPick
 	m["atoi"] = strconv.Atoi
 	return m
 }
@@ -60,6 +69,21 @@ func addFuncs(out, in map[string]interface{}) {
 	}
 }
 
+// LastN returns the last n segments of the slash separated key, joined by
+// slashes. Keys with n or fewer segments are returned whole, without their
+// leading slash, so LastN(2, "/app/db/host") is "db/host" and
+// LastN(2, "/app") is "app".
+func LastN(n int, key string) string {
+	if n <= 0 {
+		return ""
+	}
+	segments := strings.Split(strings.Trim(path.Clean(key), "/"), "/")
+	if n < len(segments) {
+		segments = segments[len(segments)-n:]
+	}
+	return strings.Join(segments, "/")
+}
+
 // Seq creates a sequence of integers. It's named and used as GNU's seq.
 // Seq takes the first and the last element as arguments. So Seq(3, 5) will generate [3,4,5]
 func Seq(first, last int) []int {
@@ -70,6 +94,91 @@ func Seq(first, last int) []int {
 	return arr
 }
 
+// ReplaceAll replaces every occurrence of old in s with new. It takes s
+// last so that it can end a pipeline, as in
+// {{getv "/app/name" | replaceAll "-" "_"}}.
+func ReplaceAll(old, new, s string) string {
+	return strings.Replace(s, old, new, -1)
+}
+
+// PadLeft pads s on the left with the single character pad until it is
+// width characters long. Strings of width characters or more are returned
+// unchanged, so PadLeft("42", 5, "0") is "00042".
+func PadLeft(s string, width int, pad string) (string, error) {
+	padding, err := padding(s, width, pad)
+	if err != nil {
+		return "", err
+	}
+	return padding + s, nil
+}
+
+// PadRight pads s on the right with the single character pad until it is
+// width characters long. Strings of width characters or more are returned
+// unchanged.
+func PadRight(s string, width int, pad string) (string, error) {
+	padding, err := padding(s, width, pad)
+	if err != nil {
+		return "", err
+	}
+	return s + padding, nil
+}
+
+// padding returns the pad characters needed to make s width characters long.
+func padding(s string, width int, pad string) (string, error) {
+	if utf8.RuneCountInString(pad) != 1 {
+		return "", fmt.Errorf("pad must be a single character, got %q", pad)
+	}
+	n := width - utf8.RuneCountInString(s)
+	if n <= 0 {
+		return "", nil
+	}
+	return strings.Repeat(pad, n), nil
+}
+
+// WeightedPick deterministically picks one of the options listed in weights
+// for seed. weights is a comma separated list of option:weight pairs such as
+// "stable:90,canary:10": a given seed always gets the same option, while
+// across many seeds each option is picked in proportion to its weight. An
+// empty seed is replaced by the hostname, so every host consistently gets
+// its own share of a rollout.
+func WeightedPick(seed, weights string) (string, error) {
+	if seed == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", err
+		}
+		seed = hostname
+	}
+	var options []string
+	var cumulative []uint64
+	var total uint64
+	for _, pair := range strings.Split(weights, ",") {
+		i := strings.LastIndex(pair, ":")
+		if i < 0 {
+			return "", fmt.Errorf("invalid weight %q, want option:weight", pair)
+		}
+		w, err := strconv.ParseUint(strings.TrimSpace(pair[i+1:]), 10, 32)
+		if err != nil {
+			return "", fmt.Errorf("invalid weight %q: %s", pair, err)
+		}
+		total += w
+		options = append(options, strings.TrimSpace(pair[:i]))
+		cumulative = append(cumulative, total)
+	}
+	if total == 0 {
+		return "", errors.New("weights must not all be zero")
+	}
+	h := fnv.New64a()
+	h.Write([]byte(seed))
+	n := h.Sum64() % total
+	for i, c := range cumulative {
+		if n < c {
+			return options[i], nil
+		}
+	}
+	return options[len(options)-1], nil
+}
+
 type byLengthKV []memkv.KVPair
 
 func (s byLengthKV) Len() int {
@@ -106,6 +215,63 @@ func SortByLength(values []string) []string {
 	return values
 }
 
+// SortNatural sorts values in natural order, comparing runs of digits by
+// their numeric value so that "node2" sorts before "node10".
+// It works with []string and []KVPair, sorting the latter by key.
+func SortNatural(values interface{}) interface{} {
+	switch v := values.(type) {
+	case []string:
+		sort.SliceStable(v, func(i, j int) bool { return naturalLess(v[i], v[j]) })
+	case []memkv.KVPair:
+		sort.SliceStable(v, func(i, j int) bool { return naturalLess(v[i].Key, v[j].Key) })
+	case memkv.KVPairs:
+		sort.SliceStable(v, func(i, j int) bool { return naturalLess(v[i].Key, v[j].Key) })
+	}
+	return values
+}
+
+// naturalLess reports whether a sorts before b in natural order. Runs of
+// digits compare numerically, ignoring leading zeros, and everything else
+// compares bytewise.
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		if isDigit(a[0]) && isDigit(b[0]) {
+			na, ra := splitDigits(a)
+			nb, rb := splitDigits(b)
+			ta, tb := strings.TrimLeft(na, "0"), strings.TrimLeft(nb, "0")
+			if len(ta) != len(tb) {
+				return len(ta) < len(tb)
+			}
+			if ta != tb {
+				return ta < tb
+			}
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			a, b = ra, rb
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// splitDigits splits s after its leading run of digits.
+func splitDigits(s string) (string, string) {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
 //Reverse returns the array in reversed order
 //works with []string and []KVPair
 func Reverse(values interface{}) interface{} {
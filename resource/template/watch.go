@@ -0,0 +1,97 @@
+package template
+
+import (
+	"sort"
+	"strings"
+)
+
+// A watchGroup watches the keys of template resources with nested prefixes
+// through a single backend watch on the outermost prefix, so that watch
+// mode needs one goroutine and one backend watch per group rather than per
+// template resource. Every change is fanned out to all members; members
+// whose keys did not change fetch them again but leave their dest alone.
+type watchGroup struct {
+	prefix  string
+	keys    []string
+	members []*TemplateResource
+	stop    chan bool
+}
+
+// groupWatches groups the template resources in ts by watch prefix. A
+// template resource whose prefix is the same as, or nested below, the
+// prefix of another is watched in the group of the outermost one. Members
+// and keys of a group are in the order of ts.
+// It returns the groups by prefix.
+func groupWatches(ts []*TemplateResource) map[string]*watchGroup {
+	prefixes := make(map[*TemplateResource]string, len(ts))
+	rootOf := make(map[string]string)
+	var unique []string
+	for _, t := range ts {
+		prefix, _ := t.watchKeys()
+		prefixes[t] = prefix
+		if _, ok := rootOf[prefix]; !ok {
+			rootOf[prefix] = ""
+			unique = append(unique, prefix)
+		}
+	}
+	// Parents are shorter than their children, so sorting by length lets
+	// every prefix find its outermost parent among the roots before it.
+	sort.Slice(unique, func(i, j int) bool {
+		if len(unique[i]) != len(unique[j]) {
+			return len(unique[i]) < len(unique[j])
+		}
+		return unique[i] < unique[j]
+	})
+	var roots []string
+	for _, prefix := range unique {
+		rootOf[prefix] = prefix
+		for _, root := range roots {
+			if isParentPath(root, prefix) {
+				rootOf[prefix] = root
+				break
+			}
+		}
+		if rootOf[prefix] == prefix {
+			roots = append(roots, prefix)
+		}
+	}
+
+	groups := make(map[string]*watchGroup, len(roots))
+	seenKeys := make(map[string]map[string]bool, len(roots))
+	for _, t := range ts {
+		root := rootOf[prefixes[t]]
+		g, ok := groups[root]
+		if !ok {
+			g = &watchGroup{prefix: root}
+			groups[root] = g
+			seenKeys[root] = make(map[string]bool)
+		}
+		g.members = append(g.members, t)
+		_, keys := t.watchKeys()
+		for _, k := range keys {
+			if !seenKeys[root][k] {
+				seenKeys[root][k] = true
+				g.keys = append(g.keys, k)
+			}
+		}
+	}
+	return groups
+}
+
+// isParentPath reports whether the key path p is parent or below it.
+func isParentPath(parent, p string) bool {
+	return parent == "/" || p == parent || strings.HasPrefix(p, parent+"/")
+}
+
+// sameMembers reports whether a and b watch the same template resources.
+func sameMembers(a, b *watchGroup) bool {
+	if len(a.members) != len(b.members) {
+		return false
+	}
+	for i := range a.members {
+		if a.members[i] != b.members[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,159 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around every change.
+const diffContext = 3
+
+// maxDiffCells bounds the size of the table used to find the longest common
+// subsequence of lines. Larger changes are shown as the removal of every
+// old line followed by the addition of every new line.
+const maxDiffCells = 1 << 22
+
+// A diffLine is a line of an edit script: ' ' for a line kept, '-' for a
+// line removed and '+' for a line added.
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// UnifiedDiff returns the unified diff, with three lines of context, turning
+// a, named from, into b, named to. It returns "" if a and b are equal.
+func UnifiedDiff(from, to string, a, b []byte) string {
+	if bytes.Equal(a, b) {
+		return ""
+	}
+	script := diffLines(splitLines(a), splitLines(b))
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", from, to)
+	// aLines[i] and bLines[i] count the lines of a and b before script[i].
+	aLines := make([]int, len(script)+1)
+	bLines := make([]int, len(script)+1)
+	for i, l := range script {
+		aLines[i+1], bLines[i+1] = aLines[i], bLines[i]
+		if l.op != '+' {
+			aLines[i+1]++
+		}
+		if l.op != '-' {
+			bLines[i+1]++
+		}
+	}
+	for i := 0; i < len(script); {
+		if script[i].op == ' ' {
+			i++
+			continue
+		}
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		// Extend the hunk while the next change is close enough for the
+		// context of both to overlap.
+		end := i
+		for j := i; j < len(script); j++ {
+			if script[j].op != ' ' {
+				end = j + 1
+			} else if j-end >= 2*diffContext {
+				break
+			}
+		}
+		i = end
+		end += diffContext
+		if end > len(script) {
+			end = len(script)
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n",
+			hunkRange(aLines[start], aLines[end]-aLines[start]),
+			hunkRange(bLines[start], bLines[end]-bLines[start]))
+		for _, l := range script[start:end] {
+			out.WriteByte(l.op)
+			out.WriteString(l.text)
+			if !strings.HasSuffix(l.text, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+	}
+	return out.String()
+}
+
+// hunkRange formats the range of a hunk starting after line start and
+// spanning n lines.
+func hunkRange(start, n int) string {
+	switch n {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, n)
+}
+
+// splitLines splits b after every newline.
+func splitLines(b []byte) []string {
+	lines := strings.SplitAfter(string(b), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines returns an edit script turning a into b, keeping the longest
+// common subsequence of their lines.
+func diffLines(a, b []string) []diffLine {
+	var prefix, suffix []diffLine
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		prefix = append(prefix, diffLine{' ', a[0]})
+		a, b = a[1:], b[1:]
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		suffix = append([]diffLine{{' ', a[len(a)-1]}}, suffix...)
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+	script := prefix
+	if (len(a)+1)*(len(b)+1) > maxDiffCells {
+		for _, l := range a {
+			script = append(script, diffLine{'-', l})
+		}
+		for _, l := range b {
+			script = append(script, diffLine{'+', l})
+		}
+		return append(script, suffix...)
+	}
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			script = append(script, diffLine{' ', a[i]})
+			i, j = i+1, j+1
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			script = append(script, diffLine{'-', a[i]})
+			i++
+		default:
+			script = append(script, diffLine{'+', b[j]})
+			j++
+		}
+	}
+	return append(script, suffix...)
+}
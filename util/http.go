@@ -0,0 +1,89 @@
+package util
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/confd/log"
+)
+
+// A UserAgentTransport is an http.RoundTripper that sets the User-Agent
+// header of every request before passing it on to Transport.
+type UserAgentTransport struct {
+	UserAgent string
+	Transport http.RoundTripper
+}
+
+// RoundTrip sets the User-Agent header on a copy of req and executes it
+// using the underlying Transport. With tracing enabled every request is
+// logged along with its status and duration.
+func (t *UserAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("User-Agent", t.UserAgent)
+	if !log.TraceEnabled() {
+		return t.Transport.RoundTrip(r)
+	}
+	start := time.Now()
+	resp, err := t.Transport.RoundTrip(r)
+	if err != nil {
+		log.Trace("%s %s failed after %s: %s", r.Method, RedactURL(r.URL), time.Since(start), err)
+		return resp, err
+	}
+	log.Trace("%s %s -> %s in %s", r.Method, RedactURL(r.URL), resp.Status, time.Since(start))
+	return resp, err
+}
+
+// RedactURL returns u as a string with its password and the values of query
+// parameters that may hold credentials replaced by "xxxxx".
+func RedactURL(u *url.URL) string {
+	redacted := *u
+	if _, ok := redacted.User.Password(); ok {
+		redacted.User = url.UserPassword(redacted.User.Username(), "xxxxx")
+	}
+	query := redacted.Query()
+	for k := range query {
+		if IsSecretName(k) {
+			query.Set(k, "xxxxx")
+		}
+	}
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
+}
+
+// RedactNodes returns nodes with the passwords of node URLs redacted, so
+// that they can be logged.
+func RedactNodes(nodes []string) []string {
+	redacted := make([]string, len(nodes))
+	for i, node := range nodes {
+		redacted[i] = node
+		if u, err := url.Parse(node); err == nil && u.Scheme != "" && u.Host != "" {
+			redacted[i] = RedactURL(u)
+		}
+	}
+	return redacted
+}
+
+// IsSecretName reports whether name, a query parameter or key, suggests
+// that its value is a credential.
+func IsSecretName(name string) bool {
+	name = strings.ToLower(name)
+	return strings.Contains(name, "token") || strings.Contains(name, "secret") || strings.Contains(name, "password")
+}
+
+// CancelRequest cancels an in-flight request if the underlying Transport
+// supports it.
+func (t *UserAgentTransport) CancelRequest(req *http.Request) {
+	type canceler interface {
+		CancelRequest(*http.Request)
+	}
+	if c, ok := t.Transport.(canceler); ok {
+		c.CancelRequest(req)
+	}
+}
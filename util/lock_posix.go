@@ -0,0 +1,26 @@
+// +build !windows
+
+package util
+
+import (
+	"os"
+	"syscall"
+)
+
+// LockFile takes an exclusive advisory lock (flock) on the file name,
+// creating it if needed, and waits until the lock is available. The lock is
+// held until the returned unlock function is called.
+func LockFile(name string) (unlock func() error, err error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() error {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		return f.Close()
+	}, nil
+}
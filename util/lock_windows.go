@@ -0,0 +1,12 @@
+package util
+
+import (
+	"github.com/kelseyhightower/confd/log"
+)
+
+// LockFile is not supported on Windows. It logs a warning and returns
+// without locking.
+func LockFile(name string) (unlock func() error, err error) {
+	log.Warning("File locking is not supported on Windows, not locking " + name)
+	return func() error { return nil }, nil
+}
@@ -0,0 +1,141 @@
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kelseyhightower/confd/log"
+)
+
+// IsPEM reports whether s holds PEM encoded data rather than a file path.
+func IsPEM(s string) bool {
+	return strings.HasPrefix(strings.TrimSpace(s), "-----BEGIN ")
+}
+
+// ReadPEM returns the PEM data in s, reading it from the file s names
+// unless s already is inline PEM.
+func ReadPEM(s string) ([]byte, error) {
+	if IsPEM(s) {
+		return []byte(s), nil
+	}
+	return ioutil.ReadFile(s)
+}
+
+// LoadX509KeyPair parses a public/private key pair. cert and key may each be
+// either the path of a PEM encoded file or the PEM data itself, which allows
+// secrets injected through the environment to be used without writing them
+// to disk. Inline PEM is never logged or included in returned errors.
+func LoadX509KeyPair(cert, key string) (tls.Certificate, error) {
+	certPEM, err := ReadPEM(cert)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := ReadPEM(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	log.Debug(fmt.Sprintf("Loading client cert from %s and key from %s", describePEM(cert), describePEM(key)))
+	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("invalid client cert/key pair (cert %s, key %s): %s", describePEM(cert), describePEM(key), err)
+	}
+	return tlsCert, nil
+}
+
+// LoadCertPool returns a pool of the CA certificates in caCert, which may
+// be the path of a PEM encoded file or the PEM data itself.
+// It returns an error if caCert cannot be read or holds no certificate, so
+// that a bad CA never silently leaves connections verified against the
+// system pool.
+func LoadCertPool(caCert string) (*x509.CertPool, error) {
+	caPEM, err := ReadPEM(caCert)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CA certificates %s: %s", describePEM(caCert), err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("invalid CA certificates %s: no PEM encoded certificate found", describePEM(caCert))
+	}
+	return pool, nil
+}
+
+// describePEM names the source of s without revealing inline PEM data.
+func describePEM(s string) string {
+	if IsPEM(s) {
+		return "inline PEM"
+	}
+	return s
+}
+
+// A CertificateReloader serves a client certificate loaded from files, and
+// loads it again once either file is modified, so that rotated certificates
+// are used for new connections without restarting confd. Inline PEM never
+// changes and is loaded only once.
+type CertificateReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    tls.Certificate
+	modTime time.Time
+}
+
+// NewCertificateReloader loads the key pair in cert and key, which may each
+// be a file path or inline PEM as accepted by LoadX509KeyPair.
+// It returns an error if the key pair cannot be loaded.
+func NewCertificateReloader(cert, key string) (*CertificateReloader, error) {
+	r := &CertificateReloader{certFile: cert, keyFile: key}
+	if err := r.reload(r.lastModified()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetClientCertificate returns the current certificate, reloading it first
+// if its files changed. It can be used as tls.Config.GetClientCertificate.
+// If reloading fails the previous certificate is kept.
+func (r *CertificateReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if modTime := r.lastModified(); modTime.After(r.modTime) {
+		if err := r.reload(modTime); err != nil {
+			log.Error("Cannot reload client certificate: " + err.Error())
+		} else {
+			log.Info("Reloaded client certificate")
+		}
+	}
+	cert := r.cert
+	return &cert, nil
+}
+
+// reload loads the key pair and records modTime as the time it was last
+// modified.
+func (r *CertificateReloader) reload(modTime time.Time) error {
+	cert, err := LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = cert
+	r.modTime = modTime
+	return nil
+}
+
+// lastModified returns the latest modification time of the key pair files.
+func (r *CertificateReloader) lastModified() time.Time {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		if IsPEM(name) {
+			continue
+		}
+		if fi, err := os.Stat(name); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
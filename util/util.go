@@ -1,11 +1,15 @@
 package util
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/kelseyhightower/confd/log"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 // Nodes is a custom flag Var representing a list of etcd nodes.
@@ -30,6 +34,31 @@ type FileInfo struct {
 	Md5  string
 }
 
+// NormalizePrefix returns prefix with a single leading slash and no
+// trailing slash, so that "foo", "/foo" and "/foo/" name the same prefix.
+// The empty prefix is "/".
+func NormalizePrefix(prefix string) string {
+	return path.Join("/", prefix)
+}
+
+// TrimPathPrefix returns key relative to prefix, as an absolute path, and
+// whether key is prefix or lies below it. Keys sharing only the first
+// characters of the last element of prefix, such as /foobar for /foo, are
+// not below it.
+func TrimPathPrefix(key, prefix string) (string, bool) {
+	key, prefix = path.Join("/", key), NormalizePrefix(prefix)
+	if prefix == "/" {
+		return key, true
+	}
+	if key == prefix {
+		return "/", true
+	}
+	if !strings.HasPrefix(key, prefix+"/") {
+		return "", false
+	}
+	return strings.TrimPrefix(key, prefix), true
+}
+
 func AppendPrefix(prefix string, keys []string) []string {
 	s := make([]string, len(keys))
 	for i, k := range keys {
@@ -46,11 +75,62 @@ func IsFileExist(fpath string) bool {
 	return true
 }
 
+// Comparison methods used to decide whether a config file changed.
+const (
+	// CompareBytes compares the file contents byte for byte.
+	CompareBytes = "bytes"
+	// CompareHash compares the md5 sums of the files.
+	CompareHash = "hash"
+	// CompareNormalized compares the file contents ignoring trailing
+	// whitespace on every line and trailing blank lines.
+	CompareNormalized = "normalized"
+)
+
+// IsValidCompareMethod reports whether method is a known comparison method.
+func IsValidCompareMethod(method string) bool {
+	switch method {
+	case CompareBytes, CompareHash, CompareNormalized:
+		return true
+	}
+	return false
+}
+
+// ParseUmask parses s, an octal umask such as "022". An empty s is a umask
+// of 0.
+// It returns an error if s is not an octal permission mask.
+func ParseUmask(s string) (os.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+	umask, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || umask > 0777 {
+		return 0, fmt.Errorf("Invalid umask %q, want an octal mask such as 022", s)
+	}
+	return os.FileMode(umask), nil
+}
+
+// ParseMode parses s, an octal permission mode such as "0644" or "644".
+// It returns an error if s is not an octal mode.
+func ParseMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 07777 {
+		return 0, fmt.Errorf("Invalid mode %q, want an octal mode such as 0644", s)
+	}
+	return os.FileMode(mode), nil
+}
+
 // IsConfigChanged reports whether src and dest config files are equal.
 // Two config files are equal when they have the same file contents and
 // Unix permissions. The owner, group, and mode must match.
 // It return false in other cases.
 func IsConfigChanged(src, dest string) (bool, error) {
+	return IsConfigChangedWith(src, dest, CompareHash)
+}
+
+// IsConfigChangedWith is like IsConfigChanged but compares the file
+// contents using method, one of CompareBytes, CompareHash or
+// CompareNormalized. IsConfigChanged uses CompareHash.
+func IsConfigChangedWith(src, dest, method string) (bool, error) {
 	if !IsFileExist(dest) {
 		return true, nil
 	}
@@ -71,15 +151,56 @@ func IsConfigChanged(src, dest string) (bool, error) {
 	if d.Mode != s.Mode {
 		log.Info(fmt.Sprintf("%s has mode %s should be %s", dest, os.FileMode(d.Mode), os.FileMode(s.Mode)))
 	}
-	if d.Md5 != s.Md5 {
-		log.Info(fmt.Sprintf("%s has md5sum %s should be %s", dest, d.Md5, s.Md5))
+	contentChanged, err := isContentChanged(src, dest, method, s, d)
+	if err != nil {
+		return true, err
 	}
-	if d.Uid != s.Uid || d.Gid != s.Gid || d.Mode != s.Mode || d.Md5 != s.Md5 {
+	if d.Uid != s.Uid || d.Gid != s.Gid || d.Mode != s.Mode || contentChanged {
 		return true, nil
 	}
 	return false, nil
 }
 
+func isContentChanged(src, dest, method string, s, d FileInfo) (bool, error) {
+	switch method {
+	case CompareHash:
+		if d.Md5 != s.Md5 {
+			log.Info(fmt.Sprintf("%s has md5sum %s should be %s", dest, d.Md5, s.Md5))
+			return true, nil
+		}
+		return false, nil
+	case CompareBytes, CompareNormalized:
+		srcBytes, err := ioutil.ReadFile(src)
+		if err != nil {
+			return true, err
+		}
+		destBytes, err := ioutil.ReadFile(dest)
+		if err != nil {
+			return true, err
+		}
+		if method == CompareNormalized {
+			srcBytes = normalize(srcBytes)
+			destBytes = normalize(destBytes)
+		}
+		if !bytes.Equal(srcBytes, destBytes) {
+			log.Info(fmt.Sprintf("%s has different contents (compared using %s)", dest, method))
+			return true, nil
+		}
+		return false, nil
+	}
+	return true, fmt.Errorf("unknown compare method %q", method)
+}
+
+// normalize strips trailing whitespace from every line of b, and trailing
+// blank lines from its end.
+func normalize(b []byte) []byte {
+	lines := bytes.Split(b, []byte("\n"))
+	for i, line := range lines {
+		lines[i] = bytes.TrimRight(line, " \t\r")
+	}
+	return bytes.TrimRight(bytes.Join(lines, []byte("\n")), "\n")
+}
+
 func IsDirectory(path string) (bool, error) {
 	f, err := os.Stat(path)
 	if err != nil {